@@ -0,0 +1,435 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// APIConfig 局域网内通过 HTTP 控制下载
+type APIConfig struct {
+	Addr  string `json:"addr"`  // 监听地址，例如 0.0.0.0:8787，为空时不启动
+	Token string `json:"token"` // 访问令牌，请求时放在 Authorization: Bearer 中或者 ?token= 参数中
+}
+
+// 运行阶段的名称，和命令行的命令一致
+const (
+	StageCrawl    = "crawl"
+	StageResolve  = "resolve"
+	StageDownload = "download"
+	StageSync     = "sync"
+)
+
+// maxPageSize 视频列表一页最多的条数
+const maxPageSize = 500
+
+// sseKeepAlive 没有事件时发送注释的间隔，避免代理断开连接
+const sseKeepAlive = 30 * time.Second
+
+// NewToken 生成随机的访问令牌
+func NewToken() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// applyStages 按阶段名称设置要执行的功能，没有指定时执行 sync
+func applyStages(conf Conf, stages []string) (Conf, error) {
+	if len(stages) == 0 {
+		stages = []string{StageSync}
+	}
+	conf.GetUrl, conf.FillUrl, conf.Download = false, false, false
+	for _, stage := range stages {
+		switch strings.TrimSpace(stage) {
+		case StageCrawl:
+			conf.GetUrl = true
+		case StageResolve:
+			conf.FillUrl = true
+		case StageDownload:
+			conf.Download = true
+		case StageSync:
+			conf.GetUrl, conf.FillUrl, conf.Download = true, true, true
+		default:
+			return conf, fmt.Errorf("未知的阶段 %q，可选 %s、%s、%s、%s", stage, StageCrawl, StageResolve, StageDownload, StageSync)
+		}
+	}
+	return conf, nil
+}
+
+// apiHandler 远程控制的 HTTP 接口，使用启动时的配置
+type apiHandler struct {
+	s    *Server
+	conf Conf
+	mux  *http.ServeMux
+}
+
+// NewAPIHandler 所有接口都需要 conf.API.Token，返回 JSON，出错时为 {"error": "..."}
+func NewAPIHandler(s *Server, conf Conf) http.Handler {
+	h := &apiHandler{s: s, conf: conf, mux: http.NewServeMux()}
+	h.mux.HandleFunc("/api/status", h.status)
+	h.mux.HandleFunc("/api/run", h.run)
+	h.mux.HandleFunc("/api/stop", h.stop)
+	h.mux.HandleFunc("/api/events", h.events)
+	h.mux.HandleFunc("/api/videos", h.videos)
+	h.mux.HandleFunc("/api/videos/", h.video)
+	h.mux.HandleFunc("/api/channels", h.channels)
+	return h
+}
+
+func (h *apiHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if token == "" {
+		token = r.URL.Query().Get("token")
+	}
+	if h.conf.API.Token == "" || subtle.ConstantTimeCompare([]byte(token), []byte(h.conf.API.Token)) != 1 {
+		writeError(w, http.StatusUnauthorized, errors.New("token 错误"))
+		return
+	}
+	h.mux.ServeHTTP(w, r)
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(code)
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(v); err != nil {
+		log.Println("返回数据错误", err)
+	}
+}
+
+func writeError(w http.ResponseWriter, code int, err error) {
+	writeJSON(w, code, map[string]string{"error": err.Error()})
+}
+
+// allowMethods 请求方法不对时返回 405
+func allowMethods(w http.ResponseWriter, r *http.Request, methods ...string) bool {
+	for _, m := range methods {
+		if r.Method == m {
+			return true
+		}
+	}
+	w.Header().Set("Allow", strings.Join(methods, ", "))
+	writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("不支持 %s 请求", r.Method))
+	return false
+}
+
+// storeError 数据库错误对应的状态码
+func storeError(w http.ResponseWriter, err error) {
+	var terr *TransitionError
+	switch {
+	case errors.Is(err, gorm.ErrRecordNotFound):
+		writeError(w, http.StatusNotFound, errors.New("视频不存在"))
+	case errors.As(err, &terr):
+		writeError(w, http.StatusConflict, err)
+	default:
+		writeError(w, http.StatusInternalServerError, err)
+	}
+}
+
+// APIStatus 是否正在运行、下载进度和各个状态的视频数量
+type APIStatus struct {
+	Running bool                  `json:"running"`
+	Stats   StatsSnapshot         `json:"stats"`
+	Counts  map[VideoStatus]int64 `json:"counts"`
+}
+
+// status GET /api/status
+func (h *apiHandler) status(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodGet) {
+		return
+	}
+	if err := h.s.openStore(h.conf); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	counts, err := h.s.store.CountByStatus()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, APIStatus{Running: h.s.running.Load(), Stats: h.s.stats.Snapshot(), Counts: counts})
+}
+
+// run POST /api/run，{"stages": ["crawl", "resolve", "download"]} 或者 ?stages=sync，在后台运行，
+// 已经有任务在运行时返回 409
+func (h *apiHandler) run(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodPost) {
+		return
+	}
+	var req struct {
+		Stages []string `json:"stages"`
+	}
+	if v := r.URL.Query().Get("stages"); v != "" {
+		req.Stages = strings.Split(v, ",")
+	} else if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("请求格式错误: %w", err))
+			return
+		}
+	}
+	conf, err := applyStages(h.conf, req.Stages)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	// 返回 202 之前占用任务，同时收到的请求只有一个能启动
+	ctx, release, err := h.s.claimRun(context.Background())
+	if err != nil {
+		writeError(w, http.StatusConflict, err)
+		return
+	}
+	go func() {
+		defer release()
+		if err := h.s.RunWithHistory(ctx, conf, TriggerAPI); err != nil {
+			log.Println("远程启动的任务失败", err)
+		}
+	}()
+	writeJSON(w, http.StatusAccepted, map[string]bool{"getUrl": conf.GetUrl, "fillUrl": conf.FillUrl, "download": conf.Download})
+}
+
+// stop POST /api/stop，取消正在运行的任务
+func (h *apiHandler) stop(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodPost) {
+		return
+	}
+	running := h.s.running.Load()
+	h.s.Stop()
+	writeJSON(w, http.StatusOK, map[string]bool{"stopped": running})
+}
+
+// events GET /api/events，Server-Sent Events，每个进度事件一条消息，event 为事件类型，data 为 JSON
+func (h *apiHandler) events(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodGet) {
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, http.StatusInternalServerError, errors.New("不支持 Server-Sent Events"))
+		return
+	}
+	events, unsubscribe := h.s.events.Subscribe()
+	defer unsubscribe()
+	w.Header().Set("Content-Type", "text/event-stream; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprint(w, ": connected\n\n")
+	flusher.Flush()
+
+	ticker := time.NewTicker(sseKeepAlive)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-ticker.C:
+			fmt.Fprint(w, ": ping\n\n")
+		case e, ok := <-events:
+			if !ok {
+				return
+			}
+			data, err := json.Marshal(e)
+			if err != nil {
+				log.Println("返回数据错误", err)
+				continue
+			}
+			fmt.Fprintf(w, "event: %s\ndata: %s\n\n", e.Type, data)
+		}
+		flusher.Flush()
+	}
+}
+
+// APIVideoPage 一页视频
+type APIVideoPage struct {
+	Total int           `json:"total"`
+	Items []LibraryItem `json:"items"`
+}
+
+// videos GET /api/videos?status=failed,queued&channel=1&q=关键字&offset=0&limit=50
+func (h *apiHandler) videos(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodGet) {
+		return
+	}
+	query := r.URL.Query()
+	statuses, err := parseStatuses(query.Get("status"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	var channelID uint64
+	if v := query.Get("channel"); v != "" {
+		if channelID, err = strconv.ParseUint(v, 10, 64); err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("channel 格式错误 %q", v))
+			return
+		}
+	}
+	offset, limit := 0, 50
+	if v := query.Get("offset"); v != "" {
+		if offset, err = strconv.Atoi(v); err != nil || offset < 0 {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("offset 格式错误 %q", v))
+			return
+		}
+	}
+	if v := query.Get("limit"); v != "" {
+		if limit, err = strconv.Atoi(v); err != nil || limit <= 0 || limit > maxPageSize {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("limit 需要在 1 到 %d 之间", maxPageSize))
+			return
+		}
+	}
+
+	list, total, err := h.findVideos(r.Context(), statuses, uint(channelID), query.Get("q"), offset, limit)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	paths, err := h.s.videoPaths(h.conf)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	// 只查看这一页的本地文件
+	page := APIVideoPage{Total: total, Items: make([]LibraryItem, 0, len(list))}
+	for i := range list {
+		page.Items = append(page.Items, newLibraryItem(h.conf, paths, list[i]))
+	}
+	writeJSON(w, http.StatusOK, page)
+}
+
+// findVideos 按条件查询一页视频，同时返回总数。没有条件时直接在数据库中分页，
+// 有状态时只读取这些状态的视频，频道和关键字在内存中过滤
+func (h *apiHandler) findVideos(ctx context.Context, statuses []VideoStatus, channelID uint, q string, offset, limit int) ([]Video, int, error) {
+	if err := h.s.openStore(h.conf); err != nil {
+		return nil, 0, err
+	}
+	q = strings.ToLower(strings.TrimSpace(q))
+	if len(statuses) == 0 && channelID == 0 && q == "" {
+		list, total, err := h.s.store.ListPage(ctx, offset, limit)
+		return list, int(total), err
+	}
+	var list []Video
+	var err error
+	if len(statuses) > 0 {
+		list, err = h.s.store.ListByStatus(ctx, statuses...)
+	} else {
+		list, err = h.s.store.List()
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	matched := list[:0]
+	for _, v := range list {
+		if (channelID == 0 || v.ChannelID == channelID) && (q == "" || videoMatches(v, q)) {
+			matched = append(matched, v)
+		}
+	}
+	if offset >= len(matched) {
+		return nil, len(matched), nil
+	}
+	end := offset + limit
+	if end > len(matched) {
+		end = len(matched)
+	}
+	return matched[offset:end], len(matched), nil
+}
+
+// video GET /api/videos/{id} 查看一个视频，PATCH 或 POST {"needDownload": false} 修改是否需要下载
+func (h *apiHandler) video(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodGet, http.MethodPatch, http.MethodPost) {
+		return
+	}
+	id, err := strconv.ParseUint(strings.TrimPrefix(r.URL.Path, "/api/videos/"), 10, 64)
+	if err != nil {
+		writeError(w, http.StatusNotFound, errors.New("视频不存在"))
+		return
+	}
+	if err = h.s.openStore(h.conf); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if r.Method != http.MethodGet {
+		var req struct {
+			NeedDownload *bool `json:"needDownload"`
+		}
+		if err = json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("请求格式错误: %w", err))
+			return
+		}
+		if req.NeedDownload == nil {
+			writeError(w, http.StatusBadRequest, errors.New("缺少 needDownload"))
+			return
+		}
+		if _, err = h.s.store.GetVideo(uint(id)); err != nil {
+			storeError(w, err)
+			return
+		}
+		if err = h.s.SetNeedDownload(h.conf, uint(id), *req.NeedDownload); err != nil {
+			storeError(w, err)
+			return
+		}
+	}
+	v, err := h.s.store.GetVideo(uint(id))
+	if err != nil {
+		storeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, v)
+}
+
+// channels GET /api/channels
+func (h *apiHandler) channels(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodGet) {
+		return
+	}
+	if err := h.s.openStore(h.conf); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	channels, err := h.s.store.ListChannels()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, channels)
+}
+
+// ServeAPI 在 conf.API.Addr 上启动远程控制接口，直到 ctx 取消
+func (s *Server) ServeAPI(ctx context.Context, conf Conf) error {
+	ln, err := net.Listen("tcp", conf.API.Addr)
+	if err != nil {
+		return err
+	}
+	srv := &http.Server{
+		Handler:           NewAPIHandler(s, conf),
+		ReadHeaderTimeout: 10 * time.Second,
+		// 关闭时结束 /api/events 的长连接
+		BaseContext: func(net.Listener) context.Context { return ctx },
+	}
+	go func() {
+		<-ctx.Done()
+		shutdown, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := srv.Shutdown(shutdown); err != nil {
+			log.Println("关闭远程控制接口错误", err)
+		}
+	}()
+	log.Println("远程控制接口", ln.Addr())
+	if err = srv.Serve(ln); errors.Is(err, http.ErrServerClosed) {
+		return nil
+	}
+	return err
+}
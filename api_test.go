@@ -0,0 +1,267 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const testToken = "secret"
+
+// newTestAPI 使用内存存储的接口，已有 1 个频道和 3 个视频，ID 从 1 开始
+func newTestAPI(t *testing.T) (*Server, *httptest.Server) {
+	store := NewMemoryStore()
+	ch := Channel{Url: "https://fake.test/home/1", Name: "平南", Enabled: true}
+	if err := store.SaveChannel(&ch); err != nil {
+		t.Fatal(err)
+	}
+	err := store.Save([]Video{
+		{ChannelID: ch.ID, WebUrl: "https://fake.test/v/1", SaveName: "牛歌戏第1集", Status: StatusResolved, WebDownloadUrl: "https://cdn/1", NeedDownload: true},
+		{ChannelID: ch.ID, WebUrl: "https://fake.test/v/2", SaveName: "牛歌戏第2集", Status: StatusFailed, NeedDownload: true},
+		{WebUrl: "https://fake.test/v/3", SaveName: "山歌", Status: StatusDownloaded, NeedDownload: true},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{store: store}
+	conf := DefaultConf()
+	conf.API = APIConfig{Addr: "127.0.0.1:0", Token: testToken}
+	conf.Retry = RetryPolicy{MaxAttempts: 1}
+	srv := httptest.NewServer(NewAPIHandler(s, conf))
+	t.Cleanup(srv.Close)
+	return s, srv
+}
+
+// apiRequest 发送带 token 的请求，返回状态码，结果解析到 out
+func apiRequest(t *testing.T, srv *httptest.Server, method, path, body string, out interface{}) int {
+	t.Helper()
+	req, err := http.NewRequest(method, srv.URL+path, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer "+testToken)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out != nil {
+		if err = json.Unmarshal(data, out); err != nil {
+			t.Fatalf("%s %s: %v, body %s", method, path, err, data)
+		}
+	}
+	return resp.StatusCode
+}
+
+func TestAPIAuth(t *testing.T) {
+	_, srv := newTestAPI(t)
+	for _, path := range []string{"/api/status", "/api/status?token=wrong", "/api/videos"} {
+		resp, err := http.Get(srv.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusUnauthorized {
+			t.Errorf("%s = %d, want 401", path, resp.StatusCode)
+		}
+	}
+	resp, err := http.Get(srv.URL + "/api/status?token=" + testToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("query token = %d", resp.StatusCode)
+	}
+}
+
+func TestAPIVideos(t *testing.T) {
+	s, srv := newTestAPI(t)
+
+	var page APIVideoPage
+	if code := apiRequest(t, srv, http.MethodGet, "/api/videos?limit=2", "", &page); code != http.StatusOK {
+		t.Fatalf("code = %d", code)
+	}
+	if page.Total != 3 || len(page.Items) != 2 || page.Items[0].SaveName != "牛歌戏第1集" {
+		t.Errorf("page = %+v", page)
+	}
+	apiRequest(t, srv, http.MethodGet, "/api/videos?status=failed,downloaded&channel=1", "", &page)
+	if page.Total != 1 || page.Items[0].SaveName != "牛歌戏第2集" {
+		t.Errorf("filtered page = %+v", page)
+	}
+	apiRequest(t, srv, http.MethodGet, "/api/videos?q=山歌&offset=5", "", &page)
+	if page.Total != 1 || page.Items == nil || len(page.Items) != 0 {
+		t.Errorf("offset page = %+v", page)
+	}
+	if code := apiRequest(t, srv, http.MethodGet, "/api/videos?status=unknown", "", nil); code != http.StatusBadRequest {
+		t.Errorf("unknown status = %d", code)
+	}
+
+	var v Video
+	if code := apiRequest(t, srv, http.MethodPatch, "/api/videos/2", `{"needDownload": false}`, &v); code != http.StatusOK {
+		t.Fatalf("patch = %d", code)
+	}
+	if v.Status != StatusSkipped || v.NeedDownload {
+		t.Errorf("after needDownload false: %s %v", v.Status, v.NeedDownload)
+	}
+	apiRequest(t, srv, http.MethodPost, "/api/videos/2", `{"needDownload": true}`, &v)
+	if got, _ := s.store.GetVideo(2); got.Status != StatusResolved || !got.NeedDownload {
+		t.Errorf("after needDownload true: %s %v", got.Status, got.NeedDownload)
+	}
+	if code := apiRequest(t, srv, http.MethodPatch, "/api/videos/2", `{}`, nil); code != http.StatusBadRequest {
+		t.Errorf("missing needDownload = %d", code)
+	}
+	if code := apiRequest(t, srv, http.MethodGet, "/api/videos/99", "", nil); code != http.StatusNotFound {
+		t.Errorf("missing video = %d", code)
+	}
+
+	var channels []Channel
+	if apiRequest(t, srv, http.MethodGet, "/api/channels", "", &channels); len(channels) != 1 || channels[0].Name != "平南" {
+		t.Errorf("channels = %+v", channels)
+	}
+}
+
+func TestAPIRun(t *testing.T) {
+	s, srv := newTestAPI(t)
+
+	if code := apiRequest(t, srv, http.MethodGet, "/api/run", "", nil); code != http.StatusMethodNotAllowed {
+		t.Errorf("GET /api/run = %d", code)
+	}
+	if code := apiRequest(t, srv, http.MethodPost, "/api/run", `{"stages": ["upload"]}`, nil); code != http.StatusBadRequest {
+		t.Errorf("unknown stage = %d", code)
+	}
+
+	// 只执行 resolve，fake.test 不是支持的平台，视频会获取地址失败
+	var started map[string]bool
+	if code := apiRequest(t, srv, http.MethodPost, "/api/run", `{"stages": ["resolve"]}`, &started); code != http.StatusAccepted {
+		t.Fatalf("run = %d", code)
+	}
+	if started["getUrl"] || !started["fillUrl"] || started["download"] {
+		t.Errorf("started = %v", started)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		runs, _ := s.store.ListRuns(0)
+		if len(runs) > 0 {
+			if runs[0].Trigger != TriggerAPI {
+				t.Errorf("trigger = %s", runs[0].Trigger)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("run did not finish")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	var status APIStatus
+	if code := apiRequest(t, srv, http.MethodGet, "/api/status", "", &status); code != http.StatusOK {
+		t.Fatalf("status = %d", code)
+	}
+	if status.Running || status.Counts[StatusDownloaded] != 1 {
+		t.Errorf("status = %+v", status)
+	}
+
+	s.running.Store(true)
+	defer s.running.Store(false)
+	if code := apiRequest(t, srv, http.MethodPost, "/api/run?stages=sync", "", nil); code != http.StatusConflict {
+		t.Errorf("run while running = %d", code)
+	}
+	var stopped map[string]bool
+	if apiRequest(t, srv, http.MethodPost, "/api/stop", "", &stopped); !stopped["stopped"] {
+		t.Errorf("stop = %v", stopped)
+	}
+}
+
+// TestAPIRunConcurrent 同时收到的启动请求只有一个返回 202，返回 202 的任务都会执行
+func TestAPIRunConcurrent(t *testing.T) {
+	s, srv := newTestAPI(t)
+	codes := make(chan int, 5)
+	var wg sync.WaitGroup
+	for i := 0; i < cap(codes); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			codes <- apiRequest(t, srv, http.MethodPost, "/api/run?stages=resolve", "", nil)
+		}()
+	}
+	wg.Wait()
+	close(codes)
+	var accepted int
+	for code := range codes {
+		switch code {
+		case http.StatusAccepted:
+			accepted++
+		case http.StatusConflict:
+		default:
+			t.Errorf("code = %d", code)
+		}
+	}
+	if accepted == 0 {
+		t.Fatal("no run started")
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		runs, _ := s.store.ListRuns(0)
+		if len(runs) >= accepted && !s.running.Load() {
+			for _, run := range runs {
+				if run.Status == RunSkipped {
+					t.Errorf("accepted run was skipped: %+v", run)
+				}
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d runs finished, %d accepted", len(runs), accepted)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestAPIEvents(t *testing.T) {
+	s, srv := newTestAPI(t)
+
+	resp, err := http.Get(srv.URL + "/api/events?token=" + testToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || !strings.HasPrefix(resp.Header.Get("Content-Type"), "text/event-stream") {
+		t.Fatalf("code = %d, content-type = %s", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+	r := bufio.NewReader(resp.Body)
+	// 连接后的注释说明已经订阅
+	if line, err := r.ReadString('\n'); err != nil || line != ": connected\n" {
+		t.Fatalf("first line = %q, %v", line, err)
+	}
+
+	s.events.Publish(Event{Type: EventDownloaded, Stage: StageDownload, VideoID: 2, Title: "牛歌戏第1集"})
+	var lines []string
+	for len(lines) < 2 {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		if line = strings.TrimSpace(line); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	if lines[0] != "event: downloaded" {
+		t.Errorf("event line = %q", lines[0])
+	}
+	var e Event
+	if err = json.Unmarshal([]byte(strings.TrimPrefix(lines[1], "data: ")), &e); err != nil || e.VideoID != 2 || e.Title != "牛歌戏第1集" {
+		t.Errorf("data = %q, %v", lines[1], err)
+	}
+}
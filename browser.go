@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/chromedp/cdproto/emulation"
+	"github.com/chromedp/chromedp"
+)
+
+const (
+	desktopUserAgent = "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/113.0.0.0 Safari/537.36"
+	mobileUserAgent  = "Mozilla/5.0 (Linux; Android 6.0; Nexus 5 Build/MRA58N) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/113.0.0.0 Mobile Safari/537.36"
+)
+
+// Browser 打开网页的浏览器，默认使用 chrome，测试时可以换成不需要浏览器的实现
+type Browser interface {
+	// NewPage 打开一个新的页面，用完后调用 Close
+	NewPage(ctx context.Context, conf Conf, userAgent string) (Page, error)
+}
+
+// Page 浏览器中的一个页面
+type Page interface {
+	Navigate(url string) error
+	// WaitVisible 等待元素出现
+	WaitVisible(sel string) error
+	// ScrollToBottom 滚动到页面底部，触发加载更多
+	ScrollToBottom() error
+	// OuterHTML 第一个匹配的元素的 html，元素不存在时一直等待
+	OuterHTML(sel string) (string, error)
+	Sleep(d time.Duration) error
+	Close()
+}
+
+// chromeProcess 通过 chromedp 启动的本机 chrome，每个页面是一个标签页
+type chromeProcess struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// launchChrome 启动 chrome，在 Close 之前一直运行
+func launchChrome(conf Conf) (browserProcess, error) {
+	options := []chromedp.ExecAllocatorOption{
+		chromedp.Flag("headless", !conf.ShowBrowser), // debug使用
+	}
+	//初始化参数，先传一个空的数据
+	options = append(chromedp.DefaultExecAllocatorOptions[:], options...)
+
+	c, c1 := chromedp.NewExecAllocator(context.Background(), options...)
+	chromeCtx, c2 := chromedp.NewContext(c, chromedp.WithLogf(log.Printf))
+	// 启动浏览器
+	if err := chromedp.Run(chromeCtx); err != nil {
+		c2()
+		c1()
+		return nil, err
+	}
+	return &chromeProcess{ctx: chromeCtx, cancel: func() { c2(); c1() }}, nil
+}
+
+// NewTab 打开一个标签页，ctx 结束时标签页也关闭
+func (p *chromeProcess) NewTab(ctx context.Context, userAgent string) (Page, error) {
+	tabCtx, cancel := chromedp.NewContext(p.ctx)
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			cancel()
+		case <-done:
+		}
+	}()
+	page := &chromePage{ctx: tabCtx, cancel: func() {
+		close(done)
+		cancel()
+	}}
+	if err := chromedp.Run(tabCtx, emulation.SetUserAgentOverride(userAgent)); err != nil {
+		page.Close()
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, err
+	}
+	return page, nil
+}
+
+// Alive chrome 崩溃或者被关掉时 chromedp 会取消浏览器的 ctx
+func (p *chromeProcess) Alive() bool {
+	return p.ctx.Err() == nil
+}
+
+func (p *chromeProcess) Close() {
+	_ = chromedp.Cancel(p.ctx)
+	p.cancel()
+}
+
+type chromePage struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+func (p *chromePage) Navigate(url string) error {
+	return chromedp.Run(p.ctx, chromedp.Navigate(url))
+}
+
+func (p *chromePage) WaitVisible(sel string) error {
+	return chromedp.Run(p.ctx, chromedp.WaitVisible(sel))
+}
+
+func (p *chromePage) ScrollToBottom() error {
+	return chromedp.Run(p.ctx, chromedp.Evaluate(`window.scrollTo(0, document.documentElement.scrollHeight)`, nil))
+}
+
+func (p *chromePage) OuterHTML(sel string) (string, error) {
+	var html string
+	err := chromedp.Run(p.ctx, chromedp.OuterHTML(sel, &html, chromedp.ByQuery))
+	return html, err
+}
+
+func (p *chromePage) Sleep(d time.Duration) error {
+	return chromedp.Run(p.ctx, chromedp.Sleep(d))
+}
+
+// Close 关闭标签页
+func (p *chromePage) Close() {
+	_ = chromedp.Cancel(p.ctx)
+	p.cancel()
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sync"
+)
+
+// errBrowserClosed 任务已经结束，浏览器已经关闭
+var errBrowserClosed = errors.New("浏览器已关闭")
+
+// browserProcess 一个启动后的浏览器，可以打开多个页面
+type browserProcess interface {
+	NewTab(ctx context.Context, userAgent string) (Page, error)
+	// Alive 浏览器是否还在运行，崩溃后返回 false
+	Alive() bool
+	Close()
+}
+
+// BrowserPool 一次任务中共用一个浏览器：第一次打开页面时启动，最多同时打开 conf.BrowserTabs 个页面，
+// 其他的等待页面关闭；浏览器崩溃后重新启动，任务结束时调用 Close 退出
+type BrowserPool struct {
+	conf   Conf
+	launch func(conf Conf) (browserProcess, error) // 测试时替换
+	tabs   chan struct{}
+
+	mu     sync.Mutex
+	proc   browserProcess
+	closed bool
+}
+
+// NewBrowserPool 创建浏览器池，这时还不会启动浏览器
+func NewBrowserPool(conf Conf) *BrowserPool {
+	tabs := conf.BrowserTabs
+	if tabs <= 0 {
+		tabs = 1
+	}
+	return &BrowserPool{conf: conf, launch: launchChrome, tabs: make(chan struct{}, tabs)}
+}
+
+// NewPage 等到有空闲的页面数后打开一个页面，页面 Close 后让给其他的请求
+func (p *BrowserPool) NewPage(ctx context.Context, conf Conf, userAgent string) (Page, error) {
+	select {
+	case p.tabs <- struct{}{}:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	page, err := p.openTab(ctx, userAgent)
+	if err != nil {
+		<-p.tabs
+		return nil, err
+	}
+	return &releasePage{Page: page, release: func() { <-p.tabs }}, nil
+}
+
+// openTab 打开页面失败并且浏览器已经退出时，重新启动浏览器再打开一次
+func (p *BrowserPool) openTab(ctx context.Context, userAgent string) (Page, error) {
+	for retried := false; ; retried = true {
+		proc, err := p.process()
+		if err != nil {
+			return nil, err
+		}
+		page, err := proc.NewTab(ctx, userAgent)
+		if err == nil || retried || proc.Alive() || ctx.Err() != nil {
+			return page, err
+		}
+	}
+}
+
+// process 返回正在运行的浏览器，还没有启动或者已经崩溃时启动一个新的
+func (p *BrowserPool) process() (browserProcess, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return nil, errBrowserClosed
+	}
+	if p.proc != nil {
+		if p.proc.Alive() {
+			return p.proc, nil
+		}
+		log.Println("浏览器已退出，重新启动")
+		p.proc.Close()
+		p.proc = nil
+	}
+	proc, err := p.launch(p.conf)
+	if err != nil {
+		return nil, err
+	}
+	p.proc = proc
+	return proc, nil
+}
+
+// Close 关闭浏览器，之后不能再打开页面，可以重复调用
+func (p *BrowserPool) Close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.closed = true
+	if p.proc != nil {
+		p.proc.Close()
+		p.proc = nil
+	}
+}
+
+// releasePage 关闭时执行 release，只执行一次
+type releasePage struct {
+	Page
+	once    sync.Once
+	release func()
+}
+
+func (p *releasePage) Close() {
+	p.once.Do(func() {
+		p.Page.Close()
+		p.release()
+	})
+}
+
+type browserKey struct{}
+
+// withBrowser 任务中打开的页面都使用 b
+func withBrowser(ctx context.Context, b Browser) context.Context {
+	return context.WithValue(ctx, browserKey{}, b)
+}
+
+// openPage 使用任务的浏览器打开页面，不在任务中时单独启动一个浏览器，页面关闭时退出
+func openPage(ctx context.Context, conf Conf, userAgent string) (Page, error) {
+	if b, ok := ctx.Value(browserKey{}).(Browser); ok {
+		return b.NewPage(ctx, conf, userAgent)
+	}
+	pool := NewBrowserPool(conf)
+	page, err := pool.NewPage(ctx, conf, userAgent)
+	if err != nil {
+		pool.Close()
+		return nil, err
+	}
+	return &releasePage{Page: page, release: pool.Close}, nil
+}
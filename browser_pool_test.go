@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeProcess 测试用的浏览器，crash 后打开页面失败
+type fakeProcess struct {
+	mu      sync.Mutex
+	crashed bool
+	closed  bool
+	tabs    int
+}
+
+func (p *fakeProcess) NewTab(ctx context.Context, userAgent string) (Page, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.crashed || p.closed {
+		return nil, errors.New("websocket: close 1006")
+	}
+	p.tabs++
+	return &httpPage{ctx: ctx, userAgent: userAgent}, nil
+}
+
+func (p *fakeProcess) Alive() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return !p.crashed && !p.closed
+}
+
+func (p *fakeProcess) Close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.closed = true
+}
+
+func (p *fakeProcess) crash() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.crashed = true
+}
+
+// newTestPool 返回浏览器池和启动过的浏览器
+func newTestPool(tabs int) (*BrowserPool, *[]*fakeProcess) {
+	conf := DefaultConf()
+	conf.BrowserTabs = tabs
+	pool := NewBrowserPool(conf)
+	var launched []*fakeProcess
+	pool.launch = func(Conf) (browserProcess, error) {
+		p := &fakeProcess{}
+		launched = append(launched, p)
+		return p, nil
+	}
+	return pool, &launched
+}
+
+func TestBrowserPoolTabs(t *testing.T) {
+	pool, launched := newTestPool(2)
+	defer pool.Close()
+	ctx := context.Background()
+
+	a, err := pool.NewPage(ctx, DefaultConf(), mobileUserAgent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := pool.NewPage(ctx, DefaultConf(), mobileUserAgent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 两个页面都在使用，第三个要等待
+	timeout, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	if _, err = pool.NewPage(timeout, DefaultConf(), mobileUserAgent); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("third page err = %v", err)
+	}
+
+	got := make(chan error)
+	go func() {
+		c, err := pool.NewPage(ctx, DefaultConf(), mobileUserAgent)
+		if err == nil {
+			c.Close()
+		}
+		got <- err
+	}()
+	a.Close()
+	a.Close() // 重复关闭不会多让出一个页面
+	if err = <-got; err != nil {
+		t.Fatal(err)
+	}
+	b.Close()
+	if len(*launched) != 1 || (*launched)[0].tabs != 3 {
+		t.Errorf("launched %d browsers", len(*launched))
+	}
+}
+
+func TestBrowserPoolRestart(t *testing.T) {
+	pool, launched := newTestPool(1)
+	page, err := pool.NewPage(context.Background(), DefaultConf(), desktopUserAgent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	page.Close()
+
+	// 浏览器崩溃后重新启动
+	(*launched)[0].crash()
+	if page, err = pool.NewPage(context.Background(), DefaultConf(), desktopUserAgent); err != nil {
+		t.Fatal(err)
+	}
+	page.Close()
+	if len(*launched) != 2 || !(*launched)[0].closed {
+		t.Fatalf("launched = %d", len(*launched))
+	}
+
+	// 任务结束后关闭浏览器，不能再打开页面
+	pool.Close()
+	if !(*launched)[1].closed {
+		t.Error("browser should be closed")
+	}
+	if _, err = pool.NewPage(context.Background(), DefaultConf(), desktopUserAgent); !errors.Is(err, errBrowserClosed) {
+		t.Errorf("after Close err = %v", err)
+	}
+}
+
+func TestOpenPageUsesRunBrowser(t *testing.T) {
+	pool, launched := newTestPool(1)
+	defer pool.Close()
+	ctx := withBrowser(context.Background(), pool)
+	for i := 0; i < 3; i++ {
+		page, err := openPage(ctx, DefaultConf(), desktopUserAgent)
+		if err != nil {
+			t.Fatal(err)
+		}
+		page.Close()
+	}
+	if len(*launched) != 1 || (*launched)[0].tabs != 3 {
+		t.Errorf("launched = %d", len(*launched))
+	}
+}
@@ -0,0 +1,408 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// 导出、导入视频目录的格式
+const (
+	FormatJSONL = "jsonl"
+	FormatCSV   = "csv"
+)
+
+// CatalogRecord 导出的一个视频，频道用地址表示，导入到另一个数据库时按地址找到对应的频道
+type CatalogRecord struct {
+	WebUrl         string      `json:"webUrl"`
+	MUrl           string      `json:"MUrl,omitempty"`
+	Source         string      `json:"source,omitempty"`
+	OriginName     string      `json:"originName,omitempty"`
+	SaveName       string      `json:"title,omitempty"`
+	WebDownloadUrl string      `json:"webDownloadUrl,omitempty"`
+	MDownloadUrl   string      `json:"MDownloadUrl,omitempty"`
+	NeedDownload   bool        `json:"needDownload"`
+	Status         VideoStatus `json:"status,omitempty"`
+	ChannelUrl     string      `json:"channelUrl,omitempty"`
+	ChannelName    string      `json:"channelName,omitempty"`
+}
+
+// catalogColumns csv 的表头，和 json 的字段名一致
+var catalogColumns = []string{"webUrl", "MUrl", "source", "originName", "title", "webDownloadUrl", "MDownloadUrl",
+	"needDownload", "status", "channelUrl", "channelName"}
+
+func (r CatalogRecord) csvRow() []string {
+	return []string{r.WebUrl, r.MUrl, r.Source, r.OriginName, r.SaveName, r.WebDownloadUrl, r.MDownloadUrl,
+		strconv.FormatBool(r.NeedDownload), string(r.Status), r.ChannelUrl, r.ChannelName}
+}
+
+// ExportFilter 导出的范围，为空时导出所有视频
+type ExportFilter struct {
+	ChannelID uint
+	Statuses  []VideoStatus
+}
+
+// CatalogFormat 根据文件扩展名判断格式，.csv 为 csv，其他为 jsonl
+func CatalogFormat(path string) string {
+	if strings.EqualFold(filepath.Ext(path), ".csv") {
+		return FormatCSV
+	}
+	return FormatJSONL
+}
+
+func checkFormat(format string) error {
+	if format != FormatJSONL && format != FormatCSV {
+		return fmt.Errorf("不支持的格式 %q，可选 %s、%s", format, FormatJSONL, FormatCSV)
+	}
+	return nil
+}
+
+// ExportCatalog 按 filter 导出视频，返回导出的个数
+func ExportCatalog(ctx context.Context, store Repository, w io.Writer, format string, filter ExportFilter) (int, error) {
+	if err := checkFormat(format); err != nil {
+		return 0, err
+	}
+	var list []Video
+	var err error
+	if len(filter.Statuses) > 0 {
+		list, err = store.ListByStatus(ctx, filter.Statuses...)
+	} else {
+		list, err = store.List()
+	}
+	if err != nil {
+		return 0, err
+	}
+	channels, err := store.ListChannels()
+	if err != nil {
+		return 0, err
+	}
+	byID := make(map[uint]Channel, len(channels))
+	for _, c := range channels {
+		byID[c.ID] = c
+	}
+
+	var records []CatalogRecord
+	for _, v := range list {
+		if filter.ChannelID != 0 && v.ChannelID != filter.ChannelID {
+			continue
+		}
+		ch := byID[v.ChannelID]
+		records = append(records, CatalogRecord{
+			WebUrl:         v.WebUrl,
+			MUrl:           v.MUrl,
+			Source:         v.Source,
+			OriginName:     v.OriginName,
+			SaveName:       v.SaveName,
+			WebDownloadUrl: v.WebDownloadUrl,
+			MDownloadUrl:   v.MDownloadUrl,
+			NeedDownload:   v.NeedDownload,
+			Status:         v.Status,
+			ChannelUrl:     ch.Url,
+			ChannelName:    ch.Name,
+		})
+	}
+
+	switch format {
+	case FormatCSV:
+		// 加上 BOM，Excel 打开时中文不会乱码
+		if _, err = io.WriteString(w, "\ufeff"); err != nil {
+			return 0, err
+		}
+		cw := csv.NewWriter(w)
+		if err = cw.Write(catalogColumns); err != nil {
+			return 0, err
+		}
+		for _, r := range records {
+			if err = cw.Write(r.csvRow()); err != nil {
+				return 0, err
+			}
+		}
+		cw.Flush()
+		err = cw.Error()
+	default:
+		enc := json.NewEncoder(w)
+		enc.SetEscapeHTML(false)
+		for _, r := range records {
+			if err = enc.Encode(r); err != nil {
+				return 0, err
+			}
+		}
+	}
+	return len(records), err
+}
+
+// ReadCatalog 读取导出的文件，格式错误时返回出错的行号
+func ReadCatalog(r io.Reader, format string) ([]CatalogRecord, error) {
+	if err := checkFormat(format); err != nil {
+		return nil, err
+	}
+	var records []CatalogRecord
+	if format == FormatJSONL {
+		scanner := bufio.NewScanner(r)
+		scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+		for line := 1; scanner.Scan(); line++ {
+			text := strings.TrimSpace(scanner.Text())
+			if text == "" {
+				continue
+			}
+			// 没有 needDownload 字段时默认需要下载
+			rec := CatalogRecord{NeedDownload: true}
+			if err := json.Unmarshal([]byte(text), &rec); err != nil {
+				return nil, fmt.Errorf("第 %d 行: %w", line, err)
+			}
+			records = append(records, rec)
+		}
+		return records, scanner.Err()
+	}
+
+	cr := csv.NewReader(r)
+	header, err := cr.Read()
+	if err != nil {
+		return nil, fmt.Errorf("读取表头失败: %w", err)
+	}
+	// 按表头对应列，列的顺序可以调整，缺少的列为空
+	index := make(map[string]int, len(header))
+	for i, name := range header {
+		index[strings.TrimSpace(strings.TrimPrefix(name, "\ufeff"))] = i
+	}
+	if _, ok := index["webUrl"]; !ok {
+		return nil, errors.New("缺少 webUrl 列")
+	}
+	for line := 2; ; line++ {
+		row, err := cr.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		get := func(name string) string {
+			if i, ok := index[name]; ok && i < len(row) {
+				return strings.TrimSpace(row[i])
+			}
+			return ""
+		}
+		rec := CatalogRecord{
+			WebUrl:         get("webUrl"),
+			MUrl:           get("MUrl"),
+			Source:         get("source"),
+			OriginName:     get("originName"),
+			SaveName:       get("title"),
+			WebDownloadUrl: get("webDownloadUrl"),
+			MDownloadUrl:   get("MDownloadUrl"),
+			NeedDownload:   true,
+			Status:         VideoStatus(get("status")),
+			ChannelUrl:     get("channelUrl"),
+			ChannelName:    get("channelName"),
+		}
+		if v := get("needDownload"); v != "" {
+			if rec.NeedDownload, err = strconv.ParseBool(v); err != nil {
+				return nil, fmt.Errorf("第 %d 行: needDownload %q 不是 true 或 false", line, v)
+			}
+		}
+		records = append(records, rec)
+	}
+	return records, nil
+}
+
+// ImportOptions 导入时的冲突处理
+type ImportOptions struct {
+	// OverwriteNames 用导入的保存名称覆盖本地的保存名称，默认保留本地的
+	OverwriteNames bool
+}
+
+// ImportResult 导入的结果
+type ImportResult struct {
+	Added     int
+	Updated   int
+	Unchanged int
+	Skipped   int // 没有播放地址的记录
+	Channels  int // 新建的频道
+}
+
+func (r ImportResult) String() string {
+	return fmt.Sprintf("新增 %d 个，更新 %d 个，没有变化 %d 个，跳过 %d 个，新建频道 %d 个",
+		r.Added, r.Updated, r.Unchanged, r.Skipped, r.Channels)
+}
+
+// ImportCatalog 按播放地址合并到数据库：
+//   - 本地没有的视频直接新增，导入的已下载视频在本地重新下载
+//   - 本地已有的视频保留本地的保存名称、状态和频道，下载地址用导入的覆盖，本地为空的字段用导入的补充
+//   - 频道按地址对应，本地没有的频道新建为停用
+//   - 不是支持的平台的播放地址跳过
+func ImportCatalog(ctx context.Context, store Repository, records []CatalogRecord, opts ImportOptions) (ImportResult, error) {
+	var result ImportResult
+	channels := make(map[string]uint)
+	channelFor := func(rec CatalogRecord) (uint, error) {
+		if rec.ChannelUrl == "" {
+			return 0, nil
+		}
+		if id, ok := channels[rec.ChannelUrl]; ok {
+			return id, nil
+		}
+		ch, err := store.findChannelByUrl(rec.ChannelUrl)
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			ch = Channel{Url: rec.ChannelUrl, Name: rec.ChannelName, Source: rec.Source}
+			if err = store.SaveChannel(&ch); err == nil {
+				result.Channels++
+			}
+		}
+		if err != nil {
+			return 0, err
+		}
+		channels[rec.ChannelUrl] = ch.ID
+		return ch.ID, nil
+	}
+
+	for _, rec := range records {
+		if err := ctx.Err(); err != nil {
+			return result, err
+		}
+		webUrl, err := importUrl(rec)
+		if err != nil {
+			log.Println("跳过", err)
+			result.Skipped++
+			continue
+		}
+		rec.WebUrl = webUrl
+		channelID, err := channelFor(rec)
+		if err != nil {
+			return result, err
+		}
+		local, err := store.findByWebUrl(ctx, rec.WebUrl)
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			if err = store.Save([]Video{importedVideo(rec, channelID)}); err != nil {
+				return result, fmt.Errorf("新增 %s 失败: %w", rec.WebUrl, err)
+			}
+			result.Added++
+			continue
+		}
+		if err != nil {
+			return result, err
+		}
+		changed, err := mergeVideo(store, local, rec, channelID, opts)
+		if err != nil {
+			return result, fmt.Errorf("更新 %s 失败: %w", rec.WebUrl, err)
+		}
+		if changed {
+			result.Updated++
+		} else {
+			result.Unchanged++
+		}
+	}
+	return result, nil
+}
+
+// importUrl 检查导入的播放地址，返回平台的规范地址，避免同一个地址写法不同时重复导入
+func importUrl(rec CatalogRecord) (string, error) {
+	raw := strings.TrimSpace(rec.WebUrl)
+	u, err := url.Parse(raw)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || strings.Trim(u.Path, "/") == "" {
+		return "", fmt.Errorf("不是有效的播放地址 %q", rec.WebUrl)
+	}
+	src, err := resolveSource(rec.Source, raw)
+	if err != nil {
+		return "", err
+	}
+	if !src.Match(u) {
+		return "", fmt.Errorf("%q 不是%s的播放地址", rec.WebUrl, src.Name())
+	}
+	return src.CanonicalUrl(raw), nil
+}
+
+// importedVideo 本地没有的视频，状态按下载地址重新计算
+func importedVideo(rec CatalogRecord, channelID uint) Video {
+	v := Video{
+		ChannelID:      channelID,
+		WebUrl:         rec.WebUrl,
+		MUrl:           rec.MUrl,
+		Source:         rec.Source,
+		OriginName:     rec.OriginName,
+		SaveName:       firstNonEmpty(rec.SaveName, rec.OriginName),
+		WebDownloadUrl: rec.WebDownloadUrl,
+		MDownloadUrl:   rec.MDownloadUrl,
+		NeedDownload:   rec.NeedDownload,
+	}
+	v.Status = inferStatus(v)
+	now := time.Now()
+	v.StatusAt = &now
+	return v
+}
+
+// mergeVideo 按导入规则合并到本地的视频，返回是否有修改
+func mergeVideo(store Repository, local Video, rec CatalogRecord, channelID uint, opts ImportOptions) (bool, error) {
+	update := Video{}
+	update.ID = local.ID
+	var changed bool
+	fill := func(dst *string, localValue, value string) {
+		if localValue == "" && value != "" {
+			*dst = value
+			changed = true
+		}
+	}
+	fill(&update.OriginName, local.OriginName, rec.OriginName)
+	fill(&update.Source, local.Source, rec.Source)
+	fill(&update.SaveName, local.SaveName, rec.SaveName)
+	if opts.OverwriteNames && rec.SaveName != "" && rec.SaveName != local.SaveName {
+		update.SaveName = rec.SaveName
+		changed = true
+	}
+	if rec.MUrl != "" && rec.MUrl != local.MUrl {
+		update.MUrl = rec.MUrl
+		changed = true
+	}
+	if local.ChannelID == 0 && channelID != 0 {
+		update.ChannelID = channelID
+		changed = true
+	}
+	if changed {
+		if err := store.Update(update); err != nil {
+			return false, err
+		}
+	}
+
+	// 下载地址用导入的覆盖，导入的为空时保留本地的
+	resolved := local
+	// 不知道导入的地址是什么时候获取的，地址中没有过期时间时下载前重新获取
+	if rec.WebDownloadUrl != "" && rec.WebDownloadUrl != local.WebDownloadUrl {
+		resolved.WebDownloadUrl, resolved.WebResolvedAt = rec.WebDownloadUrl, nil
+	}
+	if rec.MDownloadUrl != "" && rec.MDownloadUrl != local.MDownloadUrl {
+		resolved.MDownloadUrl, resolved.MResolvedAt = rec.MDownloadUrl, nil
+	}
+	if resolved.WebDownloadUrl != local.WebDownloadUrl || resolved.MDownloadUrl != local.MDownloadUrl {
+		if err := store.UpdateResolve(resolved); err != nil {
+			return false, err
+		}
+		changed = true
+	}
+	return changed, nil
+}
+
+// parseStatuses 解析逗号分隔的状态
+func parseStatuses(v string) ([]VideoStatus, error) {
+	var statuses []VideoStatus
+	for _, name := range strings.Split(v, ",") {
+		if name = strings.TrimSpace(name); name == "" {
+			continue
+		}
+		st := VideoStatus(name)
+		if _, ok := statusLabels[st]; !ok {
+			return nil, fmt.Errorf("未知的状态 %q，可选 %s", name, strings.Join(statusNames(), "、"))
+		}
+		statuses = append(statuses, st)
+	}
+	return statuses, nil
+}
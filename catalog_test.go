@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+)
+
+// catalogSource 导出用的数据库：一个频道，三个视频
+func catalogSource(t *testing.T) Repository {
+	store := newTestStore(t)
+	ch := Channel{Url: "https://www.ixigua.com/home/1/", Name: "平南牛歌戏", Folder: "平南", Enabled: true}
+	if err := store.SaveChannel(&ch); err != nil {
+		t.Fatal(err)
+	}
+	err := store.Save([]Video{
+		{ChannelID: ch.ID, WebUrl: "https://www.ixigua.com/1/", OriginName: "牛歌戏 第1集", SaveName: "第1集",
+			WebDownloadUrl: "https://v/1.mp4", NeedDownload: true, Status: StatusDownloaded},
+		{ChannelID: ch.ID, WebUrl: "https://www.ixigua.com/2/", OriginName: "牛歌戏 第2集, \"精彩\"", SaveName: "第2集",
+			NeedDownload: true, Status: StatusDiscovered},
+		{WebUrl: "https://www.ixigua.com/3/", OriginName: "片段", SaveName: "片段", Status: StatusSkipped},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return store
+}
+
+func TestCatalogRoundTrip(t *testing.T) {
+	for _, format := range []string{FormatJSONL, FormatCSV} {
+		t.Run(format, func(t *testing.T) {
+			var buf bytes.Buffer
+			n, err := ExportCatalog(context.Background(), catalogSource(t), &buf, format, ExportFilter{})
+			if err != nil || n != 3 {
+				t.Fatalf("export = %d, %v", n, err)
+			}
+			records, err := ReadCatalog(&buf, format)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			dst := NewMemoryStore()
+			result, err := ImportCatalog(context.Background(), dst, records, ImportOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if result.Added != 3 || result.Channels != 1 {
+				t.Errorf("result = %+v", result)
+			}
+			list, _ := dst.List()
+			if len(list) != 3 {
+				t.Fatalf("videos = %d", len(list))
+			}
+			// 导入的已下载视频需要在本地重新下载
+			if list[0].Status != StatusResolved || list[0].WebDownloadUrl != "https://v/1.mp4" || list[0].ChannelID == 0 {
+				t.Errorf("第1集 = %+v", list[0])
+			}
+			if list[1].OriginName != "牛歌戏 第2集, \"精彩\"" || list[1].Status != StatusDiscovered {
+				t.Errorf("第2集 = %+v", list[1])
+			}
+			if list[2].Status != StatusSkipped || list[2].ChannelID != 0 {
+				t.Errorf("片段 = %+v", list[2])
+			}
+			channels, _ := dst.ListChannels()
+			if len(channels) != 1 || channels[0].Name != "平南牛歌戏" || channels[0].Enabled {
+				t.Errorf("channels = %+v", channels)
+			}
+
+			// 再次导入没有变化
+			if result, _ = ImportCatalog(context.Background(), dst, records, ImportOptions{}); result.Unchanged != 3 {
+				t.Errorf("second import = %+v", result)
+			}
+		})
+	}
+}
+
+func TestExportFilter(t *testing.T) {
+	store := catalogSource(t)
+	var buf bytes.Buffer
+	n, err := ExportCatalog(context.Background(), store, &buf, FormatJSONL, ExportFilter{ChannelID: 1, Statuses: []VideoStatus{StatusDiscovered}})
+	if err != nil || n != 1 || !strings.Contains(buf.String(), "https://www.ixigua.com/2/") {
+		t.Errorf("export = %d, %v, %s", n, err, buf.String())
+	}
+}
+
+func TestImportMerge(t *testing.T) {
+	testRepositories(t, func(t *testing.T, store Repository) {
+		err := store.Save([]Video{{WebUrl: "https://www.ixigua.com/7/", OriginName: "原始", SaveName: "本地名称",
+			WebDownloadUrl: "https://old/a.mp4", NeedDownload: true, Status: StatusFailed}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		records := []CatalogRecord{
+			{WebUrl: "https://www.ixigua.com/7/", OriginName: "其他", SaveName: "导入名称", MUrl: "https://m/a/",
+				MDownloadUrl: "https://new/a.mp4", NeedDownload: false, Status: StatusSkipped},
+			// 地址前后有空格的是同一个视频
+			{WebUrl: " https://www.ixigua.com/7/ ", OriginName: "其他"},
+			{SaveName: "没有地址"},
+			{WebUrl: "https://www.ixigua.com", SaveName: "没有视频ID"},
+			{WebUrl: "ftp://www.ixigua.com/8/", SaveName: "不是网址"},
+			{WebUrl: "https://example.com/8/", SaveName: "不支持的平台"},
+			{WebUrl: "https://www.ixigua.com/8/", Source: "bilibili", SaveName: "不支持的平台"},
+		}
+		result, err := ImportCatalog(context.Background(), store, records, ImportOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result.Updated != 1 || result.Unchanged != 1 || result.Skipped != 5 || result.Added != 0 {
+			t.Errorf("result = %+v", result)
+		}
+		v, _ := store.findByWebUrl(context.Background(), "https://www.ixigua.com/7/")
+		// 保留本地的名称和状态，补充手机端地址，本地的下载地址不会被空值覆盖
+		if v.SaveName != "本地名称" || v.OriginName != "原始" || v.Status != StatusFailed || !v.NeedDownload ||
+			v.MUrl != "https://m/a/" || v.MDownloadUrl != "https://new/a.mp4" || v.WebDownloadUrl != "https://old/a.mp4" {
+			t.Errorf("merged = %+v", v)
+		}
+
+		if _, err = ImportCatalog(context.Background(), store, records, ImportOptions{OverwriteNames: true}); err != nil {
+			t.Fatal(err)
+		}
+		if v, _ = store.GetVideo(v.ID); v.SaveName != "导入名称" {
+			t.Errorf("overwrite names = %q", v.SaveName)
+		}
+	})
+}
+
+func TestReadCatalogErrors(t *testing.T) {
+	if _, err := ReadCatalog(strings.NewReader("{\"webUrl\":\"a\"}\n{bad\n"), FormatJSONL); err == nil || !strings.Contains(err.Error(), "第 2 行") {
+		t.Errorf("jsonl err = %v", err)
+	}
+	if _, err := ReadCatalog(strings.NewReader("title\n第1集\n"), FormatCSV); err == nil {
+		t.Error("csv without webUrl should fail")
+	}
+	if _, err := ReadCatalog(strings.NewReader("webUrl,needDownload\na,maybe\n"), FormatCSV); err == nil || !strings.Contains(err.Error(), "第 2 行") {
+		t.Errorf("csv err = %v", err)
+	}
+	// 只有 webUrl 列的简单列表也可以导入
+	records, err := ReadCatalog(strings.NewReader("webUrl\nhttps://a/\n"), FormatCSV)
+	if err != nil || len(records) != 1 || !records[0].NeedDownload {
+		t.Errorf("records = %+v, %v", records, err)
+	}
+	if _, err = ReadCatalog(strings.NewReader(""), "xml"); err == nil {
+		t.Error("unknown format should fail")
+	}
+}
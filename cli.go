@@ -0,0 +1,613 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+type runFunc func(ctx context.Context, s *Server, conf Conf, args []string) error
+
+type command struct {
+	name string
+	desc string
+	run  runFunc
+	// flags 有自己的参数的命令，在共用的参数之外注册参数，返回执行的函数
+	flags func(fs *flag.FlagSet) runFunc
+}
+
+// commands 命令行模式支持的子命令
+var commands = []command{
+	{name: "crawl", desc: "拉取所有启用的频道的播放页面保存到数据库", run: func(ctx context.Context, s *Server, conf Conf, args []string) error {
+		conf.GetUrl, conf.FillUrl, conf.Download = true, false, false
+		return runWithProgress(ctx, s, conf)
+	}},
+	{name: "resolve", desc: "获取还没有下载地址的视频的下载地址", run: func(ctx context.Context, s *Server, conf Conf, args []string) error {
+		conf.GetUrl, conf.FillUrl, conf.Download = false, true, false
+		return runWithProgress(ctx, s, conf)
+	}},
+	{name: "download", desc: "下载本地还没有的视频", run: func(ctx context.Context, s *Server, conf Conf, args []string) error {
+		conf.GetUrl, conf.FillUrl, conf.Download = false, false, true
+		return runWithProgress(ctx, s, conf)
+	}},
+	{name: "sync", desc: "依次执行 crawl、resolve、download", run: func(ctx context.Context, s *Server, conf Conf, args []string) error {
+		conf.GetUrl, conf.FillUrl, conf.Download = true, true, true
+		return runWithProgress(ctx, s, conf)
+	}},
+	{name: "list", desc: "列出数据库中的视频", flags: listCommand},
+	{name: "status", desc: "显示视频数量、下载情况的统计", run: showStatus},
+	{name: "channel", desc: "管理订阅的频道: channel list|add|edit|remove", run: manageChannels},
+	{name: "daemon", desc: "按配置中的 schedule 定时执行 sync，直到按下 Ctrl-C", flags: daemonCommand},
+	{name: "serve", desc: "启动远程控制接口，直到按下 Ctrl-C，需要在配置文件中设置 api.token", flags: serveCommand},
+	{name: "history", desc: "显示最近的运行记录", flags: historyCommand},
+	{name: "titles", desc: "按配置中的 titleRules 预览重新整理后的保存名称，-apply 保存", flags: titlesCommand},
+	{name: "series", desc: "按剧名分组显示视频，标出中间缺少的集数", flags: seriesCommand},
+	{name: "relocate", desc: "修改 pathTemplate 后把已下载的文件移动到新的路径: relocate -from 旧的模板", flags: relocateCommand},
+	{name: "export", desc: "导出视频目录到 jsonl 或 csv 文件", flags: exportCommand},
+	{name: "import", desc: "从导出的文件导入视频，按播放地址合并: import [-overwrite-names] 文件", flags: importCommand},
+	{name: "migrate", desc: "显示数据库升级的情况，-apply 执行没有执行的升级", flags: migrateCommand},
+}
+
+func usage() {
+	out := flag.CommandLine.Output()
+	fmt.Fprintf(out, "用法: %s [-conf 配置文件] [命令] [参数]\n\n不带命令时启动图形界面。\n\n命令:\n", os.Args[0])
+	for _, c := range commands {
+		fmt.Fprintf(out, "  %-10s%s\n", c.name, c.desc)
+	}
+	fmt.Fprintf(out, "\n参数:\n")
+	flag.PrintDefaults()
+	fmt.Fprintf(out, "\n命令的参数通过 %s <命令> -h 查看\n", os.Args[0])
+}
+
+// runCLI 命令行模式，返回进程的退出码：0 成功，1 运行失败，2 参数错误
+func runCLI(confPath string, args []string) int {
+	var cmd *command
+	for i := range commands {
+		if commands[i].name == args[0] {
+			cmd = &commands[i]
+		}
+	}
+	if cmd == nil {
+		fmt.Fprintf(os.Stderr, "未知的命令 %q\n\n", args[0])
+		usage()
+		return 2
+	}
+
+	conf, err := LoadConf(confPath)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "读取配置失败:", err)
+		return 1
+	}
+	fs := flag.NewFlagSet(cmd.name, flag.ContinueOnError)
+	fs.StringVar(&conf.DownloadPath, "path", conf.DownloadPath, "文件保存地址")
+	fs.BoolVar(&conf.ShowBrowser, "show-browser", conf.ShowBrowser, "显示浏览器")
+	fs.IntVar(&conf.Concurrency, "concurrency", conf.Concurrency, "同时下载的文件数")
+	fs.IntVar(&conf.BrowserTabs, "tabs", conf.BrowserTabs, "同时打开的浏览器页面数")
+	run := cmd.run
+	if cmd.flags != nil {
+		run = cmd.flags(fs)
+	}
+	if err = fs.Parse(args[1:]); err != nil {
+		return 2
+	}
+	if err = conf.Validate(); err != nil {
+		fmt.Fprintln(os.Stderr, "参数错误:", err)
+		return 2
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	if err = run(ctx, &Server{}, conf, fs.Args()); err != nil {
+		fmt.Fprintln(os.Stderr, "错误:", err)
+		return 1
+	}
+	return 0
+}
+
+// cliProgressInterval 终端中打印下载进度的间隔
+const cliProgressInterval = 3 * time.Second
+
+// runWithProgress 运行任务，在终端打印每个阶段和失败的视频，下载过程中每隔几秒打印一次进度
+func runWithProgress(ctx context.Context, s *Server, conf Conf) error {
+	events, unsubscribe := s.events.Subscribe()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		var printed time.Time
+		for e := range events {
+			switch e.Type {
+			case EventStageStarted:
+				fmt.Println("开始", e.Stage)
+			case EventError:
+				fmt.Printf("失败 [%s] %s: %s\n", e.Stage, e.Title, e.Error)
+			case EventProgress:
+				if time.Since(printed) >= cliProgressInterval {
+					printed = time.Now()
+					printProgress(*e.Progress)
+				}
+			}
+		}
+	}()
+	err := s.RunWithHistory(ctx, conf, TriggerCLI)
+	unsubscribe()
+	<-done
+	// 获取地址失败的视频不影响下载，打印完结果后一起返回
+	if err != nil && !errors.Is(err, errResolveFailed) {
+		return err
+	}
+
+	// 没有下载时只打印了每个阶段和失败的视频
+	if !conf.Download {
+		return err
+	}
+	// 结果从统计中读取，不依赖 runFinished 事件是否送到
+	final := s.stats.Snapshot()
+	fmt.Printf("完成: 下载 %d 个文件，失败 %d 个\n", final.DownloadedFiles, final.FailedFiles)
+	if final.FailedFiles > 0 {
+		err = errors.Join(err, fmt.Errorf("%d 个文件下载失败", final.FailedFiles))
+	}
+	return err
+}
+
+func printProgress(snap StatsSnapshot) {
+	if snap.TotalFiles == 0 {
+		return
+	}
+	fmt.Printf("[%d/%d] %.1f%% 速度: %.2f MB/s 剩余: %s\n", snap.Finished(), snap.TotalFiles, snap.Percent, snap.Speed, formatETA(snap.ETA))
+	for _, f := range snap.Files {
+		fmt.Printf("  [%d] %s %.1f/%.1fMB %.2fMB/s\n", f.Worker, f.File, float64(f.DownSize)/1024/1024, float64(f.Size)/1024/1024, f.Speed)
+	}
+}
+
+func listCommand(fs *flag.FlagSet) runFunc {
+	status := fs.String("status", "", "只显示指定状态的视频，多个用逗号分隔: "+strings.Join(statusNames(), "、"))
+	return func(ctx context.Context, s *Server, conf Conf, args []string) error {
+		if err := s.openStore(conf); err != nil {
+			return err
+		}
+		statuses, err := parseStatuses(*status)
+		if err != nil {
+			return err
+		}
+		var list []Video
+		if len(statuses) == 0 {
+			list, err = s.store.List()
+		} else {
+			list, err = s.store.ListByStatus(ctx, statuses...)
+		}
+		if err != nil {
+			return err
+		}
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "ID\t频道\t保存名称\t状态\t状态时间\t错误")
+		for _, v := range list {
+			var at string
+			if v.StatusAt != nil {
+				at = v.StatusAt.Format("2006-01-02 15:04:05")
+			}
+			fmt.Fprintf(w, "%d\t%d\t%s\t%s\t%s\t%s\n", v.ID, v.ChannelID, v.SaveName, v.Status.Label(), at,
+				firstNonEmpty(v.DownloadErr, v.ErrorMsg))
+		}
+		return w.Flush()
+	}
+}
+
+func showStatus(ctx context.Context, s *Server, conf Conf, args []string) error {
+	if err := s.openStore(conf); err != nil {
+		return err
+	}
+	counts, err := s.store.CountByStatus()
+	if err != nil {
+		return err
+	}
+	var total int64
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	for _, st := range videoStatuses {
+		fmt.Fprintf(w, "%s\t%s\t%d\n", st.Label(), st, counts[st])
+		total += counts[st]
+	}
+	fmt.Fprintf(w, "视频总数\t\t%d\n", total)
+	return w.Flush()
+}
+
+// statusNames 所有状态的名称
+func statusNames() []string {
+	names := make([]string, 0, len(videoStatuses))
+	for _, st := range videoStatuses {
+		names = append(names, string(st))
+	}
+	return names
+}
+
+// titlesCommand 预览按规则整理后的名称，-apply 时保存，本地已有的文件一起改名
+func titlesCommand(fs *flag.FlagSet) runFunc {
+	all := fs.Bool("all", false, "显示所有视频，默认只显示名称有变化的")
+	apply := fs.Bool("apply", false, "保存有变化的名称")
+	return func(ctx context.Context, s *Server, conf Conf, args []string) error {
+		previews, err := s.PreviewTitles(conf, conf.TitleRules)
+		if err != nil {
+			return err
+		}
+		var changed int
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "ID\t原始名称\t保存名称\t新名称")
+		for _, p := range previews {
+			if p.Changed() {
+				changed++
+			} else if !*all {
+				continue
+			}
+			fmt.Fprintf(w, "%d\t%s\t%s\t%s\n", p.ID, p.OriginName, p.SaveName, p.NewName)
+		}
+		if err = w.Flush(); err != nil {
+			return err
+		}
+		if !*apply {
+			fmt.Printf("共 %d 个视频，%d 个名称有变化，使用 -apply 保存\n", len(previews), changed)
+			return nil
+		}
+		n, err := s.ApplyTitles(conf, previews)
+		fmt.Printf("已修改 %d 个名称\n", n)
+		return err
+	}
+}
+
+// seriesCommand 按剧名分组显示视频数量、下载数量和缺少的集数
+func seriesCommand(fs *flag.FlagSet) runFunc {
+	gaps := fs.Bool("gaps", false, "只显示缺少集数的剧")
+	detect := fs.Bool("detect", false, "先按现在的名称规则重新识别所有视频的剧名和集数")
+	return func(ctx context.Context, s *Server, conf Conf, args []string) error {
+		if *detect {
+			n, err := s.DetectSeries(ctx, conf, true)
+			if err != nil {
+				return err
+			}
+			fmt.Printf("%d 个视频的剧名或集数有变化\n", n)
+		}
+		items, err := s.Library(conf)
+		if err != nil {
+			return err
+		}
+		groups := GroupSeries(items)
+		var withGaps int
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "剧名\t视频数\t已下载\t缺少的集数")
+		for _, g := range groups {
+			if len(g.Missing) > 0 {
+				withGaps++
+			} else if *gaps {
+				continue
+			}
+			fmt.Fprintf(w, "%s\t%d\t%d\t%s\n", g.Series, len(g.Items), g.Downloaded, g.MissingText())
+		}
+		if err = w.Flush(); err != nil {
+			return err
+		}
+		fmt.Printf("共 %d 个剧，%d 个缺少集数\n", len(groups), withGaps)
+		return nil
+	}
+}
+
+// relocateCommand 把按旧模板保存的文件移动到配置中模板的路径
+func relocateCommand(fs *flag.FlagSet) runFunc {
+	from := fs.String("from", DefaultPathTemplate, "原来的保存路径模板")
+	return func(ctx context.Context, s *Server, conf Conf, args []string) error {
+		n, err := s.RelocateFiles(conf, *from)
+		fmt.Printf("已移动 %d 个文件\n", n)
+		return err
+	}
+}
+
+// exportCommand 导出视频目录，没有 -o 时输出到终端
+func exportCommand(fs *flag.FlagSet) runFunc {
+	output := fs.String("o", "", "导出的文件，扩展名为 .csv 时导出 csv，其他为 jsonl")
+	format := fs.String("format", "", "格式: jsonl、csv，默认根据文件扩展名判断")
+	channel := fs.Uint("channel", 0, "只导出指定频道的视频")
+	status := fs.String("status", "", "只导出指定状态的视频，多个用逗号分隔: "+strings.Join(statusNames(), "、"))
+	return func(ctx context.Context, s *Server, conf Conf, args []string) error {
+		filter := ExportFilter{ChannelID: *channel}
+		var err error
+		if filter.Statuses, err = parseStatuses(*status); err != nil {
+			return err
+		}
+		if *format == "" {
+			*format = CatalogFormat(*output)
+		}
+		if err = s.openStore(conf); err != nil {
+			return err
+		}
+		if filter.ChannelID != 0 {
+			if _, err = findChannel(s.store, filter.ChannelID); err != nil {
+				return err
+			}
+		}
+		if *output == "" {
+			_, err = ExportCatalog(ctx, s.store, os.Stdout, *format, filter)
+			return err
+		}
+		f, err := os.Create(*output)
+		if err != nil {
+			return err
+		}
+		n, err := ExportCatalog(ctx, s.store, f, *format, filter)
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			return err
+		}
+		fmt.Printf("已导出 %d 个视频到 %s\n", n, *output)
+		return nil
+	}
+}
+
+// importCommand 导入视频目录，本地已有的视频默认保留本地的保存名称
+func importCommand(fs *flag.FlagSet) runFunc {
+	format := fs.String("format", "", "格式: jsonl、csv，默认根据文件扩展名判断")
+	overwrite := fs.Bool("overwrite-names", false, "用导入的保存名称覆盖本地的保存名称")
+	return func(ctx context.Context, s *Server, conf Conf, args []string) error {
+		if len(args) != 1 {
+			return errors.New("用法: import [-format jsonl|csv] [-overwrite-names] 文件")
+		}
+		if *format == "" {
+			*format = CatalogFormat(args[0])
+		}
+		f, err := os.Open(args[0])
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		records, err := ReadCatalog(f, *format)
+		if err != nil {
+			return fmt.Errorf("读取 %s 失败: %w", args[0], err)
+		}
+		if err = s.openStore(conf); err != nil {
+			return err
+		}
+		result, err := ImportCatalog(ctx, s.store, records, ImportOptions{OverwriteNames: *overwrite})
+		fmt.Println(result)
+		return err
+	}
+}
+
+// migrateCommand 显示和执行数据库升级，执行前最好先备份数据库
+func migrateCommand(fs *flag.FlagSet) runFunc {
+	apply := fs.Bool("apply", false, "执行没有执行的升级")
+	return func(ctx context.Context, s *Server, conf Conf, args []string) error {
+		m, err := NewMigrator(conf.Store)
+		if err != nil {
+			return err
+		}
+		defer m.Close()
+		if *apply {
+			n, err := m.Apply()
+			if n > 0 {
+				fmt.Printf("已执行 %d 个升级\n", n)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		list, err := m.Status()
+		if err != nil {
+			return err
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "版本\t名称\t执行时间")
+		for _, st := range list {
+			at := "未执行"
+			if st.Applied {
+				at = st.AppliedAt.Format("2006-01-02 15:04:05")
+			}
+			fmt.Fprintf(w, "%d\t%s\t%s\n", st.Version, st.Name, at)
+		}
+		return w.Flush()
+	}
+}
+
+// serveCommand 只启动远程控制接口，直到按下 Ctrl-C
+func serveCommand(fs *flag.FlagSet) runFunc {
+	addr := fs.String("addr", "", "监听地址，例如 0.0.0.0:8787，默认使用配置文件中的 api.addr")
+	return func(ctx context.Context, s *Server, conf Conf, args []string) error {
+		if *addr != "" {
+			conf.API.Addr = *addr
+		}
+		if conf.API.Addr == "" {
+			return errors.New("请在配置文件中设置 api.addr 或者使用 -addr 参数")
+		}
+		if err := conf.Validate(); err != nil {
+			return err
+		}
+		return s.ServeAPI(ctx, conf)
+	}
+}
+
+// daemonCommand 定时同步，-now 时启动后先同步一次
+func daemonCommand(fs *flag.FlagSet) runFunc {
+	now := fs.Bool("now", false, "启动后立即同步一次")
+	schedule := fs.String("schedule", "", "定时同步，时间间隔（6h）或 cron 表达式，默认使用配置文件中的 schedule")
+	return func(ctx context.Context, s *Server, conf Conf, args []string) error {
+		if *schedule != "" {
+			conf.Schedule = *schedule
+		}
+		if conf.Schedule == "" {
+			return errors.New("请在配置文件中设置 schedule 或者使用 -schedule 参数")
+		}
+		sched, err := NewScheduler(s, conf)
+		if err != nil {
+			return fmt.Errorf("schedule 格式错误: %w", err)
+		}
+		// 配置了远程控制时一起启动
+		if conf.API.Addr != "" {
+			go func() {
+				if err := s.ServeAPI(ctx, conf); err != nil {
+					fmt.Fprintln(os.Stderr, "远程控制接口启动失败:", err)
+				}
+			}()
+		}
+		if *now {
+			conf.GetUrl, conf.FillUrl, conf.Download = true, true, true
+			if err = s.RunWithHistory(ctx, conf, TriggerCLI); err != nil {
+				fmt.Fprintln(os.Stderr, "同步失败:", err)
+			}
+		}
+		sched.Start(ctx)
+		return nil
+	}
+}
+
+func historyCommand(fs *flag.FlagSet) runFunc {
+	limit := fs.Int("n", 20, "显示的条数，0 为全部")
+	return func(ctx context.Context, s *Server, conf Conf, args []string) error {
+		if err := s.openStore(conf); err != nil {
+			return err
+		}
+		runs, err := s.store.ListRuns(*limit)
+		if err != nil {
+			return err
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "ID\t开始时间\t耗时\t触发\t结果\t成功\t失败\t错误")
+		for _, r := range runs {
+			fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%s\t%d\t%d\t%s\n", r.ID, r.StartedAt.Format("2006-01-02 15:04:05"),
+				r.FinishedAt.Sub(r.StartedAt).Round(time.Second), r.Trigger, r.Status, r.Downloaded, r.Failed, r.Error)
+		}
+		return w.Flush()
+	}
+}
+
+// manageChannels 频道的增删改查
+func manageChannels(ctx context.Context, s *Server, conf Conf, args []string) error {
+	if len(args) == 0 {
+		return errors.New("用法: channel list|add|edit|remove [参数]")
+	}
+	if err := s.openStore(conf); err != nil {
+		return err
+	}
+
+	var ch Channel
+	var id uint
+	var enabled string
+	var replace string
+	fs := flag.NewFlagSet("channel "+args[0], flag.ContinueOnError)
+	fs.UintVar(&id, "id", 0, "频道ID，edit、remove 时必填")
+	fs.StringVar(&ch.Url, "url", "", "频道主页地址")
+	fs.StringVar(&ch.Name, "name", "", "显示名称")
+	fs.StringVar(&ch.Source, "source", "", "视频平台: "+strings.Join(SourceNames(), "、")+"，为空时根据地址判断")
+	fs.StringVar(&ch.Folder, "folder", "", "下载子目录")
+	fs.StringVar(&enabled, "enabled", "", "是否启用: true、false")
+	fs.StringVar(&replace, "replace", "", "额外的名称替换规则，格式 关键字=替换,关键字=替换")
+	if err := fs.Parse(args[1:]); err != nil {
+		return err
+	}
+	set := map[string]bool{}
+	fs.Visit(func(f *flag.Flag) { set[f.Name] = true })
+
+	switch args[0] {
+	case "list":
+		channels, err := s.store.ListChannels()
+		if err != nil {
+			return err
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "ID\t名称\t平台\t子目录\t启用\t地址")
+		for _, c := range channels {
+			fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%s\t%s\n", c.ID, c.Name, c.Source, c.Folder, yesNo(c.Enabled), c.Url)
+		}
+		return w.Flush()
+	case "add":
+		ch.Enabled = enabled != "false"
+		ch.Replace = parseReplace(replace)
+		if err := validateChannel(ch); err != nil {
+			return err
+		}
+		if err := s.store.SaveChannel(&ch); err != nil {
+			return err
+		}
+		fmt.Println("已添加频道", ch.ID)
+		return nil
+	case "edit":
+		old, err := findChannel(s.store, id)
+		if err != nil {
+			return err
+		}
+		if set["url"] {
+			old.Url = ch.Url
+		}
+		if set["name"] {
+			old.Name = ch.Name
+		}
+		if set["source"] {
+			old.Source = ch.Source
+		}
+		if set["folder"] {
+			old.Folder = ch.Folder
+		}
+		if set["enabled"] {
+			old.Enabled = enabled != "false"
+		}
+		if set["replace"] {
+			old.Replace = parseReplace(replace)
+		}
+		if err = validateChannel(old); err != nil {
+			return err
+		}
+		return s.store.SaveChannel(&old)
+	case "remove":
+		if _, err := findChannel(s.store, id); err != nil {
+			return err
+		}
+		return s.store.DeleteChannel(id)
+	default:
+		return fmt.Errorf("未知的操作 %q，可选 list、add、edit、remove", args[0])
+	}
+}
+
+func findChannel(store Repository, id uint) (Channel, error) {
+	if id == 0 {
+		return Channel{}, errors.New("请指定 -id")
+	}
+	ch, err := store.GetChannel(id)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return ch, fmt.Errorf("频道 %d 不存在", id)
+	}
+	return ch, err
+}
+
+// parseReplace 解析 关键字=替换,关键字=替换 格式的替换规则
+func parseReplace(v string) map[string]string {
+	rules := make(map[string]string)
+	for _, item := range strings.FieldsFunc(v, func(r rune) bool { return r == ',' || r == '\n' }) {
+		key, value, _ := strings.Cut(item, "=")
+		if key = strings.TrimSpace(key); key != "" {
+			rules[key] = strings.TrimSpace(value)
+		}
+	}
+	return rules
+}
+
+func yesNo(b bool) string {
+	if b {
+		return "是"
+	}
+	return "否"
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, v := range values {
+		if v != "" {
+			return v
+		}
+	}
+	return ""
+}
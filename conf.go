@@ -1,18 +1,301 @@
 package main
 
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// confEnv 指定配置文件路径的环境变量，优先级低于 -conf 参数
+const confEnv = "NIUGEXI_CONF"
+
+// maxConcurrency 同时下载的文件数上限，太多容易被限流
+const maxConcurrency = 8
+
+// maxBrowserTabs 同时打开的浏览器页面数上限，每个页面都要占用不少内存
+const maxBrowserTabs = 8
+
+// maxAttempts 失败重试次数上限
+const maxAttempts = 10
+
 type Conf struct {
 	GetUrl       bool              `json:"getUrl"`
 	FillUrl      bool              `json:"fillUrl"`
 	Download     bool              `json:"download"`
 	Store        DBConfig          `json:"store"`
-	Replace      map[string]string `json:"replace"`
+	Replace      map[string]string `json:"replace,omitempty"` // 旧版的替换表，读取时转换为 titleRules
+	TitleRules   []TitleRule       `json:"titleRules"`        // 整理标题的规则，按顺序执行
 	ShowBrowser  bool              `json:"showBrowser"`
 	MaxRepeat    int               `json:"maxRepeat"`
 	DownloadPath string            `json:"downloadPath"`
 	TargetUrl    string            `json:"targetUrl"`
+	Source       string            `json:"source"`      // 视频平台，为空时根据视频主页的地址判断
+	CheckMp4     bool              `json:"checkMp4"`    // 下载完成后检查 mp4 文件结构
+	Concurrency  int               `json:"concurrency"` // 同时下载的文件数
+	BrowserTabs  int               `json:"browserTabs"` // 同时打开的浏览器页面数，也是同时获取下载地址的视频数
+	Retry        RetryPolicy       `json:"retry"`
+	Schedule     string            `json:"schedule"`               // 定时同步，时间间隔（6h）或 cron 表达式，为空时不启用
+	PathTemplate string            `json:"pathTemplate"`           // 保存路径模板，相对于保存地址
+	SeriesFolder bool              `json:"seriesFolder,omitempty"` // 旧版的按剧集分目录，读取时转换为 pathTemplate
+	API          APIConfig         `json:"api"`                    // 远程控制接口
 }
 
 type DBConfig struct {
-	Type string `json:"type"`
-	Dns  string `json:"dns"`
+	Type string `json:"type"` // sqlite、mysql、postgres
+	Dns  string `json:"dns"`  // mysql、postgres 的连接地址
+	Path string `json:"path"` // sqlite 的数据库文件，为空时保存到用户配置目录
+}
+
+// FieldError 配置项校验错误，Field 为 json 中的字段路径
+type FieldError struct {
+	Field string
+	Msg   string
+}
+
+func (e *FieldError) Error() string {
+	return e.Field + ": " + e.Msg
+}
+
+// DefaultConf 没有配置文件时使用的默认配置
+func DefaultConf() Conf {
+	return Conf{
+		Store: DBConfig{
+			Type: "sqlite", // 如果使用sqlite，则不需要配置dns
+			Dns:  "root:root@tcp(127.0.0.1:3306)/videos?charset=utf8mb4&parseTime=True&loc=Local",
+		},
+		MaxRepeat:    5,
+		Concurrency:  2,
+		BrowserTabs:  2,
+		Retry:        DefaultRetryPolicy(),
+		TitleRules:   DefaultTitleRules(),
+		PathTemplate: DefaultPathTemplate,
+	}
+}
+
+// ConfPath 按 命令行参数 > 环境变量 > 当前目录 conf.json 的顺序确定配置文件路径
+func ConfPath(flagValue string) string {
+	if flagValue != "" {
+		return flagValue
+	}
+	if env := os.Getenv(confEnv); env != "" {
+		return env
+	}
+	return "conf.json"
+}
+
+// LoadConf 读取并校验配置文件，文件不存在时返回默认配置
+func LoadConf(path string) (Conf, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return DefaultConf(), nil
+	}
+	if err != nil {
+		return Conf{}, err
+	}
+	data, err = migrateConf(data)
+	if err != nil {
+		return Conf{}, fmt.Errorf("%s: %w", path, err)
+	}
+
+	var conf Conf
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err = dec.Decode(&conf); err != nil {
+		return Conf{}, fmt.Errorf("%s: %w", path, decodeConfError(err))
+	}
+	if conf.Store.Type == "" {
+		conf.Store.Type = "sqlite"
+	}
+	// 旧版的替换表转换为规则放在最前面，和 titleRules 都没有时使用默认规则
+	if conf.Replace != nil {
+		conf.TitleRules = append(legacyTitleRules(conf.Replace), conf.TitleRules...)
+		conf.Replace = nil
+	} else if conf.TitleRules == nil {
+		conf.TitleRules = DefaultTitleRules()
+	}
+	if conf.SeriesFolder && conf.PathTemplate == "" {
+		conf.PathTemplate = SeriesPathTemplate
+	}
+	conf.SeriesFolder = false
+	if conf.PathTemplate == "" {
+		conf.PathTemplate = DefaultPathTemplate
+	}
+	if conf.Retry == (RetryPolicy{}) {
+		conf.Retry = DefaultRetryPolicy()
+	}
+	if err = conf.Validate(); err != nil {
+		return Conf{}, fmt.Errorf("%s: %w", path, err)
+	}
+	return conf, nil
+}
+
+// SaveConf 把配置写回文件，先写临时文件再改名，避免写到一半损坏原配置
+func SaveConf(path string, conf Conf) error {
+	if err := conf.Validate(); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(conf, "", "  ")
+	if err != nil {
+		return err
+	}
+	if dir := filepath.Dir(path); dir != "." {
+		if err = os.MkdirAll(dir, 0o755); err != nil {
+			return err
+		}
+	}
+	tmp := path + ".tmp"
+	if err = os.WriteFile(tmp, append(data, '\n'), 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// Validate 校验配置项，返回所有字段的错误
+func (c Conf) Validate() error {
+	var errs []error
+	switch c.Store.Type {
+	case "sqlite":
+	case "mysql", "postgres":
+		if c.Store.Dns == "" {
+			errs = append(errs, &FieldError{Field: "store.dns", Msg: fmt.Sprintf("使用 %s 时不能为空", c.Store.Type)})
+		}
+	default:
+		errs = append(errs, &FieldError{Field: "store.type", Msg: fmt.Sprintf("不支持的数据库类型 %q，可选 sqlite、mysql、postgres", c.Store.Type)})
+	}
+	if c.MaxRepeat < 0 {
+		errs = append(errs, &FieldError{Field: "maxRepeat", Msg: "不能小于0"})
+	}
+	if c.Concurrency < 0 || c.Concurrency > maxConcurrency {
+		errs = append(errs, &FieldError{Field: "concurrency", Msg: fmt.Sprintf("需要在 0 到 %d 之间", maxConcurrency)})
+	}
+	if c.BrowserTabs < 0 || c.BrowserTabs > maxBrowserTabs {
+		errs = append(errs, &FieldError{Field: "browserTabs", Msg: fmt.Sprintf("需要在 0 到 %d 之间", maxBrowserTabs)})
+	}
+	if c.Retry.MaxAttempts < 0 || c.Retry.MaxAttempts > maxAttempts {
+		errs = append(errs, &FieldError{Field: "retry.maxAttempts", Msg: fmt.Sprintf("需要在 0 到 %d 之间", maxAttempts)})
+	}
+	if c.Retry.BaseDelay < 0 {
+		errs = append(errs, &FieldError{Field: "retry.baseDelay", Msg: "不能小于0"})
+	}
+	if c.Retry.MaxDelay < 0 {
+		errs = append(errs, &FieldError{Field: "retry.maxDelay", Msg: "不能小于0"})
+	}
+	if c.TargetUrl != "" {
+		u, err := url.Parse(c.TargetUrl)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			errs = append(errs, &FieldError{Field: "targetUrl", Msg: fmt.Sprintf("不是有效的网址 %q", c.TargetUrl)})
+		}
+	}
+	if _, err := SourceByName(c.Source); err != nil {
+		errs = append(errs, &FieldError{Field: "source", Msg: err.Error()})
+	}
+	if c.Schedule != "" {
+		if _, err := ParseSchedule(c.Schedule); err != nil {
+			errs = append(errs, &FieldError{Field: "schedule", Msg: err.Error()})
+		}
+	}
+	if c.API.Addr != "" {
+		if _, _, err := net.SplitHostPort(c.API.Addr); err != nil {
+			errs = append(errs, &FieldError{Field: "api.addr", Msg: fmt.Sprintf("格式错误 %q，例如 0.0.0.0:8787", c.API.Addr)})
+		}
+		if c.API.Token == "" {
+			errs = append(errs, &FieldError{Field: "api.token", Msg: "开启远程控制时不能为空"})
+		}
+	}
+	if _, err := ParsePathTemplate(c.PathTemplate); err != nil {
+		errs = append(errs, &FieldError{Field: "pathTemplate", Msg: err.Error()})
+	}
+	if c.DownloadPath != "" {
+		if info, err := os.Stat(c.DownloadPath); err == nil && !info.IsDir() {
+			errs = append(errs, &FieldError{Field: "downloadPath", Msg: "不是目录"})
+		}
+	}
+	for key := range c.Replace {
+		if key == "" {
+			errs = append(errs, &FieldError{Field: "replace", Msg: "替换的关键字不能为空"})
+			break
+		}
+	}
+	if _, err := CompileTitleRules(c.TitleRules); err != nil {
+		errs = append(errs, &FieldError{Field: "titleRules", Msg: err.Error()})
+	}
+	return errors.Join(errs...)
+}
+
+// migrateConf 兼容旧版配置：
+// 旧版把 geturl/fillurl/download 放在 mode 下，Store 没有 type 字段时使用 mysql
+func migrateConf(data []byte) ([]byte, error) {
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, decodeConfError(err)
+	}
+	modeKey, ok := lookupKey(raw, "mode")
+	if !ok {
+		return data, nil
+	}
+
+	var mode map[string]json.RawMessage
+	if err := json.Unmarshal(raw[modeKey], &mode); err != nil {
+		return nil, &FieldError{Field: "mode", Msg: "格式错误"}
+	}
+	delete(raw, modeKey)
+	for _, name := range []string{"getUrl", "fillUrl", "download"} {
+		if _, exist := lookupKey(raw, name); exist {
+			continue
+		}
+		if k, exist := lookupKey(mode, name); exist {
+			raw[name] = mode[k]
+		}
+	}
+
+	if storeKey, exist := lookupKey(raw, "store"); exist {
+		var store map[string]json.RawMessage
+		if err := json.Unmarshal(raw[storeKey], &store); err != nil {
+			return nil, &FieldError{Field: "store", Msg: "格式错误"}
+		}
+		if _, hasType := lookupKey(store, "type"); !hasType {
+			store["type"] = json.RawMessage(`"mysql"`)
+			b, err := json.Marshal(store)
+			if err != nil {
+				return nil, err
+			}
+			raw[storeKey] = b
+		}
+	}
+	return json.Marshal(raw)
+}
+
+// lookupKey 和 encoding/json 一样不区分大小写地查找字段
+func lookupKey(m map[string]json.RawMessage, name string) (string, bool) {
+	if _, ok := m[name]; ok {
+		return name, true
+	}
+	for k := range m {
+		if strings.EqualFold(k, name) {
+			return k, true
+		}
+	}
+	return "", false
+}
+
+// decodeConfError 把 encoding/json 的错误转换成字段错误
+func decodeConfError(err error) error {
+	var typeErr *json.UnmarshalTypeError
+	if errors.As(err, &typeErr) {
+		return &FieldError{Field: typeErr.Field, Msg: fmt.Sprintf("类型错误，需要 %s", typeErr.Type)}
+	}
+	var syntaxErr *json.SyntaxError
+	if errors.As(err, &syntaxErr) {
+		return fmt.Errorf("json 格式错误(第 %d 字节): %w", syntaxErr.Offset, err)
+	}
+	if msg := err.Error(); strings.HasPrefix(msg, "json: unknown field ") {
+		return &FieldError{Field: strings.Trim(strings.TrimPrefix(msg, "json: unknown field "), `"`), Msg: "未知的配置项"}
+	}
+	return err
 }
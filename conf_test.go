@@ -0,0 +1,99 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadConfLegacy(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "conf.json")
+	legacy := `{
+  "targetUrl": "https://www.ixigua.com/home/104305645109/",
+  "mode": {"geturl": true, "fillurl": false, "download": true},
+  "Store": {"dns": "root:123456@tcp(localhost:3306)/niugexi"},
+  "maxRepeat": 5,
+  "replace": {"山歌": ""},
+  "seriesFolder": true
+}`
+	if err := os.WriteFile(path, []byte(legacy), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	conf, err := LoadConf(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !conf.GetUrl || conf.FillUrl || !conf.Download {
+		t.Errorf("mode 没有迁移: %+v", conf)
+	}
+	if conf.Store.Type != "mysql" || conf.Store.Dns == "" {
+		t.Errorf("store 迁移错误: %+v", conf.Store)
+	}
+	// 旧版的 replace 转换为 titleRules，只有配置文件中的内容
+	if conf.Replace != nil || len(conf.TitleRules) != 1 || conf.TitleRules[0] != (TitleRule{Type: RuleLiteral, Find: "山歌"}) {
+		t.Errorf("replace 没有转换为 titleRules: %v, %v", conf.Replace, conf.TitleRules)
+	}
+	if conf.SeriesFolder || conf.PathTemplate != SeriesPathTemplate {
+		t.Errorf("seriesFolder 没有转换为 pathTemplate: %q", conf.PathTemplate)
+	}
+
+	conf.DownloadPath = t.TempDir()
+	if err = SaveConf(path, conf); err != nil {
+		t.Fatal(err)
+	}
+	saved, err := LoadConf(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if saved.DownloadPath != conf.DownloadPath || saved.Store != conf.Store || !saved.GetUrl {
+		t.Errorf("写回后读取不一致: %+v", saved)
+	}
+}
+
+func TestLoadConfMissing(t *testing.T) {
+	conf, err := LoadConf(filepath.Join(t.TempDir(), "conf.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if conf.Store.Type != "sqlite" || len(conf.TitleRules) == 0 {
+		t.Errorf("应该返回默认配置: %+v", conf)
+	}
+}
+
+func TestLoadConfInvalid(t *testing.T) {
+	tests := map[string]struct {
+		content string
+		field   string
+	}{
+		"未知字段":          {`{"targetUrl": "https://www.ixigua.com/", "foo": 1}`, "foo"},
+		"类型错误":          {`{"maxRepeat": "5"}`, "maxRepeat"},
+		"数据库类型":         {`{"store": {"type": "oracle"}}`, "store.type"},
+		"缺少dns":         {`{"store": {"type": "mysql"}}`, "store.dns"},
+		"postgres缺少dns": {`{"store": {"type": "postgres"}}`, "store.dns"},
+		"错误网址":          {`{"targetUrl": "ixigua"}`, "targetUrl"},
+		"路径模板":          {`{"pathTemplate": "{channel}/{title}.mp4"}`, "pathTemplate"},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "conf.json")
+			if err := os.WriteFile(path, []byte(tt.content), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			_, err := LoadConf(path)
+			var fieldErr *FieldError
+			if !errors.As(err, &fieldErr) {
+				t.Fatalf("应该返回字段错误: %v", err)
+			}
+			if fieldErr.Field != tt.field {
+				t.Errorf("字段 = %q, 期望 %q", fieldErr.Field, tt.field)
+			}
+		})
+	}
+}
+
+func TestShippedConf(t *testing.T) {
+	if _, err := LoadConf("conf.json"); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+)
+
+type Download struct {
+	Url   string
+	Path  string
+	Title string
+	// ETag、LastModified 是上次下载时服务器返回的校验值，断点续传时作为 If-Range 发送，
+	// 下载完成后更新为本次响应的值
+	ETag         string
+	LastModified string
+	// Size 服务器返回的文件总大小，未知时为0
+	Size int64
+	// CheckMp4 下载完成后检查 mp4 的 ftyp、moov 结构
+	CheckMp4 bool
+	// Worker 下载协程编号，用于统计每个协程的进度
+	Worker int
+}
+
+// errRangeMismatch 服务器返回的 Content-Range 和本地已下载的大小对不上
+var errRangeMismatch = errors.New("content-range 与本地文件大小不一致")
+
+var (
+	errEmptyFile  = errors.New("下载的文件为空")
+	errIncomplete = errors.New("文件下载不完整")
+	errInvalidMp4 = errors.New("不是有效的mp4文件")
+)
+
+// DownloadFile will download a url to a local file. It's efficient because it will
+// write as it downloads and not load the whole file into memory.
+// 如果存在上次未完成的 .download 文件，会通过 Range 请求从断点处继续下载。
+// 只有校验通过的文件才会改名为最终的文件，下载失败时保留 .download 文件用于下次续传。
+func (s *Server) DownloadFile(ctx context.Context, d *Download) (err error) {
+	f := s.stats.Begin(d.Worker, d.Title)
+	defer func() { s.stats.End(f, err == nil) }()
+
+	s2 := d.Path + ".download"
+	var offset int64
+	if info, err := os.Stat(s2); err == nil {
+		offset = info.Size()
+	}
+
+	err = s.downloadRange(ctx, f, d, s2, offset)
+	if errors.Is(err, errRangeMismatch) {
+		// 断点对不上，删掉临时文件从头下载，没有请求 Range 时服务器也可能返回 206、416，这时还没有临时文件
+		if err = os.Remove(s2); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		err = s.downloadRange(ctx, f, d, s2, 0)
+	}
+	if err != nil {
+		return err
+	}
+
+	if err = verifyDownload(s2, d); err != nil {
+		// 大小已经达到或超过预期但校验失败，续传也没有意义，删掉重新下载
+		if info, statErr := os.Stat(s2); statErr == nil && d.Size > 0 && info.Size() >= d.Size {
+			_ = os.Remove(s2)
+		}
+		return err
+	}
+	return os.Rename(s2, d.Path)
+}
+
+// PartialSize 返回未完成的临时文件大小，不存在时返回0
+func PartialSize(path string) int64 {
+	info, err := os.Stat(path + ".download")
+	if err != nil {
+		return 0
+	}
+	return info.Size()
+}
+
+// verifyDownload 检查临时文件是否完整：大小不为0、和服务器返回的大小一致，开启校验时检查 mp4 结构
+func verifyDownload(s2 string, d *Download) error {
+	info, err := os.Stat(s2)
+	if err != nil {
+		return err
+	}
+	if info.Size() == 0 {
+		return errEmptyFile
+	}
+	if d.Size > 0 && info.Size() != d.Size {
+		return fmt.Errorf("%w: 已下载 %d 字节，文件大小 %d 字节", errIncomplete, info.Size(), d.Size)
+	}
+	if d.CheckMp4 {
+		return checkMp4(s2)
+	}
+	return nil
+}
+
+// downloadRange 从 offset 处开始下载到临时文件，offset 为0时从头下载
+func (s *Server) downloadRange(ctx context.Context, f *fileProgress, d *Download, s2 string, offset int64) error {
+	client := &http.Client{}
+
+	// 创建一个 GET 请求
+	req, err := http.NewRequestWithContext(ctx, "GET", d.Url, nil)
+	if err != nil {
+		return err
+	}
+
+	//// 设置请求头
+	req.Header.Set("accept", "text/html,application/xhtml+xml,application/xml;q=0.9,image/avif,image/webp,image/apng,*/*;q=0.8,application/signed-exchange;v=b3;q=0.7")
+	req.Header.Set("accept-language", "zh-CN,zh;q=0.9")
+	req.Header.Set("cache-control", "max-age=0")
+	req.Header.Set("sec-ch-ua", "Chromium;v=\"122\", \"Not(A:Brand\";v=\"24\", \"Google Chrome\";v=\"122\"")
+	req.Header.Set("sec-ch-ua-platform", "Android")
+	req.Header.Set("sec-fetch-dest", "document")
+	req.Header.Set("sec-fetch-mode", "navigate")
+	req.Header.Set("sec-fetch-site", "none")
+	req.Header.Set("sec-fetch-user", "?1")
+	req.Header.Set("upgrade-insecure-requests", "1")
+	if offset > 0 {
+		req.Header.Set("range", fmt.Sprintf("bytes=%d-", offset))
+		// 弱 ETag 不能用于 If-Range，这时退回到 Last-Modified
+		if d.ETag != "" && !strings.HasPrefix(d.ETag, "W/") {
+			req.Header.Set("if-range", d.ETag)
+		} else if d.LastModified != "" {
+			req.Header.Set("if-range", d.LastModified)
+		}
+	}
+
+	// 发送请求并获取响应
+	resp, err := client.Do(req)
+
+	// Get the data
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	var out *os.File
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+		start, total, err := parseContentRange(resp.Header.Get("Content-Range"))
+		if err != nil || start != offset {
+			return errRangeMismatch
+		}
+		d.Size = max64(total, 0)
+		// offset 为0时服务器主动返回的 206，临时文件还不存在
+		out, err = os.OpenFile(s2, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+		if err != nil {
+			return err
+		}
+	case http.StatusRequestedRangeNotSatisfiable:
+		// 本地文件已经是完整的
+		_, total, err := parseContentRange(resp.Header.Get("Content-Range"))
+		if err != nil || total != offset {
+			return errRangeMismatch
+		}
+		d.Size = total
+		s.stats.SetSize(f, total, total)
+		return nil
+	default:
+		if resp.StatusCode > 300 {
+			return &HTTPError{StatusCode: resp.StatusCode, Status: resp.Status}
+		}
+		// 服务器不支持断点续传或者文件已经变化，从头下载
+		offset = 0
+		d.Size = max64(resp.ContentLength, 0)
+		out, err = os.Create(s2)
+		if err != nil {
+			return err
+		}
+	}
+	d.ETag = resp.Header.Get("ETag")
+	d.LastModified = resp.Header.Get("Last-Modified")
+
+	s.stats.SetSize(f, d.Size, offset)
+	copier := &statsWriter{
+		writer: out,
+		stats:  &s.stats,
+		file:   f,
+	}
+	_, err = io.Copy(copier, resp.Body)
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+func max64(a, b int64) int64 {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+// parseContentRange 解析 "bytes start-end/total" 或 "bytes */total"，total 未知时返回 -1
+func parseContentRange(v string) (start, total int64, err error) {
+	v, ok := strings.CutPrefix(v, "bytes ")
+	if !ok {
+		return 0, 0, fmt.Errorf("无效的 content-range: %q", v)
+	}
+	rng, size, ok := strings.Cut(v, "/")
+	if !ok {
+		return 0, 0, fmt.Errorf("无效的 content-range: %q", v)
+	}
+	total = -1
+	if size != "*" {
+		if total, err = strconv.ParseInt(size, 10, 64); err != nil {
+			return 0, 0, err
+		}
+	}
+	if rng == "*" {
+		return 0, total, nil
+	}
+	first, _, ok := strings.Cut(rng, "-")
+	if !ok {
+		return 0, 0, fmt.Errorf("无效的 content-range: %q", v)
+	}
+	start, err = strconv.ParseInt(first, 10, 64)
+	return start, total, err
+}
+
+// checkMp4 检查 mp4 顶层 box：第一个必须是 ftyp，必须包含 moov，且所有 box 正好占满整个文件
+func checkMp4(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	var pos int64
+	var hasMoov bool
+	header := make([]byte, 16)
+	for i := 0; pos < info.Size(); i++ {
+		if _, err = f.ReadAt(header[:8], pos); err != nil {
+			return fmt.Errorf("%w: 读取 box 头失败: %v", errInvalidMp4, err)
+		}
+		size := int64(binary.BigEndian.Uint32(header[:4]))
+		boxType := string(header[4:8])
+		switch size {
+		case 0:
+			// box 一直延续到文件末尾
+			size = info.Size() - pos
+		case 1:
+			if _, err = f.ReadAt(header[8:16], pos+8); err != nil {
+				return fmt.Errorf("%w: 读取 box 头失败: %v", errInvalidMp4, err)
+			}
+			size = int64(binary.BigEndian.Uint64(header[8:16]))
+		}
+		if size < 8 || pos+size > info.Size() {
+			return fmt.Errorf("%w: %s box 大小 %d 超出文件范围", errInvalidMp4, boxType, size)
+		}
+		if i == 0 && boxType != "ftyp" {
+			return fmt.Errorf("%w: 第一个 box 是 %q，不是 ftyp", errInvalidMp4, boxType)
+		}
+		if boxType == "moov" {
+			hasMoov = true
+		}
+		pos += size
+	}
+	if !hasMoov {
+		return fmt.Errorf("%w: 缺少 moov", errInvalidMp4)
+	}
+	return nil
+}
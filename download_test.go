@@ -0,0 +1,232 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// rangeServer 支持 Range、If-Range 的文件服务器，记录收到的 Range 头
+func rangeServer(t *testing.T, content []byte, etag string) (*httptest.Server, *[]string) {
+	var ranges []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ranges = append(ranges, r.Header.Get("Range"))
+		w.Header().Set("ETag", etag)
+		http.ServeContent(w, r, "video.mp4", time.Unix(1700000000, 0), bytes.NewReader(content))
+	}))
+	t.Cleanup(srv.Close)
+	return srv, &ranges
+}
+
+func testContent() []byte {
+	content := make([]byte, 64*1024)
+	for i := range content {
+		content[i] = byte(i % 251)
+	}
+	return content
+}
+
+func TestDownloadFileResume(t *testing.T) {
+	content := testContent()
+	srv, ranges := rangeServer(t, content, `"v1"`)
+
+	path := filepath.Join(t.TempDir(), "牛歌戏.mp4")
+	if err := os.WriteFile(path+".download", content[:1000], 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	s := &Server{}
+	d := &Download{Url: srv.URL, Path: path, Title: "牛歌戏.mp4", ETag: `"v1"`}
+	if err := s.DownloadFile(context.Background(), d); err != nil {
+		t.Fatal(err)
+	}
+	if got := (*ranges)[0]; got != "bytes=1000-" {
+		t.Errorf("range = %q, 期望从断点处续传", got)
+	}
+	got, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, content) {
+		t.Errorf("文件内容不一致, 长度 %d, 期望 %d", len(got), len(content))
+	}
+	if d.ETag != `"v1"` {
+		t.Errorf("etag = %q", d.ETag)
+	}
+}
+
+func TestDownloadFileRestartOnChanged(t *testing.T) {
+	content := testContent()
+	srv, _ := rangeServer(t, content, `"v2"`)
+
+	path := filepath.Join(t.TempDir(), "牛歌戏.mp4")
+	// 本地的临时文件来自旧版本，If-Range 不匹配时服务器会返回完整内容
+	if err := os.WriteFile(path+".download", bytes.Repeat([]byte{0xff}, 1000), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	s := &Server{}
+	d := &Download{Url: srv.URL, Path: path, Title: "牛歌戏.mp4", ETag: `"v1"`}
+	if err := s.DownloadFile(context.Background(), d); err != nil {
+		t.Fatal(err)
+	}
+	got, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, content) {
+		t.Errorf("文件内容不一致, 长度 %d, 期望 %d", len(got), len(content))
+	}
+	if d.ETag != `"v2"` {
+		t.Errorf("etag = %q, 应该更新为新的值", d.ETag)
+	}
+}
+
+func TestDownloadFileNoRangeSupport(t *testing.T) {
+	content := testContent()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write(content)
+	}))
+	defer srv.Close()
+
+	path := filepath.Join(t.TempDir(), "牛歌戏.mp4")
+	if err := os.WriteFile(path+".download", content[:1000], 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	s := &Server{}
+	if err := s.DownloadFile(context.Background(), &Download{Url: srv.URL, Path: path, Title: "牛歌戏.mp4"}); err != nil {
+		t.Fatal(err)
+	}
+	got, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, content) {
+		t.Errorf("文件内容不一致, 长度 %d, 期望 %d", len(got), len(content))
+	}
+}
+
+// TestDownloadFileUnrequestedRange 没有请求 Range 时服务器返回 206、416，没有临时文件也能下载
+func TestDownloadFileUnrequestedRange(t *testing.T) {
+	content := testContent()
+	var requests int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if requests == 1 {
+			w.Header().Set("Content-Range", "bytes */"+strconv.Itoa(len(content)))
+			w.WriteHeader(http.StatusRequestedRangeNotSatisfiable)
+			return
+		}
+		w.Header().Set("Content-Range", "bytes 0-"+strconv.Itoa(len(content)-1)+"/"+strconv.Itoa(len(content)))
+		w.WriteHeader(http.StatusPartialContent)
+		_, _ = w.Write(content)
+	}))
+	defer srv.Close()
+
+	path := filepath.Join(t.TempDir(), "牛歌戏.mp4")
+	s := &Server{}
+	if err := s.DownloadFile(context.Background(), &Download{Url: srv.URL, Path: path, Title: "牛歌戏.mp4"}); err != nil {
+		t.Fatal(err)
+	}
+	got, err := os.ReadFile(path)
+	if err != nil || !bytes.Equal(got, content) {
+		t.Errorf("文件内容不一致, 长度 %d, %v", len(got), err)
+	}
+	if requests != 2 {
+		t.Errorf("requests = %d", requests)
+	}
+}
+
+func TestParseContentRange(t *testing.T) {
+	tests := []struct {
+		in           string
+		start, total int64
+		wantErr      bool
+	}{
+		{"bytes 100-199/200", 100, 200, false},
+		{"bytes 0-99/*", 0, -1, false},
+		{"bytes */200", 0, 200, false},
+		{"100-199/200", 0, 0, true},
+		{"bytes 100-199", 0, 0, true},
+	}
+	for _, tt := range tests {
+		start, total, err := parseContentRange(tt.in)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%q: err = %v", tt.in, err)
+			continue
+		}
+		if !tt.wantErr && (start != tt.start || total != tt.total) {
+			t.Errorf("%q: got %d/%d, want %d/%d", tt.in, start, total, tt.start, tt.total)
+		}
+	}
+}
+
+func TestDownloadFileKeepPartial(t *testing.T) {
+	content := testContent()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// 声明的大小比实际发送的多，模拟下载中途断开
+		w.Header().Set("Content-Length", strconv.Itoa(len(content)))
+		_, _ = w.Write(content[:500])
+	}))
+	defer srv.Close()
+
+	path := filepath.Join(t.TempDir(), "牛歌戏.mp4")
+	s := &Server{}
+	d := &Download{Url: srv.URL, Path: path, Title: "牛歌戏.mp4"}
+	if err := s.DownloadFile(context.Background(), d); err == nil {
+		t.Fatal("下载不完整时应该返回错误")
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("不完整的文件不应该改名为 mp4: %v", err)
+	}
+	if got := PartialSize(path); got != 500 {
+		t.Errorf("临时文件大小 = %d, 期望 500", got)
+	}
+	if d.Size != int64(len(content)) {
+		t.Errorf("文件大小 = %d", d.Size)
+	}
+}
+
+func mp4Box(boxType string, payload int) []byte {
+	b := make([]byte, 8+payload)
+	binary.BigEndian.PutUint32(b, uint32(len(b)))
+	copy(b[4:], boxType)
+	return b
+}
+
+func TestCheckMp4(t *testing.T) {
+	tests := map[string]struct {
+		content []byte
+		valid   bool
+	}{
+		"完整":      {bytes.Join([][]byte{mp4Box("ftyp", 16), mp4Box("moov", 100), mp4Box("mdat", 1000)}, nil), true},
+		"moov在末尾": {bytes.Join([][]byte{mp4Box("ftyp", 16), mp4Box("mdat", 1000), mp4Box("moov", 100)}, nil), true},
+		"缺少moov":  {bytes.Join([][]byte{mp4Box("ftyp", 16), mp4Box("mdat", 1000)}, nil), false},
+		"缺少ftyp":  {bytes.Join([][]byte{mp4Box("moov", 100), mp4Box("mdat", 1000)}, nil), false},
+		"被截断":     {bytes.Join([][]byte{mp4Box("ftyp", 16), mp4Box("moov", 100), mp4Box("mdat", 1000)}, nil)[:500], false},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "a.mp4")
+			if err := os.WriteFile(path, tt.content, 0o644); err != nil {
+				t.Fatal(err)
+			}
+			err := checkMp4(path)
+			if tt.valid && err != nil {
+				t.Errorf("应该校验通过: %v", err)
+			}
+			if !tt.valid && !errors.Is(err, errInvalidMp4) {
+				t.Errorf("应该校验失败: %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// urlTTL 下载地址中没有过期时间时，获取后按这么久有效
+	urlTTL = time.Hour
+	// urlExpiryMargin 离过期不到这么久时就重新获取，留出下载的时间
+	urlExpiryMargin = 5 * time.Minute
+)
+
+// expiryParams 签名的下载地址中表示过期时间的参数，值为 Unix 时间戳，不区分大小写
+var expiryParams = []string{"expire", "expires", "x-expires", "deadline", "x-oss-expires"}
+
+// URLExpiry 从签名的下载地址的参数中解析过期时间，没有时返回 false。
+// 支持 expire=1700000000 这样的时间戳、S3 的 X-Amz-Date 加 X-Amz-Expires、阿里云 CDN 的 auth_key
+func URLExpiry(rawUrl string) (time.Time, bool) {
+	u, err := url.Parse(rawUrl)
+	if err != nil {
+		return time.Time{}, false
+	}
+	query := make(map[string]string)
+	for key, values := range u.Query() {
+		if len(values) > 0 {
+			query[strings.ToLower(key)] = values[0]
+		}
+	}
+	for _, key := range expiryParams {
+		if t, ok := parseUnixTime(query[key]); ok {
+			return t, true
+		}
+	}
+	if date, err := time.Parse("20060102T150405Z", query["x-amz-date"]); err == nil {
+		if seconds, err := strconv.Atoi(query["x-amz-expires"]); err == nil {
+			return date.Add(time.Duration(seconds) * time.Second), true
+		}
+	}
+	// auth_key=时间戳-随机数-uid-签名
+	if key, _, ok := strings.Cut(query["auth_key"], "-"); ok {
+		return parseUnixTime(key)
+	}
+	return time.Time{}, false
+}
+
+// parseUnixTime 解析秒或者毫秒的时间戳，不像时间戳的值返回 false
+func parseUnixTime(v string) (time.Time, bool) {
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil {
+		return time.Time{}, false
+	}
+	switch {
+	case n >= 1e12 && n < 1e13:
+		return time.UnixMilli(n), true
+	case n >= 1e9 && n < 1e10:
+		return time.Unix(n, 0), true
+	}
+	return time.Time{}, false
+}
+
+// urlValid 下载地址是否还可以直接使用：地址中有过期时间时按过期时间判断，没有时按获取的时间判断，
+// 不知道什么时候获取的（旧版或者导入的地址）都重新获取
+func urlValid(u string, resolvedAt *time.Time, now time.Time) bool {
+	if u == "" {
+		return false
+	}
+	if exp, ok := URLExpiry(u); ok {
+		return now.Add(urlExpiryMargin).Before(exp)
+	}
+	return resolvedAt != nil && now.Sub(*resolvedAt) < urlTTL
+}
+
+// urlForbidden 下载地址的签名过期时服务器返回 403
+func urlForbidden(err error) bool {
+	var httpErr *HTTPError
+	return errors.As(err, &httpErr) && httpErr.StatusCode == http.StatusForbidden
+}
+
+// refreshDownloadUrl 重新获取网页端（mobile 为 false）或手机端的下载地址，成功时更新 v 中的地址和获取时间，
+// 失败时保留原来的地址，返回尝试的次数
+func (s *Server) refreshDownloadUrl(ctx context.Context, conf Conf, v *Video, mobile bool) (int, error) {
+	name, resolve := "获取下载地址 ", func() (string, error) { return s.GetDownloadUrlParse(ctx, *v) }
+	if mobile {
+		name, resolve = "获取手机端下载地址 ", func() (string, error) { return s.GetDownloadUrlChrome(ctx, conf, *v) }
+	}
+	var u string
+	n, err := conf.Retry.Do(ctx, name+v.SaveName, func() (err error) {
+		u, err = resolve()
+		return err
+	})
+	if err != nil {
+		return n, err
+	}
+	now := time.Now()
+	if mobile {
+		v.MDownloadUrl, v.MResolvedAt = u, &now
+	} else {
+		v.WebDownloadUrl, v.WebResolvedAt = u, &now
+	}
+	return n, nil
+}
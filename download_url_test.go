@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestURLExpiry(t *testing.T) {
+	tests := map[string]struct {
+		url  string
+		want int64 // 0 为没有过期时间
+	}{
+		"expire":     {"https://v3-xg.ixigua.com/a.mp4?a=1768&expire=1700003600&sign=x", 1700003600},
+		"大写":         {"https://cdn.test/a.mp4?Expires=1700003600", 1700003600},
+		"毫秒":         {"https://cdn.test/a.mp4?x-expires=1700003600000", 1700003600},
+		"s3":         {"https://s3.test/a.mp4?X-Amz-Date=20231114T221320Z&X-Amz-Expires=3600", 1700003600},
+		"auth_key":   {"https://cdn.test/a.mp4?auth_key=1700003600-0-0-abcdef", 1700003600},
+		"没有签名":       {"https://cdn.test/a.mp4?a=1", 0},
+		"不是时间戳":      {"https://cdn.test/a.mp4?expire=3600", 0},
+		"无效的地址":      {"://", 0},
+		"auth_key错误": {"https://cdn.test/a.mp4?auth_key=abc", 0},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			got, ok := URLExpiry(tt.url)
+			if ok != (tt.want != 0) || (ok && got.Unix() != tt.want) {
+				t.Errorf("got %v, %v, want %d", got, ok, tt.want)
+			}
+		})
+	}
+}
+
+func TestUrlValid(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	recent, old := now.Add(-10*time.Minute), now.Add(-2*urlTTL)
+	tests := map[string]struct {
+		url        string
+		resolvedAt *time.Time
+		want       bool
+	}{
+		"没有地址":      {"", &recent, false},
+		"还没有过期":     {"https://cdn.test/a.mp4?expire=1700003600", nil, true},
+		"快要过期":      {"https://cdn.test/a.mp4?expire=1700000060", &recent, false},
+		"已经过期":      {"https://cdn.test/a.mp4?expire=1699990000", &recent, false},
+		"刚获取的":      {"https://cdn.test/a.mp4", &recent, true},
+		"很久以前获取的":   {"https://cdn.test/a.mp4", &old, false},
+		"不知道什么时候获取": {"https://cdn.test/a.mp4", nil, false},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			if got := urlValid(tt.url, tt.resolvedAt, now); got != tt.want {
+				t.Errorf("got %v", got)
+			}
+		})
+	}
+}
+
+// TestDownloadVideoUrlCache 没有过期的地址直接下载，过期的和返回 403 的地址重新获取后下载
+func TestDownloadVideoUrlCache(t *testing.T) {
+	// 只有 /fresh 开头的地址可以下载，其他的签名都已经失效
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.URL.Path, "/fresh") {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		w.Write([]byte("video " + r.URL.Path))
+	}))
+	defer srv.Close()
+	future := strconv.FormatInt(time.Now().Add(time.Hour).Unix(), 10)
+	past := strconv.FormatInt(time.Now().Add(-time.Hour).Unix(), 10)
+	downloads := map[string]string{
+		"https://fake.test/v/2": srv.URL + "/fresh/2.mp4?expire=" + future,
+		"https://fake.test/v/3": srv.URL + "/fresh/3.mp4",
+	}
+	useSource(t, fakeSource{downloads: downloads})
+
+	recent := time.Now().Add(-time.Minute)
+	store := NewMemoryStore()
+	videos := []Video{
+		// 还没有过期，不会重新获取（fake.test/v/1 获取不到地址）
+		{WebUrl: "https://fake.test/v/1", Source: "fake", SaveName: "1", WebDownloadUrl: srv.URL + "/fresh/1.mp4?expire=" + future},
+		// 已经过期
+		{WebUrl: "https://fake.test/v/2", Source: "fake", SaveName: "2", WebDownloadUrl: srv.URL + "/old/2.mp4?expire=" + past},
+		// 地址中没有过期时间，刚获取的，但是服务器返回 403
+		{WebUrl: "https://fake.test/v/3", Source: "fake", SaveName: "3", WebDownloadUrl: srv.URL + "/old/3.mp4", WebResolvedAt: &recent},
+	}
+	if err := store.Save(videos); err != nil {
+		t.Fatal(err)
+	}
+	conf := DefaultConf()
+	conf.Retry = RetryPolicy{MaxAttempts: 1}
+	dir := t.TempDir()
+	s := &Server{store: store}
+	// 排队之后修改的名称不会被下载时的旧数据覆盖
+	if err := store.UpdateSaveName(videos[1].ID, "改过的名称"); err != nil {
+		t.Fatal(err)
+	}
+	for _, v := range videos {
+		path := filepath.Join(dir, v.SaveName+".mp4")
+		if err := s.downloadVideo(context.Background(), conf, 1, path, v); err != nil {
+			t.Fatalf("%s: %v", v.SaveName, err)
+		}
+		data, _ := os.ReadFile(path)
+		if want := "video /fresh/" + v.SaveName + ".mp4"; string(data) != want {
+			t.Errorf("%s = %q, want %q", v.SaveName, data, want)
+		}
+	}
+
+	// 重新获取的地址和获取时间保存到数据库
+	for i, want := range []string{videos[0].WebDownloadUrl, downloads["https://fake.test/v/2"], downloads["https://fake.test/v/3"]} {
+		got, _ := store.GetVideo(videos[i].ID)
+		if got.WebDownloadUrl != want {
+			t.Errorf("%s url = %q, want %q", got.SaveName, got.WebDownloadUrl, want)
+		}
+		if i > 0 && (got.WebResolvedAt == nil || time.Since(*got.WebResolvedAt) > time.Minute) {
+			t.Errorf("%s resolvedAt = %v", got.SaveName, got.WebResolvedAt)
+		}
+	}
+	if got, _ := store.GetVideo(videos[1].ID); got.SaveName != "改过的名称" {
+		t.Errorf("save name reverted to %q", got.SaveName)
+	}
+}
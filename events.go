@@ -0,0 +1,143 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// EventType 进度事件的类型
+type EventType string
+
+const (
+	EventRunStarted      EventType = "runStarted"      // 任务开始
+	EventRunFinished     EventType = "runFinished"     // 任务结束，Error 为失败原因，Progress 为最终的下载统计
+	EventStageStarted    EventType = "stageStarted"    // 开始 crawl、resolve、download 中的一个阶段
+	EventStageFinished   EventType = "stageFinished"   // 一个阶段结束，Error 为失败原因
+	EventVideoDiscovered EventType = "videoDiscovered" // 获取到新的视频
+	EventUrlResolved     EventType = "urlResolved"     // 获取到视频的下载地址
+	EventDownloaded      EventType = "downloaded"      // 一个视频下载完成
+	EventProgress        EventType = "progress"        // 下载进度，下载过程中每秒一次
+	EventError           EventType = "error"           // 一个频道或视频处理失败，不影响其他的
+)
+
+// progressInterval 下载过程中发送进度事件的间隔
+const progressInterval = time.Second
+
+// subscriberBuffer 每个订阅者最多缓存的事件数
+const subscriberBuffer = 256
+
+// deliverTimeout 订阅者缓存满时，开始、结束和失败的事件最多等待的时间
+const deliverTimeout = time.Second
+
+// Event 运行过程中的一个进度事件
+type Event struct {
+	Type     EventType      `json:"type"`
+	Time     time.Time      `json:"time"`
+	Stage    string         `json:"stage,omitempty"` // crawl、resolve、download
+	VideoID  uint           `json:"videoId,omitempty"`
+	Title    string         `json:"title,omitempty"`
+	Error    string         `json:"error,omitempty"`
+	Progress *StatsSnapshot `json:"progress,omitempty"`
+}
+
+// EventBus 把进度事件发给所有的订阅者，界面、命令行和 /api/events 都通过它获取进度。
+// 零值可以直接使用
+type EventBus struct {
+	mu   sync.Mutex
+	subs map[chan Event]struct{}
+}
+
+// Subscribe 订阅之后的事件，不再需要时调用返回的函数取消订阅，取消后 channel 会关闭
+func (b *EventBus) Subscribe() (<-chan Event, func()) {
+	ch := make(chan Event, subscriberBuffer)
+	b.mu.Lock()
+	if b.subs == nil {
+		b.subs = make(map[chan Event]struct{})
+	}
+	b.subs[ch] = struct{}{}
+	b.mu.Unlock()
+
+	var once sync.Once
+	return ch, func() {
+		once.Do(func() {
+			b.mu.Lock()
+			delete(b.subs, ch)
+			b.mu.Unlock()
+			close(ch)
+		})
+	}
+}
+
+// Publish 发送事件。订阅者处理不过来、缓存满了时，开始、结束和失败的事件最多等待 deliverTimeout，
+// 其他事件直接丢掉，下载进度下一秒会再发送
+func (b *EventBus) Publish(e Event) {
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var timeout <-chan time.Time
+	if e.mustDeliver() {
+		timer := time.NewTimer(deliverTimeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	for ch := range b.subs {
+		select {
+		case ch <- e:
+			continue
+		default:
+		}
+		if timeout == nil {
+			continue
+		}
+		select {
+		case ch <- e:
+		case <-timeout:
+			// 已经等待够了，后面缓存满的订阅者不再等待
+			timeout = nil
+		}
+	}
+}
+
+// mustDeliver 丢掉后不会再发送、订阅者需要知道的事件
+func (e Event) mustDeliver() bool {
+	switch e.Type {
+	case EventRunStarted, EventRunFinished, EventStageStarted, EventStageFinished, EventError:
+		return true
+	}
+	return false
+}
+
+// publishError 发送一个视频处理失败的事件
+func (s *Server) publishError(stage string, v Video, msg string) {
+	s.events.Publish(Event{Type: EventError, Stage: stage, VideoID: v.ID, Title: v.SaveName, Error: msg})
+}
+
+// runStage 执行一个阶段，前后发送开始和结束的事件
+func (s *Server) runStage(stage string, fn func() error) error {
+	s.events.Publish(Event{Type: EventStageStarted, Stage: stage})
+	err := fn()
+	e := Event{Type: EventStageFinished, Stage: stage}
+	if err != nil {
+		e.Error = err.Error()
+	}
+	s.events.Publish(e)
+	return err
+}
+
+// publishProgress 每秒发送一次下载进度，直到 done 关闭，没有在下载时不发送
+func (s *Server) publishProgress(done <-chan struct{}) {
+	ticker := time.NewTicker(progressInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			if snap := s.stats.Snapshot(); snap.TotalFiles > 0 {
+				s.events.Publish(Event{Type: EventProgress, Progress: &snap})
+			}
+		}
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestEventBus(t *testing.T) {
+	var bus EventBus
+	a, unsubscribeA := bus.Subscribe()
+	b, unsubscribeB := bus.Subscribe()
+
+	bus.Publish(Event{Type: EventStageStarted, Stage: StageCrawl})
+	for _, ch := range []<-chan Event{a, b} {
+		if e := <-ch; e.Type != EventStageStarted || e.Stage != StageCrawl || e.Time.IsZero() {
+			t.Errorf("event = %+v", e)
+		}
+	}
+
+	// 取消订阅后 channel 关闭，不再收到事件，重复取消不会出错
+	unsubscribeA()
+	unsubscribeA()
+	if _, ok := <-a; ok {
+		t.Error("channel should be closed")
+	}
+
+	// 订阅者不读取时不阻塞，多出来的事件丢掉
+	for i := 0; i < subscriberBuffer+10; i++ {
+		bus.Publish(Event{Type: EventProgress})
+	}
+	if len(b) != subscriberBuffer {
+		t.Errorf("buffered = %d", len(b))
+	}
+
+	// 缓存满时结束的事件等订阅者读取后送到
+	published := make(chan struct{})
+	go func() {
+		defer close(published)
+		bus.Publish(Event{Type: EventRunFinished})
+	}()
+	// 等 Publish 遇到满的缓存后再开始读取
+	time.Sleep(deliverTimeout / 10)
+	var last Event
+	for i := 0; i <= subscriberBuffer; i++ {
+		select {
+		case last = <-b:
+		case <-time.After(2 * deliverTimeout):
+			t.Fatal("runFinished dropped")
+		}
+	}
+	if last.Type != EventRunFinished {
+		t.Errorf("last event = %+v", last)
+	}
+	<-published
+	unsubscribeB()
+}
+
+// collectEvents 收集运行过程中的事件类型，调用返回的函数结束收集
+func collectEvents(s *Server) func() []Event {
+	events, unsubscribe := s.events.Subscribe()
+	var got []Event
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for e := range events {
+			if e.Type != EventProgress {
+				got = append(got, e)
+			}
+		}
+	}()
+	return func() []Event {
+		unsubscribe()
+		<-done
+		return got
+	}
+}
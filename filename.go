@@ -0,0 +1,137 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	// maxComponentBytes 大部分文件系统中一层目录或文件名的最大字节数
+	maxComponentBytes = 255
+	// maxNameBytes 文件名（不含扩展名）的最大字节数，留出重名序号、.mp4 和下载中的 .download 的长度
+	maxNameBytes = 200
+)
+
+// reservedChars Windows 文件名中不能使用的字符，换成相似的全角字符
+var reservedChars = map[rune]rune{
+	'<': '＜', '>': '＞', ':': '：', '"': '＂', '|': '｜', '?': '？', '*': '＊',
+	'/': '-', '\\': '-',
+}
+
+// reservedNames Windows 中的设备名，加上扩展名也不能作为文件名
+var reservedNames = map[string]bool{
+	"CON": true, "PRN": true, "AUX": true, "NUL": true,
+	"COM1": true, "COM2": true, "COM3": true, "COM4": true, "COM5": true, "COM6": true, "COM7": true, "COM8": true, "COM9": true,
+	"LPT1": true, "LPT2": true, "LPT3": true, "LPT4": true, "LPT5": true, "LPT6": true, "LPT7": true, "LPT8": true, "LPT9": true,
+}
+
+// SanitizeFileName 把名称转换成 Windows、NTFS、Linux、macOS 上都可以使用的一层目录名或文件名：
+// 替换保留字符，去掉控制字符和末尾的空格、点，避开设备名，按 UTF-8 的字节数截断
+func SanitizeFileName(name string, maxBytes int) string {
+	var b strings.Builder
+	for _, r := range name {
+		if r < 0x20 || r == 0x7f {
+			continue
+		}
+		if c, ok := reservedChars[r]; ok {
+			r = c
+		}
+		b.WriteRune(r)
+	}
+	s := truncateBytes(strings.TrimSpace(b.String()), maxBytes)
+	// Windows 会去掉末尾的空格和点，导致和其他文件重名
+	s = strings.TrimRight(s, " .")
+	if s == "" {
+		return "_"
+	}
+	base, _, _ := strings.Cut(s, ".")
+	if reservedNames[strings.ToUpper(strings.TrimSpace(base))] {
+		s = "_" + s
+	}
+	return s
+}
+
+// truncateBytes 按字节数截断，不会截断到一个字符的中间
+func truncateBytes(s string, maxBytes int) string {
+	if len(s) <= maxBytes {
+		return s
+	}
+	s = s[:maxBytes]
+	for len(s) > 0 && !utf8.ValidString(s) {
+		s = s[:len(s)-1]
+	}
+	return s
+}
+
+// fileSuffix 重名的文件名后面加的序号
+func fileSuffix(n int) string {
+	if n <= 0 {
+		return ""
+	}
+	return fmt.Sprintf(" (%d)", n)
+}
+
+// pathKey 比较路径是否相同，Windows 和 NTFS 不区分大小写
+func pathKey(path string) string {
+	return strings.ToLower(path)
+}
+
+// onDisk 可能已经保存到本地或者将要下载的视频，只有这些视频的文件名会冲突
+func onDisk(status VideoStatus) bool {
+	switch status {
+	case StatusResolved, StatusQueued, StatusDownloading, StatusDownloaded, StatusFailed:
+		return true
+	}
+	return false
+}
+
+// assignSuffixes 找出保存路径相同的视频，已下载的和先获取到的保留原来的文件名，其他的在文件名后面加上 (2)、(3) 这样的序号
+// 并记录到数据库，已经记录的序号不再改变，修改后的序号同时写回 list。
+// 已删除、不下载、还没有下载地址的视频不占用文件名
+func (s *Server) assignSuffixes(p videoPaths, list []Video) error {
+	order := make([]int, 0, len(list))
+	natural := make(map[string]int, len(list))
+	for i := range list {
+		if !onDisk(list[i].Status) {
+			continue
+		}
+		order = append(order, i)
+		natural[pathKey(p.File(list[i]))]++
+	}
+	sort.SliceStable(order, func(i, j int) bool {
+		a, b := list[order[i]], list[order[j]]
+		if (a.Status == StatusDownloaded) != (b.Status == StatusDownloaded) {
+			return a.Status == StatusDownloaded
+		}
+		return a.ID < b.ID
+	})
+
+	taken := make(map[string]bool, len(list))
+	for _, i := range order {
+		v := &list[i]
+		key := pathKey(p.File(*v))
+		if !taken[key] {
+			taken[key] = true
+			continue
+		}
+		// 序号从2开始，不能占用其他视频原来的路径
+		n := 2
+		if v.FileSuffix >= n {
+			n = v.FileSuffix + 1
+		}
+		for ; ; n++ {
+			v.FileSuffix = n
+			key = pathKey(p.File(*v))
+			if !taken[key] && natural[key] == 0 {
+				break
+			}
+		}
+		taken[key] = true
+		if err := s.store.UpdateFileSuffix(v.ID, n); err != nil {
+			return err
+		}
+	}
+	return nil
+}
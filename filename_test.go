@@ -0,0 +1,138 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestSanitizeFileName(t *testing.T) {
+	tests := map[string]string{
+		"妹仔想当主人婆第1集":    "妹仔想当主人婆第1集",
+		`a/b\c`:         "a-b-c",
+		`问题?<是>:"什么"|*`: "问题？＜是＞：＂什么＂｜＊",
+		"换行\n制表\t":      "换行制表",
+		"结尾的点...":       "结尾的点",
+		" 首尾空格 . ":      "首尾空格",
+		"...":           "_",
+		"":              "_",
+		"CON":           "_CON",
+		"con.mp4":       "_con.mp4",
+		"Lpt1 ":         "_Lpt1",
+		"CONSOLE":       "CONSOLE",
+	}
+	for in, want := range tests {
+		if got := SanitizeFileName(in, maxComponentBytes); got != want {
+			t.Errorf("SanitizeFileName(%q) = %q, want %q", in, got, want)
+		}
+	}
+
+	long := strings.Repeat("牛歌戏", 50)
+	got := SanitizeFileName(long, maxNameBytes)
+	if len(got) > maxNameBytes || !utf8.ValidString(got) || !strings.HasPrefix(long, got) {
+		t.Errorf("truncated to %d bytes: %q", len(got), got)
+	}
+	if got = SanitizeFileName("牛歌戏"+strings.Repeat(".", 300), 20); got != "牛歌戏" {
+		t.Errorf("truncated dots = %q", got)
+	}
+}
+
+func TestPathSanitize(t *testing.T) {
+	tmpl, _ := ParsePathTemplate("{channel}/{series}/{name}")
+	v := Video{SaveName: "CON", Series: "问题?", Episode: 1, FileSuffix: 2}
+	want := filepath.Join("root", "_", "平南", "问题？", "_CON (2).mp4")
+	if got := tmpl.Path("root", "../平南/", v); got != want {
+		t.Errorf("Path = %s, want %s", got, want)
+	}
+	v.SaveName = strings.Repeat("长", 100)
+	if base := filepath.Base(tmpl.Path("root", "", v)); len(base+".download") > maxComponentBytes {
+		t.Errorf("file name too long: %d bytes", len(base))
+	}
+}
+
+func TestAssignSuffixes(t *testing.T) {
+	store := NewMemoryStore()
+	videos := []Video{
+		{WebUrl: "https://a/1", SaveName: "问题?", Status: StatusResolved},
+		{WebUrl: "https://a/2", SaveName: "问题？", Status: StatusDownloaded},
+		{WebUrl: "https://a/3", SaveName: "问题？ (2)", Status: StatusResolved},
+		{WebUrl: "https://a/4", SaveName: "ABC", Status: StatusResolved},
+		{WebUrl: "https://a/5", SaveName: "abc", Status: StatusResolved},
+		{WebUrl: "https://a/6", SaveName: "其他", Status: StatusResolved},
+	}
+	if err := store.Save(videos); err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{store: store}
+	tmpl, _ := ParsePathTemplate(DefaultPathTemplate)
+	paths := videoPaths{root: t.TempDir(), template: tmpl}
+
+	assign := func() []Video {
+		list, err := store.List()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = s.assignSuffixes(paths, list); err != nil {
+			t.Fatal(err)
+		}
+		stored, _ := store.List()
+		for i := range list {
+			if list[i].FileSuffix != stored[i].FileSuffix {
+				t.Errorf("video %d suffix %d not saved", list[i].ID, list[i].FileSuffix)
+			}
+		}
+		return list
+	}
+	list := assign()
+	// 已下载的保留原来的文件名，(2) 已经是第3个视频原来的文件名，所以用 (3)，不区分大小写
+	want := []int{3, 0, 0, 0, 2, 0}
+	seen := make(map[string]bool)
+	for i, v := range list {
+		if v.FileSuffix != want[i] {
+			t.Errorf("video %d suffix = %d, want %d", v.ID, v.FileSuffix, want[i])
+		}
+		key := pathKey(paths.File(v))
+		if seen[key] {
+			t.Errorf("duplicate path %s", paths.File(v))
+		}
+		seen[key] = true
+	}
+
+	// 已经记录的序号不再改变，原来重名的视频删除后也一样
+	if err := store.Transition(list[1].ID, StatusRemoved, ""); err != nil {
+		t.Fatal(err)
+	}
+	for i, v := range assign() {
+		if v.FileSuffix != want[i] {
+			t.Errorf("second run: video %d suffix = %d, want %d", v.ID, v.FileSuffix, want[i])
+		}
+	}
+}
+
+// TestAssignSuffixesIgnoreRemoved 已删除、不下载的视频不占用文件名
+func TestAssignSuffixesIgnoreRemoved(t *testing.T) {
+	store := NewMemoryStore()
+	videos := []Video{
+		{WebUrl: "https://a/1", SaveName: "第1集", Status: StatusRemoved},
+		{WebUrl: "https://a/2", SaveName: "第1集", Status: StatusSkipped},
+		{WebUrl: "https://a/3", SaveName: "第1集", Status: StatusDiscovered},
+		{WebUrl: "https://a/4", SaveName: "第1集", Status: StatusResolved},
+		{WebUrl: "https://a/5", SaveName: "第1集", Status: StatusQueued},
+	}
+	if err := store.Save(videos); err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{store: store}
+	tmpl, _ := ParsePathTemplate(DefaultPathTemplate)
+	list, _ := store.List()
+	if err := s.assignSuffixes(videoPaths{root: t.TempDir(), template: tmpl}, list); err != nil {
+		t.Fatal(err)
+	}
+	want := []int{0, 0, 0, 0, 2}
+	for i, v := range list {
+		if v.FileSuffix != want[i] {
+			t.Errorf("video %d (%s) suffix = %d, want %d", v.ID, v.Status, v.FileSuffix, want[i])
+		}
+	}
+}
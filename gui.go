@@ -0,0 +1,385 @@
+//go:build !nogui
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+
+	"fyne.io/fyne/v2"
+	"fyne.io/fyne/v2/app"
+	"fyne.io/fyne/v2/container"
+	"fyne.io/fyne/v2/dialog"
+	"fyne.io/fyne/v2/widget"
+)
+
+// runGUI 启动图形界面
+func runGUI(confPath string) {
+	conf, confErr := LoadConf(confPath)
+	if confErr != nil {
+		log.Println("读取配置失败", confErr)
+		conf = DefaultConf()
+	}
+	// 配置文件有错误时不写回，避免覆盖用户的配置
+	saveConf := func() {
+		if confErr != nil {
+			return
+		}
+		if err := SaveConf(confPath, conf); err != nil {
+			log.Println("保存配置失败", err)
+		}
+	}
+
+	myApp := app.NewWithID("xigua-shrimp")
+	window := myApp.NewWindow("西瓜下载工具")
+	if confErr != nil {
+		dialog.ShowError(confErr, window)
+	}
+
+	form := widget.NewForm()
+
+	s := &Server{}
+	channelButton := widget.NewButton("管理频道...", func() {
+		if err := s.openStore(conf); err != nil {
+			dialog.ShowError(err, window)
+			return
+		}
+		showChannels(myApp, s.store)
+	})
+	form.AppendItem(widget.NewFormItem("频道", channelButton))
+
+	libraryButton := widget.NewButton("浏览视频...", func() {
+		showLibrary(myApp, s, conf)
+	})
+	form.AppendItem(widget.NewFormItem("视频库", libraryButton))
+
+	titleButton := widget.NewButton("名称规则...", func() {
+		showTitleRules(myApp, s, conf, func(rules []TitleRule) {
+			conf.TitleRules = rules
+			saveConf()
+		})
+	})
+	form.AppendItem(widget.NewFormItem("保存名称", titleButton))
+
+	migrateButton := widget.NewButton("升级...", func() {
+		showMigrations(window, conf)
+	})
+	form.AppendItem(widget.NewFormItem("数据库", migrateButton))
+
+	showBrowser := widget.NewCheck("", func(b bool) {
+		conf.ShowBrowser = b
+		saveConf()
+	})
+	showBrowser.SetChecked(conf.ShowBrowser)
+	form.AppendItem(widget.NewFormItem("显示浏览器", showBrowser))
+
+	getUrl := widget.NewCheck("", func(b bool) {
+		conf.GetUrl = b
+		saveConf()
+	})
+	getUrl.SetChecked(conf.GetUrl)
+	form.AppendItem(widget.NewFormItem("获取链接", getUrl))
+
+	fillUrl := widget.NewCheck("", func(b bool) {
+		conf.FillUrl = b
+		saveConf()
+	})
+	fillUrl.SetChecked(conf.FillUrl)
+	form.AppendItem(widget.NewFormItem("填充地址", fillUrl))
+
+	download := widget.NewCheck("", func(b bool) {
+		conf.Download = b
+		saveConf()
+	})
+	download.SetChecked(conf.Download)
+	form.AppendItem(widget.NewFormItem("下载文件", download))
+
+	checkMp4 := widget.NewCheck("", func(b bool) {
+		conf.CheckMp4 = b
+		saveConf()
+	})
+	checkMp4.SetChecked(conf.CheckMp4)
+	form.AppendItem(widget.NewFormItem("校验MP4", checkMp4))
+
+	var workerOptions []string
+	for i := 1; i <= maxConcurrency; i++ {
+		workerOptions = append(workerOptions, strconv.Itoa(i))
+	}
+	concurrency := widget.NewSelect(workerOptions, func(v string) {
+		conf.Concurrency, _ = strconv.Atoi(v)
+		saveConf()
+	})
+	if conf.Concurrency > 0 {
+		concurrency.SetSelected(strconv.Itoa(conf.Concurrency))
+	} else {
+		concurrency.SetSelected("1")
+	}
+	form.AppendItem(widget.NewFormItem("同时下载", concurrency))
+
+	var tabOptions []string
+	for i := 1; i <= maxBrowserTabs; i++ {
+		tabOptions = append(tabOptions, strconv.Itoa(i))
+	}
+	browserTabs := widget.NewSelect(tabOptions, func(v string) {
+		conf.BrowserTabs, _ = strconv.Atoi(v)
+		saveConf()
+	})
+	if conf.BrowserTabs > 0 {
+		browserTabs.SetSelected(strconv.Itoa(conf.BrowserTabs))
+	} else {
+		browserTabs.SetSelected("1")
+	}
+	form.AppendItem(widget.NewFormItem("浏览器页面", browserTabs))
+
+	savePath := widget.NewEntry()
+	savePath.SetPlaceHolder("文件保存地址")
+	savePath.SetText(conf.DownloadPath)
+	savePath.Disable()
+	selectButton := widget.NewButton("浏览...", func() {
+		folderDialog := dialog.NewFolderOpen(func(uri fyne.ListableURI, err error) {
+			if err != nil {
+				dialog.ShowError(err, window)
+				return
+			}
+			if uri == nil {
+				log.Println("用户取消了选择")
+				return
+			}
+			savePath.SetText(uri.Path())
+			conf.DownloadPath = uri.Path()
+			saveConf()
+		}, window)
+		folderDialog.Show()
+	})
+	pathRow := container.NewHSplit(
+		savePath,
+		selectButton,
+	)
+	pathRow.SetOffset(0.8)
+	form.AppendItem(widget.NewFormItem("文件保存地址", pathRow))
+
+	// 保存路径模板，修改后可以把已经下载的文件移动到新的路径
+	pathTemplate := widget.NewSelectEntry([]string{DefaultPathTemplate, SeriesPathTemplate, "{channel}/{series}/{series} 第{episode:2}集.mp4", "{channel}/{year}/{date} {name}.mp4"})
+	pathTemplate.SetPlaceHolder("占位符: {" + strings.Join(pathFields, "} {") + "}")
+	pathTemplate.SetText(conf.PathTemplate)
+	applyTemplate := widget.NewButton("应用", func() {
+		old := conf.PathTemplate
+		text := strings.TrimSpace(pathTemplate.Text)
+		if _, err := ParsePathTemplate(text); err != nil {
+			dialog.ShowError(fmt.Errorf("保存路径格式错误: %w", err), window)
+			return
+		}
+		if text == old {
+			return
+		}
+		conf.PathTemplate = text
+		saveConf()
+		if conf.DownloadPath == "" {
+			return
+		}
+		dialog.ShowConfirm("保存路径", "把已经下载的文件移动到新的路径？不移动的话会重新下载", func(ok bool) {
+			if !ok {
+				return
+			}
+			runConf := conf
+			go func() {
+				n, err := s.RelocateFiles(runConf, old)
+				fyne.Do(func() {
+					if err != nil {
+						dialog.ShowError(fmt.Errorf("已移动 %d 个文件，部分失败: %w", n, err), window)
+						return
+					}
+					dialog.ShowInformation("保存路径", fmt.Sprintf("已移动 %d 个文件", n), window)
+				})
+			}()
+		}, window)
+	})
+	form.AppendItem(widget.NewFormItem("保存路径", container.NewBorder(nil, nil, nil, applyTemplate, pathTemplate)))
+
+	// 定时同步，修改后点击应用重新开始计时
+	var stopScheduler context.CancelFunc
+	startScheduler := func() error {
+		if stopScheduler != nil {
+			stopScheduler()
+			stopScheduler = nil
+		}
+		if conf.Schedule == "" {
+			return nil
+		}
+		sched, err := NewScheduler(s, conf)
+		if err != nil {
+			return err
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		stopScheduler = cancel
+		go sched.Start(ctx)
+		return nil
+	}
+	schedule := widget.NewEntry()
+	schedule.SetPlaceHolder("例如 6h、@daily、0 3 * * *，为空时不启用")
+	schedule.SetText(conf.Schedule)
+	applyButton := widget.NewButton("应用", func() {
+		old := conf.Schedule
+		conf.Schedule = strings.TrimSpace(schedule.Text)
+		if err := startScheduler(); err != nil {
+			conf.Schedule = old
+			dialog.ShowError(fmt.Errorf("定时同步格式错误: %w", err), window)
+			return
+		}
+		saveConf()
+	})
+	scheduleRow := container.NewBorder(nil, nil, nil, applyButton, schedule)
+	form.AppendItem(widget.NewFormItem("定时同步", scheduleRow))
+	if err := startScheduler(); err != nil {
+		log.Println("启动定时同步失败", err)
+	}
+
+	// 远程控制，局域网内的手机可以通过 HTTP 接口开始同步、查看进度，修改后点击应用重新启动
+	var stopAPI context.CancelFunc
+	startAPI := func() {
+		if stopAPI != nil {
+			stopAPI()
+			stopAPI = nil
+		}
+		if conf.API.Addr == "" {
+			return
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		stopAPI = cancel
+		apiConf := conf
+		go func() {
+			if err := s.ServeAPI(ctx, apiConf); err != nil {
+				log.Println("远程控制接口启动失败", err)
+				fyne.Do(func() { dialog.ShowError(fmt.Errorf("远程控制接口启动失败: %w", err), window) })
+			}
+		}()
+	}
+	apiAddr := widget.NewEntry()
+	apiAddr.SetPlaceHolder("例如 0.0.0.0:8787，为空时不启用")
+	apiAddr.SetText(conf.API.Addr)
+	apiToken := widget.NewEntry()
+	apiToken.SetPlaceHolder("访问令牌，为空时自动生成")
+	apiToken.SetText(conf.API.Token)
+	applyAPI := widget.NewButton("应用", func() {
+		api := APIConfig{Addr: strings.TrimSpace(apiAddr.Text), Token: strings.TrimSpace(apiToken.Text)}
+		if api.Addr != "" && api.Token == "" {
+			api.Token = NewToken()
+			apiToken.SetText(api.Token)
+		}
+		old := conf.API
+		conf.API = api
+		if err := conf.Validate(); err != nil {
+			conf.API = old
+			dialog.ShowError(err, window)
+			return
+		}
+		saveConf()
+		startAPI()
+	})
+	apiRow := container.NewBorder(nil, nil, nil, applyAPI, container.NewGridWithColumns(2, apiAddr, apiToken))
+	form.AppendItem(widget.NewFormItem("远程控制", apiRow))
+	startAPI()
+
+	statsLabel := widget.NewLabel("")
+
+	var startButton *widget.Button
+
+	progressBar := widget.NewProgressBar()
+	progressBar.Min = 0
+	progressBar.Max = 100
+
+	statusLabel := widget.NewLabel("准备下载...")
+	currentFileLabel := widget.NewLabel("")
+	speedLabel := widget.NewLabel("")
+
+	stopButton := widget.NewButton("停止", func() {
+		s.Stop()
+	})
+
+	startButton = widget.NewButton("开始", func() {
+		startButton.Disable()
+		conf.DownloadPath = savePath.Text
+		saveConf()
+		runConf := conf
+
+		go func() {
+			defer fyne.Do(func() { startButton.Enable() })
+			if err := s.RunWithHistory(context.Background(), runConf, TriggerManual); err != nil {
+				fyne.Do(func() {
+					statsLabel.SetText(err.Error())
+				})
+			}
+		}()
+	})
+
+	// 手动、定时和远程启动的任务都在这里刷新进度
+	events, _ := s.events.Subscribe()
+	go func() {
+		for e := range events {
+			e := e
+			fyne.Do(func() { showEvent(e, progressBar, statusLabel, currentFileLabel, speedLabel, statsLabel) })
+		}
+	}()
+
+	box := container.NewVBox(
+		form,
+		startButton,
+		stopButton,
+		progressBar,
+		statusLabel,
+		currentFileLabel,
+		speedLabel,
+		statsLabel,
+	)
+	window.SetContent(box)
+	window.Resize(fyne.NewSize(600, 400))
+	checkPendingMigrations(window, conf)
+	window.ShowAndRun()
+}
+
+// stageNames 界面上显示的阶段名称
+var stageNames = map[string]string{StageCrawl: "获取链接", StageResolve: "填充地址", StageDownload: "下载文件"}
+
+// showEvent 根据进度事件刷新主界面
+func showEvent(e Event, progressBar *widget.ProgressBar, statusLabel, currentFileLabel, speedLabel, statsLabel *widget.Label) {
+	switch e.Type {
+	case EventRunStarted:
+		progressBar.SetValue(0)
+		currentFileLabel.SetText("")
+		speedLabel.SetText("")
+		statsLabel.SetText("")
+	case EventStageStarted:
+		statusLabel.SetText("正在" + stageNames[e.Stage] + "...")
+	case EventVideoDiscovered:
+		currentFileLabel.SetText("新视频: " + e.Title)
+	case EventUrlResolved:
+		currentFileLabel.SetText("获取到下载地址: " + e.Title)
+	case EventError:
+		statsLabel.SetText(fmt.Sprintf("%s失败: %s %s", stageNames[e.Stage], e.Title, e.Error))
+	case EventProgress:
+		snap := e.Progress
+		progressBar.SetValue(snap.Percent)
+		statusLabel.SetText(fmt.Sprintf("正在下载: %d/%d 文件，剩余 %s", snap.Finished(), snap.TotalFiles, formatETA(snap.ETA)))
+		var files []string
+		for _, f := range snap.Files {
+			files = append(files, fmt.Sprintf("[%d] %s %.1f/%.1fMB %.2fMB/s", f.Worker, f.File,
+				float64(f.DownSize)/1024/1024, float64(f.Size)/1024/1024, f.Speed))
+		}
+		currentFileLabel.SetText("当前文件: " + strings.Join(files, "\n"))
+		speedLabel.SetText(fmt.Sprintf("速度: %.2f MB/s", snap.Speed))
+		statsLabel.SetText(fmt.Sprintf("已下载: %d 文件，失败 %d 个，%.1f/%.1fMB", snap.DownloadedFiles, snap.FailedFiles,
+			float64(snap.DownBytes)/1024/1024, float64(snap.TotalBytes)/1024/1024))
+	case EventRunFinished:
+		switch {
+		case e.Error != "":
+			statusLabel.SetText("已结束: " + e.Error)
+		case e.Progress.TotalFiles > 0:
+			statusLabel.SetText(fmt.Sprintf("完成: 下载 %d 个文件，失败 %d 个", e.Progress.DownloadedFiles, e.Progress.FailedFiles))
+		default:
+			statusLabel.SetText("完成")
+		}
+	}
+}
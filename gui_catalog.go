@@ -0,0 +1,118 @@
+//go:build !nogui
+
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"fyne.io/fyne/v2"
+	"fyne.io/fyne/v2/dialog"
+	"fyne.io/fyne/v2/storage"
+	"fyne.io/fyne/v2/widget"
+)
+
+// showExport 选择导出的频道、状态和格式，再选择保存的文件
+func showExport(window fyne.Window, s *Server, conf Conf) {
+	if err := s.openStore(conf); err != nil {
+		dialog.ShowError(err, window)
+		return
+	}
+	channels, err := s.store.ListChannels()
+	if err != nil {
+		dialog.ShowError(err, window)
+		return
+	}
+	options := []string{"全部频道"}
+	for _, c := range channels {
+		options = append(options, c.DisplayName())
+	}
+	channel := widget.NewSelect(options, nil)
+	channel.SetSelectedIndex(0)
+
+	labels := make([]string, 0, len(videoStatuses))
+	for _, st := range videoStatuses {
+		labels = append(labels, st.Label())
+	}
+	statuses := widget.NewCheckGroup(labels, nil)
+	statuses.Horizontal = true
+	format := widget.NewRadioGroup([]string{FormatJSONL, FormatCSV}, nil)
+	format.Horizontal = true
+	format.SetSelected(FormatJSONL)
+
+	dialog.ShowForm("导出视频", "选择文件", "取消", []*widget.FormItem{
+		widget.NewFormItem("频道", channel),
+		widget.NewFormItem("状态", statuses),
+		widget.NewFormItem("格式", format),
+		widget.NewFormItem("", widget.NewLabel("不选择状态时导出所有状态的视频")),
+	}, func(ok bool) {
+		if !ok {
+			return
+		}
+		var filter ExportFilter
+		if i := channel.SelectedIndex(); i > 0 {
+			filter.ChannelID = channels[i-1].ID
+		}
+		for _, st := range videoStatuses {
+			for _, label := range statuses.Selected {
+				if st.Label() == label {
+					filter.Statuses = append(filter.Statuses, st)
+				}
+			}
+		}
+		save := dialog.NewFileSave(func(w fyne.URIWriteCloser, err error) {
+			if err != nil || w == nil {
+				return
+			}
+			n, err := ExportCatalog(context.Background(), s.store, w, format.Selected, filter)
+			if cerr := w.Close(); err == nil {
+				err = cerr
+			}
+			if err != nil {
+				dialog.ShowError(fmt.Errorf("导出失败: %w", err), window)
+				return
+			}
+			dialog.ShowInformation("导出视频", fmt.Sprintf("已导出 %d 个视频到 %s", n, w.URI().Path()), window)
+		}, window)
+		save.SetFileName("视频目录." + format.Selected)
+		save.Show()
+	}, window)
+}
+
+// showImport 选择导出的文件，确认后按播放地址合并到数据库
+func showImport(window fyne.Window, s *Server, conf Conf, done func()) {
+	open := dialog.NewFileOpen(func(r fyne.URIReadCloser, err error) {
+		if err != nil || r == nil {
+			return
+		}
+		records, err := ReadCatalog(r, CatalogFormat(r.URI().Path()))
+		r.Close()
+		if err != nil {
+			dialog.ShowError(fmt.Errorf("读取 %s 失败: %w", r.URI().Name(), err), window)
+			return
+		}
+		overwrite := widget.NewCheck("用导入的保存名称覆盖本地的保存名称", nil)
+		dialog.ShowForm("导入视频", "导入", "取消", []*widget.FormItem{
+			widget.NewFormItem("文件", widget.NewLabel(fmt.Sprintf("%s，共 %d 个视频", r.URI().Name(), len(records)))),
+			widget.NewFormItem("", widget.NewLabel("本地已有的视频保留状态和频道，下载地址使用导入的")),
+			widget.NewFormItem("", overwrite),
+		}, func(ok bool) {
+			if !ok {
+				return
+			}
+			if err := s.openStore(conf); err != nil {
+				dialog.ShowError(err, window)
+				return
+			}
+			result, err := ImportCatalog(context.Background(), s.store, records, ImportOptions{OverwriteNames: overwrite.Checked})
+			if err != nil {
+				dialog.ShowError(fmt.Errorf("导入失败，%s: %w", result, err), window)
+			} else {
+				dialog.ShowInformation("导入视频", result.String(), window)
+			}
+			done()
+		}, window)
+	}, window)
+	open.SetFilter(storage.NewExtensionFileFilter([]string{".jsonl", ".json", ".csv"}))
+	open.Show()
+}
@@ -0,0 +1,161 @@
+//go:build !nogui
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"fyne.io/fyne/v2"
+	"fyne.io/fyne/v2/container"
+	"fyne.io/fyne/v2/dialog"
+	"fyne.io/fyne/v2/widget"
+)
+
+// showChannels 频道管理窗口
+func showChannels(a fyne.App, store Repository) {
+	window := a.NewWindow("频道管理")
+
+	var channels []Channel
+	selected := -1
+	list := widget.NewList(
+		func() int { return len(channels) },
+		func() fyne.CanvasObject { return widget.NewLabel("") },
+		func(id widget.ListItemID, o fyne.CanvasObject) {
+			c := channels[id]
+			text := fmt.Sprintf("%s  %s", c.DisplayName(), c.Url)
+			if !c.Enabled {
+				text += "  [停用]"
+			}
+			o.(*widget.Label).SetText(text)
+		},
+	)
+	list.OnSelected = func(id widget.ListItemID) { selected = id }
+	list.OnUnselected = func(id widget.ListItemID) { selected = -1 }
+
+	reload := func() {
+		var err error
+		if channels, err = store.ListChannels(); err != nil {
+			dialog.ShowError(err, window)
+		}
+		selected = -1
+		list.UnselectAll()
+		list.Refresh()
+	}
+
+	addButton := widget.NewButton("添加", func() {
+		editChannel(window, Channel{Enabled: true}, func(c Channel) error {
+			if err := store.SaveChannel(&c); err != nil {
+				return err
+			}
+			reload()
+			return nil
+		})
+	})
+	editButton := widget.NewButton("修改", func() {
+		if selected < 0 {
+			dialog.ShowInformation("提示", "请先选择频道", window)
+			return
+		}
+		editChannel(window, channels[selected], func(c Channel) error {
+			if err := store.SaveChannel(&c); err != nil {
+				return err
+			}
+			reload()
+			return nil
+		})
+	})
+	removeButton := widget.NewButton("删除", func() {
+		if selected < 0 {
+			dialog.ShowInformation("提示", "请先选择频道", window)
+			return
+		}
+		c := channels[selected]
+		dialog.ShowConfirm("删除频道", "确定删除 "+c.DisplayName()+" 吗？已经获取的视频不会删除。", func(ok bool) {
+			if !ok {
+				return
+			}
+			if err := store.DeleteChannel(c.ID); err != nil {
+				dialog.ShowError(err, window)
+				return
+			}
+			reload()
+		}, window)
+	})
+
+	reload()
+	window.SetContent(container.NewBorder(nil, container.NewHBox(addButton, editButton, removeButton), nil, nil, list))
+	window.Resize(fyne.NewSize(600, 400))
+	window.Show()
+}
+
+// editChannel 添加、修改频道的表单
+func editChannel(parent fyne.Window, c Channel, save func(Channel) error) {
+	urlEntry := widget.NewEntry()
+	urlEntry.SetText(c.Url)
+	urlEntry.SetPlaceHolder("频道主页地址")
+	nameEntry := widget.NewEntry()
+	nameEntry.SetText(c.Name)
+	source := widget.NewSelect(append([]string{"自动"}, SourceNames()...), nil)
+	if c.Source == "" {
+		source.SetSelected("自动")
+	} else {
+		source.SetSelected(c.Source)
+	}
+	folderEntry := widget.NewEntry()
+	folderEntry.SetText(c.Folder)
+	folderEntry.SetPlaceHolder("为空时保存到下载目录")
+	enabled := widget.NewCheck("", nil)
+	enabled.SetChecked(c.Enabled)
+	replaceEntry := widget.NewMultiLineEntry()
+	replaceEntry.SetPlaceHolder("每行一条，格式 关键字=替换")
+	replaceEntry.SetText(formatReplace(c.Replace))
+
+	items := []*widget.FormItem{
+		widget.NewFormItem("地址", urlEntry),
+		widget.NewFormItem("名称", nameEntry),
+		widget.NewFormItem("视频平台", source),
+		widget.NewFormItem("子目录", folderEntry),
+		widget.NewFormItem("启用", enabled),
+		widget.NewFormItem("替换规则", replaceEntry),
+	}
+	d := dialog.NewForm("频道", "保存", "取消", items, func(ok bool) {
+		if !ok {
+			return
+		}
+		c.Url = strings.TrimSpace(urlEntry.Text)
+		c.Name = strings.TrimSpace(nameEntry.Text)
+		c.Source = source.Selected
+		if c.Source == "自动" {
+			c.Source = ""
+		}
+		c.Folder = strings.TrimSpace(folderEntry.Text)
+		c.Enabled = enabled.Checked
+		c.Replace = parseReplace(replaceEntry.Text)
+		err := validateChannel(c)
+		if err == nil {
+			err = save(c)
+		}
+		if err != nil {
+			dialog.ShowError(errors.Join(errors.New("保存频道失败"), err), parent)
+		}
+	}, parent)
+	d.Resize(fyne.NewSize(500, 400))
+	d.Show()
+}
+
+// formatReplace 把替换规则转换成每行一条的文本
+func formatReplace(rules map[string]string) string {
+	keys := make([]string, 0, len(rules))
+	for k := range rules {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var b strings.Builder
+	for _, k := range keys {
+		b.WriteString(k + "=" + rules[k] + "\n")
+	}
+	return b.String()
+}
@@ -0,0 +1,253 @@
+//go:build !nogui
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"fyne.io/fyne/v2"
+	"fyne.io/fyne/v2/container"
+	"fyne.io/fyne/v2/dialog"
+	"fyne.io/fyne/v2/layout"
+	"fyne.io/fyne/v2/storage"
+	"fyne.io/fyne/v2/widget"
+)
+
+// libraryColumns 视频库表格的列，顺序和 SortBy 常量一致
+var libraryColumns = []struct {
+	title string
+	width float32
+}{
+	{"ID", 60},
+	{"保存名称", 220},
+	{"原始名称", 220},
+	{"状态", 100},
+	{"错误", 240},
+	{"本地文件", 70},
+	{"大小", 80},
+	{"剧集", 200},
+}
+
+// showLibrary 视频库窗口，可以搜索、排序，修改单个视频
+func showLibrary(a fyne.App, s *Server, conf Conf) {
+	window := a.NewWindow("视频库")
+
+	var all, items []LibraryItem
+	sortColumn, sortDesc := SortByID, false
+	selected := -1
+
+	search := widget.NewEntry()
+	search.SetPlaceHolder("搜索名称、状态、错误")
+	countLabel := widget.NewLabel("")
+
+	table := widget.NewTableWithHeaders(
+		func() (int, int) { return len(items), len(libraryColumns) },
+		func() fyne.CanvasObject {
+			label := widget.NewLabel("")
+			label.Truncation = fyne.TextTruncateEllipsis
+			return label
+		},
+		func(id widget.TableCellID, o fyne.CanvasObject) {
+			o.(*widget.Label).SetText(libraryCell(items[id.Row], id.Col))
+		},
+	)
+	table.ShowHeaderColumn = false
+	for i, c := range libraryColumns {
+		table.SetColumnWidth(i, c.width)
+	}
+
+	apply := func() {
+		items = filterLibrary(all, search.Text)
+		sortLibrary(items, sortColumn, sortDesc)
+		selected = -1
+		table.UnselectAll()
+		table.Refresh()
+		countLabel.SetText(fmt.Sprintf("共 %d 个视频，显示 %d 个", len(all), len(items)))
+	}
+	reload := func() {
+		var err error
+		if all, err = s.Library(conf); err != nil {
+			dialog.ShowError(err, window)
+		}
+		apply()
+	}
+
+	// 点击表头排序，再次点击切换升序、降序
+	table.CreateHeader = func() fyne.CanvasObject {
+		return widget.NewButton("", nil)
+	}
+	table.UpdateHeader = func(id widget.TableCellID, o fyne.CanvasObject) {
+		b := o.(*widget.Button)
+		if id.Col < 0 {
+			return
+		}
+		text := libraryColumns[id.Col].title
+		if id.Col == sortColumn {
+			if sortDesc {
+				text += " ▼"
+			} else {
+				text += " ▲"
+			}
+		}
+		b.SetText(text)
+		col := id.Col
+		b.OnTapped = func() {
+			if sortColumn == col {
+				sortDesc = !sortDesc
+			} else {
+				sortColumn, sortDesc = col, false
+			}
+			apply()
+		}
+	}
+	table.OnSelected = func(id widget.TableCellID) { selected = id.Row }
+	table.OnUnselected = func(id widget.TableCellID) { selected = -1 }
+	search.OnChanged = func(string) { apply() }
+
+	// current 返回选中的视频，没有选中时提示
+	current := func() (LibraryItem, bool) {
+		if selected < 0 || selected >= len(items) {
+			dialog.ShowInformation("提示", "请先选择视频", window)
+			return LibraryItem{}, false
+		}
+		return items[selected], true
+	}
+	// background 在后台执行耗时的操作，完成后刷新列表
+	background := func(name string, fn func() error) {
+		countLabel.SetText(name + "...")
+		go func() {
+			err := fn()
+			fyne.Do(func() {
+				if err != nil {
+					dialog.ShowError(fmt.Errorf("%s失败: %w", name, err), window)
+				}
+				reload()
+			})
+		}()
+	}
+
+	toggleButton := widget.NewButton("切换是否下载", func() {
+		item, ok := current()
+		if !ok {
+			return
+		}
+		if err := s.SetNeedDownload(conf, item.ID, item.Status == StatusSkipped); err != nil {
+			dialog.ShowError(err, window)
+		}
+		reload()
+	})
+	renameButton := widget.NewButton("修改名称", func() {
+		item, ok := current()
+		if !ok {
+			return
+		}
+		name := widget.NewEntry()
+		name.SetText(item.SaveName)
+		dialog.ShowForm("修改保存名称", "保存", "取消", []*widget.FormItem{
+			widget.NewFormItem("原始名称", widget.NewLabel(item.OriginName)),
+			widget.NewFormItem("保存名称", name),
+		}, func(ok bool) {
+			if !ok {
+				return
+			}
+			if err := s.RenameVideo(conf, item.ID, name.Text); err != nil {
+				dialog.ShowError(err, window)
+			}
+			reload()
+		}, window)
+	})
+	resolveButton := widget.NewButton("重新获取地址", func() {
+		item, ok := current()
+		if !ok {
+			return
+		}
+		background("获取下载地址", func() error {
+			return s.ResolveVideo(context.Background(), conf, item.ID)
+		})
+	})
+	downloadButton := widget.NewButton("重新下载", func() {
+		item, ok := current()
+		if !ok {
+			return
+		}
+		if item.OnDisk {
+			dialog.ShowInformation("提示", "文件已经存在，删除后才能重新下载", window)
+			return
+		}
+		background("下载", func() error {
+			return s.RetryDownload(context.Background(), conf, item.ID)
+		})
+	})
+	openButton := widget.NewButton("打开文件夹", func() {
+		item, ok := current()
+		if !ok {
+			return
+		}
+		if item.Path == "" {
+			dialog.ShowInformation("提示", "请先设置文件保存地址", window)
+			return
+		}
+		dir := filepath.Dir(item.Path)
+		if _, err := os.Stat(dir); err != nil {
+			dialog.ShowError(err, window)
+			return
+		}
+		u, err := url.Parse(storage.NewFileURI(dir).String())
+		if err == nil {
+			err = a.OpenURL(u)
+		}
+		if err != nil {
+			dialog.ShowError(err, window)
+		}
+	})
+	refreshButton := widget.NewButton("刷新", reload)
+	seriesButton := widget.NewButton("剧集...", func() {
+		showSeries(a, s, conf, func(series string) {
+			sortColumn, sortDesc = SortBySeries, false
+			search.SetText(series)
+			window.RequestFocus()
+		})
+	})
+	exportButton := widget.NewButton("导出", func() { showExport(window, s, conf) })
+	importButton := widget.NewButton("导入", func() { showImport(window, s, conf, reload) })
+
+	top := container.NewBorder(nil, nil, nil, refreshButton, search)
+	actions := container.NewHBox(toggleButton, renameButton, resolveButton, downloadButton, openButton,
+		layout.NewSpacer(), seriesButton, exportButton, importButton)
+	bottom := container.NewVBox(actions, countLabel)
+	window.SetContent(container.NewBorder(top, bottom, nil, nil, table))
+	window.Resize(fyne.NewSize(1000, 600))
+	reload()
+	window.Show()
+}
+
+// libraryCell 表格中一个单元格的内容
+func libraryCell(item LibraryItem, col int) string {
+	switch col {
+	case SortByID:
+		return fmt.Sprint(item.ID)
+	case SortBySaveName:
+		return item.SaveName
+	case SortByOriginName:
+		return item.OriginName
+	case SortByStatus:
+		return item.Status.Label()
+	case SortByError:
+		return item.Error()
+	case SortByOnDisk:
+		return yesNo(item.OnDisk)
+	case SortBySize:
+		if !item.OnDisk {
+			return ""
+		}
+		return fmt.Sprintf("%.1fMB", float64(item.DiskSize)/1024/1024)
+	case SortBySeries:
+		return strings.TrimSpace(item.Series + " " + EpisodeLabel(item.Part, item.Episode))
+	}
+	return ""
+}
@@ -0,0 +1,76 @@
+//go:build !nogui
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+
+	"fyne.io/fyne/v2"
+	"fyne.io/fyne/v2/dialog"
+	"fyne.io/fyne/v2/widget"
+)
+
+// showMigrations 显示数据库升级的情况，有没有执行的升级时可以执行
+func showMigrations(window fyne.Window, conf Conf) {
+	m, err := NewMigrator(conf.Store)
+	if err != nil {
+		dialog.ShowError(err, window)
+		return
+	}
+	list, err := m.Status()
+	if err != nil {
+		m.Close()
+		dialog.ShowError(err, window)
+		return
+	}
+	var lines []string
+	var pending int
+	for _, st := range list {
+		at := "未执行"
+		if st.Applied {
+			at = st.AppliedAt.Format("2006-01-02 15:04:05")
+		} else {
+			pending++
+		}
+		lines = append(lines, fmt.Sprintf("%d  %s  %s", st.Version, st.Name, at))
+	}
+	content := widget.NewLabel(strings.Join(lines, "\n"))
+	if pending == 0 {
+		m.Close()
+		dialog.ShowCustom("数据库升级", "关闭", content, window)
+		return
+	}
+	content.SetText(content.Text + "\n\n有 " + fmt.Sprint(pending) + " 个升级没有执行，执行前最好先备份数据库。")
+	dialog.ShowCustomConfirm("数据库升级", "升级", "取消", content, func(ok bool) {
+		defer m.Close()
+		if !ok {
+			return
+		}
+		n, err := m.Apply()
+		log.Println("已执行", n, "个数据库升级")
+		if err != nil {
+			dialog.ShowError(err, window)
+			return
+		}
+		dialog.ShowInformation("数据库升级", fmt.Sprintf("已执行 %d 个升级", n), window)
+	}, window)
+}
+
+// checkPendingMigrations 启动时检查数据库是否需要升级
+func checkPendingMigrations(window fyne.Window, conf Conf) {
+	m, err := NewMigrator(conf.Store)
+	if err != nil {
+		log.Println("连接数据库失败", err)
+		return
+	}
+	defer m.Close()
+	// 新建的数据库在第一次使用时自动创建表
+	if m.fresh() {
+		return
+	}
+	if pending, err := m.Pending(); err == nil && len(pending) > 0 {
+		showMigrations(window, conf)
+	}
+}
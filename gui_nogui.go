@@ -0,0 +1,15 @@
+//go:build nogui
+
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+// runGUI 使用 nogui 编译时没有图形界面，只能使用命令行模式
+func runGUI(confPath string) {
+	fmt.Fprintln(os.Stderr, "当前版本没有图形界面，请使用命令行模式")
+	usage()
+	os.Exit(2)
+}
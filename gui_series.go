@@ -0,0 +1,119 @@
+//go:build !nogui
+
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"fyne.io/fyne/v2"
+	"fyne.io/fyne/v2/container"
+	"fyne.io/fyne/v2/dialog"
+	"fyne.io/fyne/v2/widget"
+)
+
+// seriesColumns 剧集表格的列
+var seriesColumns = []struct {
+	title string
+	width float32
+}{
+	{"剧名", 260},
+	{"视频数", 70},
+	{"已下载", 70},
+	{"缺少的集数", 300},
+}
+
+// showSeries 按剧名分组显示视频库，标出中间缺少的集数，选中一个剧时调用 pick
+func showSeries(a fyne.App, s *Server, conf Conf, pick func(series string)) {
+	window := a.NewWindow("剧集")
+	var groups, shown []SeriesGroup
+
+	gapsOnly := widget.NewCheck("只显示缺少集数的", nil)
+	countLabel := widget.NewLabel("")
+	table := widget.NewTableWithHeaders(
+		func() (int, int) { return len(shown), len(seriesColumns) },
+		func() fyne.CanvasObject {
+			label := widget.NewLabel("")
+			label.Truncation = fyne.TextTruncateEllipsis
+			return label
+		},
+		func(id widget.TableCellID, o fyne.CanvasObject) {
+			g := shown[id.Row]
+			text := ""
+			switch id.Col {
+			case 0:
+				text = g.Series
+			case 1:
+				text = fmt.Sprint(len(g.Items))
+			case 2:
+				text = fmt.Sprint(g.Downloaded)
+			case 3:
+				text = g.MissingText()
+			}
+			o.(*widget.Label).SetText(text)
+		},
+	)
+	table.ShowHeaderColumn = false
+	table.CreateHeader = func() fyne.CanvasObject { return widget.NewLabel("") }
+	table.UpdateHeader = func(id widget.TableCellID, o fyne.CanvasObject) {
+		if id.Col >= 0 {
+			o.(*widget.Label).SetText(seriesColumns[id.Col].title)
+		}
+	}
+	for i, c := range seriesColumns {
+		table.SetColumnWidth(i, c.width)
+	}
+	table.OnSelected = func(id widget.TableCellID) {
+		if id.Row >= 0 && id.Row < len(shown) {
+			pick(shown[id.Row].Series)
+		}
+	}
+
+	filter := func() {
+		shown = shown[:0]
+		var gaps int
+		for _, g := range groups {
+			if len(g.Missing) > 0 {
+				gaps++
+			}
+			if len(g.Missing) > 0 || !gapsOnly.Checked {
+				shown = append(shown, g)
+			}
+		}
+		table.UnselectAll()
+		table.Refresh()
+		countLabel.SetText(fmt.Sprintf("共 %d 个剧，%d 个缺少集数", len(groups), gaps))
+	}
+	gapsOnly.OnChanged = func(bool) { filter() }
+	reload := func() {
+		items, err := s.Library(conf)
+		if err != nil {
+			dialog.ShowError(err, window)
+		}
+		groups = GroupSeries(items)
+		filter()
+	}
+
+	detectButton := widget.NewButton("重新识别", func() {
+		countLabel.SetText("正在识别...")
+		go func() {
+			n, err := s.DetectSeries(context.Background(), conf, true)
+			fyne.Do(func() {
+				if err != nil {
+					dialog.ShowError(err, window)
+				} else {
+					dialog.ShowInformation("剧集", fmt.Sprintf("%d 个视频的剧名或集数有变化", n), window)
+				}
+				reload()
+			})
+		}()
+	})
+	refreshButton := widget.NewButton("刷新", reload)
+
+	top := container.NewHBox(gapsOnly, detectButton, refreshButton)
+	bottom := container.NewVBox(widget.NewLabel("选中一个剧后在视频库中按集数显示"), countLabel)
+	window.SetContent(container.NewBorder(top, bottom, nil, nil, table))
+	window.Resize(fyne.NewSize(760, 500))
+	reload()
+	window.Show()
+}
@@ -0,0 +1,222 @@
+//go:build !nogui
+
+package main
+
+import (
+	"fmt"
+
+	"fyne.io/fyne/v2"
+	"fyne.io/fyne/v2/container"
+	"fyne.io/fyne/v2/dialog"
+	"fyne.io/fyne/v2/layout"
+	"fyne.io/fyne/v2/widget"
+)
+
+// ruleLabels 规则类型在界面中显示的名称
+var ruleLabels = map[string]string{
+	RuleLiteral:       "替换文字",
+	RuleRegex:         "正则替换",
+	RuleStripBrackets: "去掉括号",
+	RuleTrim:          "去掉首尾空白",
+	RuleCollapseSpace: "合并空白",
+	RuleNumerals:      "中文数字转数字",
+}
+
+// titleColumns 预览表格的列
+var titleColumns = []struct {
+	title string
+	width float32
+}{
+	{"ID", 60},
+	{"原始名称", 280},
+	{"现在的名称", 220},
+	{"新名称", 220},
+}
+
+// showTitleRules 编辑整理标题的规则，预览视频库中所有视频的新名称，确认后再保存
+func showTitleRules(a fyne.App, s *Server, conf Conf, save func(rules []TitleRule)) {
+	window := a.NewWindow("名称规则")
+	rules := append([]TitleRule(nil), conf.TitleRules...)
+	var all, shown []TitlePreview
+
+	labels := make([]string, 0, len(ruleTypes))
+	for _, t := range ruleTypes {
+		labels = append(labels, ruleLabels[t])
+	}
+	typeOf := func(label string) string {
+		for t, l := range ruleLabels {
+			if l == label {
+				return t
+			}
+		}
+		return ""
+	}
+
+	status := widget.NewLabel("")
+	changedOnly := widget.NewCheck("只显示有变化的", nil)
+	changedOnly.SetChecked(true)
+	table := widget.NewTableWithHeaders(
+		func() (int, int) { return len(shown), len(titleColumns) },
+		func() fyne.CanvasObject {
+			label := widget.NewLabel("")
+			label.Truncation = fyne.TextTruncateEllipsis
+			return label
+		},
+		func(id widget.TableCellID, o fyne.CanvasObject) {
+			p := shown[id.Row]
+			text := ""
+			switch id.Col {
+			case 0:
+				text = fmt.Sprint(p.ID)
+			case 1:
+				text = p.OriginName
+			case 2:
+				text = p.SaveName
+			case 3:
+				text = p.NewName
+			}
+			o.(*widget.Label).SetText(text)
+		},
+	)
+	table.ShowHeaderColumn = false
+	table.CreateHeader = func() fyne.CanvasObject { return widget.NewLabel("") }
+	table.UpdateHeader = func(id widget.TableCellID, o fyne.CanvasObject) {
+		if id.Col >= 0 {
+			o.(*widget.Label).SetText(titleColumns[id.Col].title)
+		}
+	}
+	for i, c := range titleColumns {
+		table.SetColumnWidth(i, c.width)
+	}
+
+	filter := func() {
+		shown = shown[:0]
+		var changed int
+		for _, p := range all {
+			if p.Changed() {
+				changed++
+			}
+			if p.Changed() || !changedOnly.Checked {
+				shown = append(shown, p)
+			}
+		}
+		table.Refresh()
+		status.SetText(fmt.Sprintf("共 %d 个视频，%d 个名称有变化", len(all), changed))
+	}
+	changedOnly.OnChanged = func(bool) { filter() }
+	preview := func() bool {
+		var err error
+		if all, err = s.PreviewTitles(conf, rules); err != nil {
+			all = nil
+			filter()
+			status.SetText(err.Error())
+			return false
+		}
+		filter()
+		return true
+	}
+
+	// 每条规则一行：类型、查找、替换，可以调整顺序
+	ruleBox := container.NewVBox()
+	var rebuild func()
+	rebuild = func() {
+		ruleBox.RemoveAll()
+		for i := range rules {
+			i := i
+			kind := widget.NewSelect(labels, nil)
+			kind.SetSelected(ruleLabels[rules[i].Type])
+			kind.OnChanged = func(label string) { rules[i].Type = typeOf(label) }
+			find := widget.NewEntry()
+			find.SetPlaceHolder("查找")
+			find.SetText(rules[i].Find)
+			find.OnChanged = func(v string) { rules[i].Find = v }
+			replace := widget.NewEntry()
+			replace.SetPlaceHolder("替换为")
+			replace.SetText(rules[i].Replace)
+			replace.OnChanged = func(v string) { rules[i].Replace = v }
+			up := widget.NewButton("↑", func() {
+				if i > 0 {
+					rules[i-1], rules[i] = rules[i], rules[i-1]
+					rebuild()
+				}
+			})
+			down := widget.NewButton("↓", func() {
+				if i < len(rules)-1 {
+					rules[i+1], rules[i] = rules[i], rules[i+1]
+					rebuild()
+				}
+			})
+			remove := widget.NewButton("删除", func() {
+				rules = append(rules[:i], rules[i+1:]...)
+				rebuild()
+			})
+			buttons := container.NewHBox(up, down, remove)
+			fields := container.NewGridWithColumns(2, find, replace)
+			ruleBox.Add(container.NewBorder(nil, nil, container.NewGridWrap(fyne.NewSize(150, kind.MinSize().Height), kind), buttons, fields))
+		}
+		ruleBox.Refresh()
+	}
+	rebuild()
+
+	addButton := widget.NewButton("添加规则", func() {
+		rules = append(rules, TitleRule{Type: RuleLiteral})
+		rebuild()
+	})
+	defaultButton := widget.NewButton("恢复默认", func() {
+		rules = DefaultTitleRules()
+		rebuild()
+		preview()
+	})
+	previewButton := widget.NewButton("预览", func() { preview() })
+	saveButton := widget.NewButton("保存规则", func() {
+		if !preview() {
+			return
+		}
+		save(append([]TitleRule(nil), rules...))
+		status.SetText(status.Text + "，规则已保存，新获取的视频使用新规则")
+	})
+	applyButton := widget.NewButton("保存并修改视频库", func() {
+		if !preview() {
+			return
+		}
+		var changed int
+		for _, p := range all {
+			if p.Changed() {
+				changed++
+			}
+		}
+		if changed == 0 {
+			dialog.ShowInformation("名称规则", "没有需要修改的名称", window)
+			return
+		}
+		dialog.ShowConfirm("名称规则", fmt.Sprintf("保存规则并修改 %d 个视频的名称，本地已有的文件一起改名？", changed), func(ok bool) {
+			if !ok {
+				return
+			}
+			save(append([]TitleRule(nil), rules...))
+			previews := append([]TitlePreview(nil), all...)
+			status.SetText("正在修改名称...")
+			go func() {
+				n, err := s.ApplyTitles(conf, previews)
+				fyne.Do(func() {
+					if err != nil {
+						dialog.ShowError(fmt.Errorf("已修改 %d 个名称，部分失败: %w", n, err), window)
+					}
+					preview()
+				})
+			}()
+		}, window)
+	})
+
+	ruleScroll := container.NewVScroll(ruleBox)
+	ruleScroll.SetMinSize(fyne.NewSize(0, 220))
+	top := container.NewBorder(nil, container.NewHBox(addButton, defaultButton), nil, nil, ruleScroll)
+	bottom := container.NewVBox(
+		container.NewHBox(changedOnly, layout.NewSpacer(), previewButton, saveButton, applyButton),
+		status,
+	)
+	window.SetContent(container.NewBorder(top, bottom, nil, nil, table))
+	window.Resize(fyne.NewSize(900, 700))
+	preview()
+	window.Show()
+}
@@ -0,0 +1,282 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"sort"
+	"strings"
+)
+
+// LibraryItem 视频库中的一行
+type LibraryItem struct {
+	Video
+	Path     string `json:"path"` // 本地文件路径
+	OnDisk   bool   `json:"onDisk"`
+	DiskSize int64  `json:"diskSize"`
+}
+
+// 视频库可以排序的列
+const (
+	SortByID = iota
+	SortBySaveName
+	SortByOriginName
+	SortByStatus
+	SortByError
+	SortByOnDisk
+	SortBySize
+	SortBySeries
+)
+
+// Library 读取所有视频和本地文件的情况
+func (s *Server) Library(conf Conf) ([]LibraryItem, error) {
+	if err := s.openStore(conf); err != nil {
+		return nil, err
+	}
+	if _, err := s.DetectSeries(context.Background(), conf, false); err != nil {
+		return nil, err
+	}
+	list, err := s.store.List()
+	if err != nil {
+		return nil, err
+	}
+	paths, err := s.videoPaths(conf)
+	if err != nil {
+		return nil, err
+	}
+	if err = s.assignSuffixes(paths, list); err != nil {
+		return nil, err
+	}
+	items := make([]LibraryItem, 0, len(list))
+	for i := range list {
+		items = append(items, newLibraryItem(conf, paths, list[i]))
+	}
+	return items, nil
+}
+
+// newLibraryItem 查看一个视频的本地文件
+func newLibraryItem(conf Conf, paths videoPaths, v Video) LibraryItem {
+	item := LibraryItem{Video: v}
+	if conf.DownloadPath != "" {
+		item.Path = paths.File(v)
+		if info, err := os.Stat(item.Path); err == nil && !info.IsDir() {
+			item.OnDisk = true
+			item.DiskSize = info.Size()
+		}
+	}
+	return item
+}
+
+// Error 最近一次的错误，优先显示下载错误
+func (item LibraryItem) Error() string {
+	return firstNonEmpty(item.DownloadErr, item.ErrorMsg)
+}
+
+// filterLibrary 按关键字过滤，匹配名称、剧名、状态和错误信息，不区分大小写，返回新的切片
+func filterLibrary(items []LibraryItem, query string) []LibraryItem {
+	query = strings.ToLower(strings.TrimSpace(query))
+	if query == "" {
+		return append([]LibraryItem(nil), items...)
+	}
+	var out []LibraryItem
+	for i := range items {
+		if videoMatches(items[i].Video, query) {
+			out = append(out, items[i])
+		}
+	}
+	return out
+}
+
+// videoMatches 名称、剧名、状态或错误信息中是否有关键字，query 需要是小写的
+func videoMatches(v Video, query string) bool {
+	text := strings.ToLower(strings.Join([]string{v.SaveName, v.OriginName, v.Series, v.Status.Label(), string(v.Status), firstNonEmpty(v.DownloadErr, v.ErrorMsg)}, "\n"))
+	return strings.Contains(text, query)
+}
+
+// sortLibrary 按列排序，值相同时按ID排序
+func sortLibrary(items []LibraryItem, column int, desc bool) {
+	less := func(a, b LibraryItem) bool {
+		switch column {
+		case SortBySaveName:
+			return a.SaveName < b.SaveName
+		case SortByOriginName:
+			return a.OriginName < b.OriginName
+		case SortByStatus:
+			return statusOrder(a.Status) < statusOrder(b.Status)
+		case SortByError:
+			return a.Error() < b.Error()
+		case SortByOnDisk:
+			return !a.OnDisk && b.OnDisk
+		case SortBySize:
+			return a.DiskSize < b.DiskSize
+		case SortBySeries:
+			// 同一个剧的视频排在一起，按集数排列
+			if a.Series != b.Series {
+				return a.Series < b.Series
+			}
+			if a.Part != b.Part {
+				return a.Part < b.Part
+			}
+			return a.Episode < b.Episode
+		}
+		return false
+	}
+	sort.SliceStable(items, func(i, j int) bool {
+		a, b := items[i], items[j]
+		if desc {
+			a, b = b, a
+		}
+		if less(a, b) {
+			return true
+		}
+		if less(b, a) {
+			return false
+		}
+		return items[i].ID < items[j].ID
+	})
+}
+
+// statusOrder 状态在流程中的顺序，用来排序
+func statusOrder(st VideoStatus) int {
+	for i := range videoStatuses {
+		if videoStatuses[i] == st {
+			return i
+		}
+	}
+	return len(videoStatuses)
+}
+
+// SetNeedDownload 修改视频是否需要下载，不需要下载时切换到 skipped，恢复时根据下载地址切换到 discovered 或 resolved
+func (s *Server) SetNeedDownload(conf Conf, id uint, need bool) error {
+	if err := s.openStore(conf); err != nil {
+		return err
+	}
+	if !need {
+		return s.store.Transition(id, StatusSkipped, "手动设置为不下载")
+	}
+	v, err := s.store.GetVideo(id)
+	if err != nil || v.Status != StatusSkipped {
+		return err
+	}
+	to := StatusDiscovered
+	if v.WebDownloadUrl != "" || v.MDownloadUrl != "" {
+		to = StatusResolved
+	}
+	return s.store.Transition(id, to, "手动设置为需要下载")
+}
+
+// RenameVideo 修改保存名称，已经下载的文件一起改名
+func (s *Server) RenameVideo(conf Conf, id uint, name string) error {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return errors.New("保存名称不能为空")
+	}
+	if strings.ContainsAny(name, `/\`) {
+		return errors.New("保存名称不能包含目录")
+	}
+	if err := s.openStore(conf); err != nil {
+		return err
+	}
+	v, err := s.store.GetVideo(id)
+	if err != nil {
+		return err
+	}
+	if v.SaveName == name {
+		return nil
+	}
+	if conf.DownloadPath != "" {
+		paths, err := s.videoPaths(conf)
+		if err != nil {
+			return err
+		}
+		oldPath := paths.File(v)
+		v.SaveName = name
+		// 新的路径已经有其他视频的文件时和 assignSuffixes 一样加上序号
+		suffix := v.FileSuffix
+		for n := 2; ; n++ {
+			newPath := paths.File(v)
+			if _, err := os.Stat(newPath); newPath == oldPath || err != nil {
+				break
+			}
+			v.FileSuffix = n
+		}
+		if _, err = moveVideoFile(oldPath, paths.File(v)); err != nil {
+			return err
+		}
+		if v.FileSuffix != suffix {
+			if err = s.store.UpdateFileSuffix(id, v.FileSuffix); err != nil {
+				return err
+			}
+		}
+	}
+	return s.store.UpdateSaveName(id, name)
+}
+
+// ResolveVideo 清空一个视频的下载地址后重新获取
+func (s *Server) ResolveVideo(ctx context.Context, conf Conf, id uint) error {
+	ctx, end, err := s.begin(ctx, conf)
+	if err != nil {
+		return err
+	}
+	defer end()
+	v, err := s.store.GetVideo(id)
+	if err != nil {
+		return err
+	}
+	v.WebDownloadUrl, v.MDownloadUrl = "", ""
+	v.WebResolvedAt, v.MResolvedAt = nil, nil
+	return s.resolveVideo(ctx, conf, v)
+}
+
+// RetryDownload 重新下载一个视频，不管是否需要下载：不下载的视频改为需要下载，
+// 还没有下载地址的先获取地址，已删除的视频不能重新下载
+func (s *Server) RetryDownload(ctx context.Context, conf Conf, id uint) error {
+	if conf.DownloadPath == "" {
+		return errors.New("请填写保存地址")
+	}
+	ctx, end, err := s.begin(ctx, conf)
+	if err != nil {
+		return err
+	}
+	defer end()
+	v, err := s.store.GetVideo(id)
+	if err != nil {
+		return err
+	}
+	paths, err := s.videoPaths(conf)
+	if err != nil {
+		return err
+	}
+	hasUrl := v.WebDownloadUrl != "" || v.MDownloadUrl != ""
+	switch v.Status {
+	case StatusRemoved:
+		return errors.New("视频所属的频道已经删除，不能重新下载")
+	case StatusSkipped:
+		to := StatusResolved
+		if !hasUrl {
+			to = StatusDiscovered
+		}
+		if err = s.store.Transition(id, to, "手动重新下载"); err != nil {
+			return err
+		}
+		v.Status = to
+	}
+	if v.Status == StatusDiscovered {
+		if err = s.resolveVideo(ctx, conf, v); err != nil {
+			return err
+		}
+		if v, err = s.store.GetVideo(id); err != nil {
+			return err
+		}
+	}
+	if err = s.store.Transition(id, StatusQueued, "手动重新下载"); err != nil {
+		return err
+	}
+	s.stats.Reset()
+	s.stats.SetTotal(1)
+	err = s.downloadQueued(ctx, conf, 1, paths.File(v), v)
+	if ctx.Err() == nil {
+		s.stats.FileDone(err == nil)
+	}
+	return err
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"gorm.io/gorm"
+)
+
+func libraryItem(id uint, name string, status VideoStatus) LibraryItem {
+	return LibraryItem{Video: Video{Model: gorm.Model{ID: id}, SaveName: name, Status: status}}
+}
+
+func TestFilterLibrary(t *testing.T) {
+	items := []LibraryItem{
+		libraryItem(1, "牛歌戏1", StatusDownloaded),
+		libraryItem(2, "Opera", StatusFailed),
+		libraryItem(3, "牛歌戏2", StatusResolved),
+	}
+	if got := filterLibrary(items, "牛歌"); len(got) != 2 {
+		t.Errorf("filter 牛歌 = %d items", len(got))
+	}
+	if got := filterLibrary(items, "opera"); len(got) != 1 || got[0].ID != 2 {
+		t.Errorf("filter opera = %v", got)
+	}
+	if got := filterLibrary(items, StatusFailed.Label()); len(got) != 1 {
+		t.Errorf("filter status = %d items", len(got))
+	}
+	got := filterLibrary(items, " ")
+	got[0].ID = 100
+	if items[0].ID != 1 {
+		t.Error("filter should return a new slice")
+	}
+}
+
+func TestSortLibrary(t *testing.T) {
+	items := []LibraryItem{
+		libraryItem(3, "b", ""),
+		libraryItem(1, "b", ""),
+		libraryItem(2, "a", ""),
+	}
+	sortLibrary(items, SortBySaveName, false)
+	if items[0].ID != 2 || items[1].ID != 1 || items[2].ID != 3 {
+		t.Errorf("asc order = %d %d %d", items[0].ID, items[1].ID, items[2].ID)
+	}
+	sortLibrary(items, SortBySaveName, true)
+	if items[0].ID != 1 || items[1].ID != 3 || items[2].ID != 2 {
+		t.Errorf("desc order = %d %d %d", items[0].ID, items[1].ID, items[2].ID)
+	}
+}
+
+func TestSortLibraryByStatus(t *testing.T) {
+	items := []LibraryItem{
+		libraryItem(1, "", StatusDownloaded),
+		libraryItem(2, "", StatusDiscovered),
+		libraryItem(3, "", StatusResolved),
+	}
+	sortLibrary(items, SortByStatus, false)
+	if items[0].ID != 2 || items[1].ID != 3 || items[2].ID != 1 {
+		t.Errorf("status order = %d %d %d", items[0].ID, items[1].ID, items[2].ID)
+	}
+}
+
+// TestRetryDownload 不下载的、还没有下载地址的视频也可以重新下载，已删除的不能
+func TestRetryDownload(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("video " + r.URL.Path))
+	}))
+	defer srv.Close()
+	useSource(t, fakeSource{downloads: map[string]string{"https://fake.test/v/2": srv.URL + "/2.mp4"}})
+
+	store := NewMemoryStore()
+	videos := []Video{
+		{WebUrl: "https://fake.test/v/1", Source: "fake", SaveName: "1", WebDownloadUrl: srv.URL + "/1.mp4", Status: StatusSkipped},
+		{WebUrl: "https://fake.test/v/2", Source: "fake", SaveName: "2", Status: StatusSkipped},
+		{WebUrl: "https://fake.test/v/3", Source: "fake", SaveName: "3", Status: StatusRemoved},
+	}
+	if err := store.Save(videos); err != nil {
+		t.Fatal(err)
+	}
+	conf := DefaultConf()
+	conf.DownloadPath = t.TempDir()
+	conf.Retry = RetryPolicy{MaxAttempts: 1}
+	s := &Server{store: store}
+	for _, v := range videos[:2] {
+		if err := s.RetryDownload(context.Background(), conf, v.ID); err != nil {
+			t.Fatalf("%s: %v", v.SaveName, err)
+		}
+		got, _ := store.GetVideo(v.ID)
+		if got.Status != StatusDownloaded || !got.NeedDownload {
+			t.Errorf("%s: status = %s, needDownload = %v", v.SaveName, got.Status, got.NeedDownload)
+		}
+		data, err := os.ReadFile(filepath.Join(conf.DownloadPath, v.SaveName+".mp4"))
+		if want := "video /" + v.SaveName + ".mp4"; err != nil || string(data) != want {
+			t.Errorf("%s.mp4 = %q, %v", v.SaveName, data, err)
+		}
+	}
+	if err := s.RetryDownload(context.Background(), conf, videos[2].ID); err == nil {
+		t.Error("removed video should not be downloaded")
+	}
+}
@@ -3,390 +3,272 @@ package main
 import (
 	"context"
 	"errors"
+	"flag"
 	"fmt"
-	"io"
 	"log"
-	"math/rand"
-	"net/http"
-	"net/url"
 	"os"
-	"strconv"
-	"strings"
+	"path/filepath"
+	"sync"
 	"sync/atomic"
 	"time"
 
-	"fyne.io/fyne/v2"
-	"fyne.io/fyne/v2/app"
-	"fyne.io/fyne/v2/container"
-	"fyne.io/fyne/v2/dialog"
-	"fyne.io/fyne/v2/widget"
-	"github.com/PuerkitoBio/goquery"
-	"github.com/chromedp/chromedp"
-	"github.com/wujunwei928/parse-video/parser"
+	"gorm.io/gorm"
 )
 
 //go:generate fyne package -os windows -icon xigua.png
 //go:generate upx -9  niugexi.exe
 
-//https://www.ixigua.com/home/104305645109/?source=pgc_author_name&list_entrance=anyVideo
-
-type Download struct {
-	Url   string
-	Path  string
-	Title string
-}
-
 type Server struct {
-	store   *Store
+	store   Repository
 	running atomic.Bool
 	stats   Stats
+	events  EventBus
+	mu      sync.Mutex
 	cancel  context.CancelFunc
 }
 
-type Stats struct {
-	CurFile         string
-	CurFileSize     int64
-	CurFileDownSize int64
-	BytesCopied     int64
-	LastUpdateTime  time.Time
-	LastBytes       int64
-	Speed           float64
-	TotalFiles      int64
-	DownloadedFiles int64
+func main() {
+	confFile := flag.String("conf", "", "配置文件路径，默认读取环境变量 "+confEnv+" 或当前目录的 conf.json")
+	flag.Usage = usage
+	flag.Parse()
+
+	confPath := ConfPath(*confFile)
+	if flag.NArg() > 0 {
+		os.Exit(runCLI(confPath, flag.Args()))
+	}
+	runGUI(confPath)
 }
 
-func main() {
+// errRunning 上一次的任务还没有结束
+var errRunning = errors.New("任务正在运行中")
 
-	conf := Conf{Store: DBConfig{
-		Type: "sqlite", // 如果使用sqlite，则不需要配置dns
-		Dns:  "root:root@tcp(127.0.0.1:3306)/videos?charset=utf8mb4&parseTime=True&loc=Local",
-	},
-		MaxRepeat: 5,
-		Replace: map[string]string{
-			"山歌":   "",
-			"牛歌剧":  "",
-			"广西":   "",
-			"弘扬":   "",
-			"地方":   "",
-			"特色":   "",
-			"平南":   "",
-			"牛歌戏":  "",
-			"非遗":   "",
-			"文化":   "",
-			"非物质":  "",
-			"遗产":   "",
-			"《":    "",
-			"》":    "",
-			"戏曲":   "",
-			"，":    "",
-			" ":    "",
-			"精彩":   "",
-			"传承":   "",
-			"区粹":   "",
-			"戏剧":   "",
-			"现代版":  "",
-			"民间":   "",
-			"现代":   "",
-			"第一":   "第1",
-			"第二":   "第2",
-			"第三":   "第3",
-			"第四":   "第4",
-			"第五":   "第5",
-			"第六":   "第6",
-			"第七":   "第7",
-			"第八":   "第8",
-			"第九":   "第9",
-			"第十一":  "第11",
-			"第十二":  "第12",
-			"第十三":  "第13",
-			"第十四":  "第14",
-			"第十五":  "第15",
-			"第十六":  "第16",
-			"第十七":  "第17",
-			"第十八":  "第18",
-			"第十九":  "第19",
-			"第二十一": "第21",
-			"第二十二": "第22",
-			"第二十三": "第23",
-			"第十集":  "第10集",
-			"第二十集": "第20集",
-			"第十节":  "第10节",
-			"第二十节": "第20节",
-		},
-	}
-
-	myApp := app.NewWithID("xigua-shrimp")
-	window := myApp.NewWindow("西瓜下载工具")
-
-	form := widget.NewForm()
-
-	home := widget.NewEntry()
-	home.SetPlaceHolder("输入视频主页")
-	home.SetText(conf.TargetUrl)
-	form.AppendItem(widget.NewFormItem("视频主页", home))
-
-	showBrowser := widget.NewCheck("", func(b bool) {
-		conf.ShowBrowser = b
-	})
-	showBrowser.SetChecked(conf.ShowBrowser)
-	form.AppendItem(widget.NewFormItem("显示浏览器", showBrowser))
-
-	getUrl := widget.NewCheck("", func(b bool) {
-		conf.GetUrl = b
-	})
-	getUrl.SetChecked(conf.GetUrl)
-	form.AppendItem(widget.NewFormItem("获取链接", getUrl))
-
-	fillUrl := widget.NewCheck("", func(b bool) {
-		conf.FillUrl = b
-	})
-	fillUrl.SetChecked(conf.FillUrl)
-	form.AppendItem(widget.NewFormItem("填充地址", fillUrl))
-
-	download := widget.NewCheck("", func(b bool) {
-		conf.Download = b
-	})
-	download.SetChecked(conf.Download)
-	form.AppendItem(widget.NewFormItem("下载文件", download))
-
-	savePath := widget.NewEntry()
-	savePath.SetPlaceHolder("文件保存地址")
-	savePath.SetText(conf.DownloadPath)
-	savePath.Disable()
-	selectButton := widget.NewButton("浏览...", func() {
-		folderDialog := dialog.NewFolderOpen(func(uri fyne.ListableURI, err error) {
-			if err != nil {
-				dialog.ShowError(err, window)
-				return
-			}
-			if uri == nil {
-				log.Println("用户取消了选择")
-				return
-			}
-			savePath.SetText(uri.Path())
-		}, window)
-		folderDialog.Show()
-	})
-	pathRow := container.NewHSplit(
-		savePath,
-		selectButton,
-	)
-	pathRow.SetOffset(0.8)
-	form.AppendItem(widget.NewFormItem("文件保存地址", pathRow))
-
-	statsLabel := widget.NewLabel("")
-
-	var startButton *widget.Button
-	s := Server{running: atomic.Bool{}}
-
-	progressBar := widget.NewProgressBar()
-	progressBar.Min = 0
-	progressBar.Max = 100
-
-	statusLabel := widget.NewLabel("准备下载...")
-	currentFileLabel := widget.NewLabel("")
-	speedLabel := widget.NewLabel("")
-
-	stopButton := widget.NewButton("停止", func() {
-		if s.running.Load() && s.cancel != nil {
-			s.cancel()
-		}
-	})
+// errResolveFailed 有视频没有获取到下载地址，不影响后面的下载，任务结束时返回
+var errResolveFailed = errors.New("个视频获取下载地址失败")
 
-	startButton = widget.NewButton("开始", func() {
-		startButton.Disable()
+// Run 按配置依次执行 获取链接、填充地址、下载文件，图形界面和命令行共用，进度通过 s.events 发送
+func (s *Server) Run(ctx context.Context, conf Conf) (err error) {
+	ctx, end, err := s.begin(ctx, conf)
+	if err != nil {
+		return err
+	}
+	defer end()
+	s.stats.Reset()
+	s.events.Publish(Event{Type: EventRunStarted})
+	defer func() {
+		snap := s.stats.Snapshot()
+		e := Event{Type: EventRunFinished, Progress: &snap}
+		if err != nil {
+			e.Error = err.Error()
+		}
+		s.events.Publish(e)
+	}()
+	if err = recoverInterrupted(ctx, s.store); err != nil {
+		return err
+	}
+	if n, err := s.DetectSeries(ctx, conf, false); err != nil {
+		return err
+	} else if n > 0 {
+		log.Println("识别剧名和集数", n, "个视频")
+	}
 
-		go func() {
-			defer fyne.Do(func() { startButton.Enable() })
-			if s.running.Load() {
-				return
-			}
-			conf.TargetUrl = home.Text
-			conf.DownloadPath = savePath.Text
-			s.stats = Stats{}
-			s.running.Store(true)
-
-			go func() {
-				for {
-					fyne.Do(func() {
-						if s.stats.TotalFiles > 0 {
-							progress := float64(s.stats.DownloadedFiles/s.stats.TotalFiles) * 100
-							progressBar.SetValue(progress)
-							statusLabel.SetText(fmt.Sprintf("正在下载: %d/%d 文件", s.stats.DownloadedFiles, s.stats.TotalFiles))
-							currentFileLabel.SetText("当前文件: " + s.stats.CurFile)
-							speedLabel.SetText(fmt.Sprintf("速度: %.2f MB/s", s.stats.Speed))
-							statsLabel.SetText(fmt.Sprintf("已下载: %d 文件", s.stats.DownloadedFiles))
-						}
-					})
-					if !s.running.Load() {
-						return
-					}
-					time.Sleep(time.Second)
-				}
-			}()
-
-			defer s.running.Store(false)
-			if s.store == nil {
-				store, err := NewStore(conf.Store)
-				if err != nil {
-					fyne.Do(func() {
-						statsLabel.SetText(err.Error())
-					})
-					return
-				}
-				s.store = store
-			}
+	if conf.GetUrl {
+		log.Println("拉取最新的播放页面保存到数据库")
+		if err = s.runStage(StageCrawl, func() error { return s.GetList(ctx, conf) }); err != nil {
+			return err
+		}
+	}
 
-			var ctx context.Context
-			ctx, s.cancel = context.WithCancel(context.Background())
-			if conf.GetUrl {
-				log.Println("拉取最新的播放页面保存到数据库")
-				err := s.GetList(ctx, conf)
-				if err != nil {
-					fyne.Do(func() {
-						statsLabel.SetText(err.Error())
-					})
-					return
-				}
+	var resolveErr error
+	if conf.FillUrl {
+		log.Println("处理没有获取下载连接的")
+		if err = s.runStage(StageResolve, func() error { return s.FillDownload(ctx, conf) }); err != nil {
+			if !errors.Is(err, errResolveFailed) {
+				return err
 			}
+			resolveErr = err
+		}
+	}
 
-			if conf.FillUrl {
-				log.Println("处理没有获取下载连接的")
-				err := s.FillDownload(ctx, conf)
-				if err != nil {
-					fyne.Do(func() {
-						statsLabel.SetText(err.Error())
-					})
-					return
-				}
-			}
+	if conf.Download {
+		log.Println("本地下载列表和远程比较，补全未下载的文件")
+		if err = s.runStage(StageDownload, func() error { return s.DownloadNotExist(ctx, conf) }); err != nil {
+			return err
+		}
+	}
+	return resolveErr
+}
 
-			if conf.Download {
-				log.Println("本地下载列表和远程比较，补全未下载的文件")
-				err := s.DownloadNotExist(ctx, conf)
-				if err != nil {
-					fyne.Do(func() {
-						statsLabel.SetText(err.Error())
-					})
-					return
-				}
-			}
-		}()
+type runClaimKey struct{}
 
-	})
-
-	box := container.NewVBox(
-		form,
-		startButton,
-		stopButton,
-		progressBar,
-		statusLabel,
-		currentFileLabel,
-		speedLabel,
-		statsLabel,
-	)
-	window.SetContent(box)
-	window.Resize(fyne.NewSize(600, 400))
-	window.ShowAndRun()
+// claimRun 在启动任务的协程之前占用任务，避免两个请求都认为启动成功。
+// 返回的 ctx 传给 Run 时直接使用占用的任务；Run 没有执行到时（例如打开数据库失败）需要调用 release 让出
+func (s *Server) claimRun(ctx context.Context) (context.Context, func(), error) {
+	if !s.running.CompareAndSwap(false, true) {
+		return nil, nil, errRunning
+	}
+	used := new(atomic.Bool)
+	release := func() {
+		if used.CompareAndSwap(false, true) {
+			s.running.Store(false)
+		}
+	}
+	return context.WithValue(ctx, runClaimKey{}, used), release, nil
 }
 
-// GetList 获取所有的下载链接
-func (s *Server) GetList(ctx context.Context, conf Conf) error {
-	if conf.TargetUrl == "" {
-		return errors.New("请输入视频主页")
+// begin 标记任务开始，同一时间只能有一个任务，返回的 ctx 可以通过 Stop 取消，结束时调用 end
+func (s *Server) begin(ctx context.Context, conf Conf) (context.Context, func(), error) {
+	// 通过 claimRun 占用的任务只能使用一次
+	if used, ok := ctx.Value(runClaimKey{}).(*atomic.Bool); !ok || !used.CompareAndSwap(false, true) {
+		if !s.running.CompareAndSwap(false, true) {
+			return nil, nil, errRunning
+		}
 	}
-	options := []chromedp.ExecAllocatorOption{
-		chromedp.Flag("headless", !conf.ShowBrowser), // debug使用
-		chromedp.UserAgent("Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/113.0.0.0 Safari/537.36"),
+	if err := s.openStore(conf); err != nil {
+		s.running.Store(false)
+		return nil, nil, err
 	}
-	//初始化参数，先传一个空的数据
-	options = append(chromedp.DefaultExecAllocatorOptions[:], options...)
+	ctx, cancel := context.WithCancel(ctx)
+	s.mu.Lock()
+	s.cancel = cancel
+	s.mu.Unlock()
+	// 任务中共用一个浏览器，结束或取消时关闭
+	browser := NewBrowserPool(conf)
+	ctx = withBrowser(ctx, browser)
+	done := make(chan struct{})
+	go s.publishProgress(done)
+	return ctx, func() {
+		close(done)
+		cancel()
+		browser.Close()
+		s.running.Store(false)
+	}, nil
+}
 
-	c, c1 := chromedp.NewExecAllocator(ctx, options...)
-	defer c1()
+// Stop 取消正在运行的任务，未下载完的文件保留为 .download
+func (s *Server) Stop() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.running.Load() && s.cancel != nil {
+		s.cancel()
+	}
+}
 
-	// create context
-	chromeCtx, c2 := chromedp.NewContext(c, chromedp.WithLogf(log.Printf))
-	defer c2()
+// openStore 第一次使用时连接数据库
+func (s *Server) openStore(conf Conf) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.store != nil {
+		return nil
+	}
+	store, err := NewStore(conf.Store)
+	if err != nil {
+		return err
+	}
+	if err = seedChannel(store, conf); err != nil {
+		return err
+	}
+	s.store = store
+	return nil
+}
 
-	err := chromedp.Run(chromeCtx, chromedp.Navigate(conf.TargetUrl),
-		chromedp.WaitVisible("div.userDetailV3__main__list"),
-	)
-	defer chromedp.Run(chromeCtx, chromedp.ActionFunc(func(ctx context.Context) error { return chromedp.Cancel(ctx) }))
-	defer chromedp.Run(chromeCtx, chromedp.Stop())
+// seedChannel 旧版只有一个视频主页，第一次使用频道时把它转换成频道，已有的视频都归到这个频道
+func seedChannel(store Repository, conf Conf) error {
+	if conf.TargetUrl == "" {
+		return nil
+	}
+	channels, err := store.ListChannels()
+	if err != nil || len(channels) > 0 {
+		return err
+	}
+	ch := Channel{Url: conf.TargetUrl, Source: conf.Source, Enabled: true}
+	if err = store.SaveChannel(&ch); err != nil {
+		return err
+	}
+	log.Println("视频主页已转换为频道", ch.Url)
+	return store.AssignChannel(ch.ID)
+}
 
+// GetList 获取所有启用的频道的视频，保存到数据库
+func (s *Server) GetList(ctx context.Context, conf Conf) error {
+	channels, err := s.store.ListChannels()
 	if err != nil {
 		return err
 	}
-	var hasMore string
-	for hasMore != "<div class=\"Feed-footer\">已经到底部，没有更多内容了</div>" {
-		err = chromedp.Run(chromeCtx, chromedp.Evaluate(`window.scrollTo(0, document.documentElement.scrollHeight)`, nil),
-			chromedp.Sleep(time.Duration(rand.Intn(2)+2)*time.Second),
-			chromedp.OuterHTML(".Feed-footer", &hasMore, chromedp.ByQuery),
-		)
-		if err != nil {
-			return err
+	var enabled int
+	var errs error
+	for i := range channels {
+		if !channels[i].Enabled {
+			continue
+		}
+		enabled++
+		log.Println("获取频道", channels[i].DisplayName())
+		if err = s.getChannelList(ctx, conf, channels[i]); err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			log.Println("获取频道错误", channels[i].DisplayName(), err)
+			s.events.Publish(Event{Type: EventError, Stage: StageCrawl, Title: channels[i].DisplayName(), Error: err.Error()})
+			errs = errors.Join(errs, fmt.Errorf("%s: %w", channels[i].DisplayName(), err))
 		}
 	}
+	if enabled == 0 {
+		return errors.New("请先添加频道")
+	}
+	return errs
+}
 
-	var as string
-	err = chromedp.Run(chromeCtx, chromedp.OuterHTML(".userDetailV3__main__list", &as, chromedp.ByQueryAll))
+// getChannelList 获取一个频道的所有视频，新的视频保存到数据库
+func (s *Server) getChannelList(ctx context.Context, conf Conf, ch Channel) error {
+	src, err := resolveSource(ch.Source, ch.Url)
 	if err != nil {
 		return err
 	}
-
-	dom, err := goquery.NewDocumentFromReader(strings.NewReader(as))
+	found, err := src.ListVideos(ctx, conf, ch.Url)
 	if err != nil {
 		return err
 	}
-	nodes := dom.Find("div.HorizontalFeedCard__contentWrapper > div > a").Nodes
-	log.Println("获取到", len(nodes), "个视频")
-	//因为名字会有重复，所以需要额外计算 集数
+	log.Println("获取到", len(found), "个视频")
+	// 同名的视频不改名字，按识别的剧名、集数区分，保存路径相同时由 assignSuffixes 加上序号
 	list, err := s.store.List()
 	if err != nil {
 		return err
 	}
 	log.Println("数据库中已经存在", len(list), "个视频")
-	repeat := make(map[string]int, len(list))
 	repeatWebUrl := make(map[string]int, len(list))
+	// 删除频道时标记为已删除的视频，重新出现在启用的频道中时恢复
+	removed := make(map[string]uint)
 	for i := range list {
 		repeatWebUrl[list[i].WebUrl] = 0
-		originName := list[i].OriginName
-		if value, ok := repeat[originName]; ok {
-			ii := value + 1
-			repeat[originName] = ii
-		} else {
-			repeat[originName] = 1
+		if list[i].Status == StatusRemoved {
+			removed[list[i].WebUrl] = list[i].ID
 		}
 	}
 
+	titles, err := titlePipeline(conf.TitleRules, ch)
+	if err != nil {
+		return err
+	}
+
 	//	repeatCount := 0
 	var newInsert int
 	defer func() {
 		log.Println("新插入", newInsert)
 	}()
-	for i := range nodes {
-		var originName string
-		var saveName string
-		var webUrl string
-		node := nodes[i]
-		for index := range node.Attr {
-
-			attribute := node.Attr[index]
-			if attribute.Key == "href" {
-				webUrl = "https://www.ixigua.com" + attribute.Val
-			}
-			if attribute.Key == "title" {
-				originName = attribute.Val
-				saveName = originName
-			}
-		}
+	for i := range found {
+		originName := found[i].Title
+		webUrl := found[i].PageUrl
 
 		var ok bool
 		_, ok = repeatWebUrl[webUrl]
 
 		// 数据已经存在，并且重复数据已经大于
 		if ok {
+			if id, ok := removed[webUrl]; ok {
+				delete(removed, webUrl)
+				if err = s.restoreVideo(id, ch.ID); err != nil {
+					log.Println("恢复视频错误", originName, err)
+				}
+			}
 			//if repeatCount > conf.MaxRepeat {
 			//	return nil
 			//}
@@ -395,281 +277,387 @@ func (s *Server) GetList(ctx context.Context, conf Conf) error {
 		}
 
 		//	repeatCount = 0
-		for key, value := range conf.Replace {
-			saveName = strings.ReplaceAll(saveName, key, value)
-		}
-
-		if value, ok := repeat[originName]; ok {
-			ii := value + 1
-			saveName = saveName + strconv.Itoa(ii)
-			repeat[originName] = ii
-		} else {
-			repeat[originName] = 1
-		}
+		saveName := firstNonEmpty(titles.Apply(originName), originName)
+		episode := ParseEpisode(saveName)
 
 		log.Println("新增数据【", originName, "】的链接：", webUrl)
+		now := time.Now()
 		video := Video{
+			ChannelID:      ch.ID,
 			WebUrl:         webUrl,
-			MUrl:           strings.ReplaceAll(webUrl, "https://www.ixigua.com/", "https://m.ixigua.com/video/"),
+			MUrl:           found[i].MUrl,
+			Source:         src.Name(),
 			OriginName:     originName,
 			SaveName:       saveName,
 			WebDownloadUrl: "",
 			MDownloadUrl:   "",
 			NeedDownload:   true,
 			ErrorMsg:       "",
+			Status:         StatusDiscovered,
+			StatusAt:       &now,
 		}
-		if err = s.store.Save([]Video{video}); err != nil {
+		episode.applyTo(&video)
+		saved := []Video{video}
+		if err = s.store.Save(saved); err != nil {
 			log.Println("新增数据错误", err)
 			continue
 		}
 		newInsert++
+		s.events.Publish(Event{Type: EventVideoDiscovered, Stage: StageCrawl, VideoID: saved[0].ID, Title: saveName})
 
 		repeatWebUrl[webUrl] = 0
 	}
 	return nil
 }
 
-// FillDownload 填充下载地址
+// restoreVideo 已删除的视频归到新的频道，重新获取下载地址
+func (s *Server) restoreVideo(id, channelID uint) error {
+	if err := s.store.Update(Video{Model: gorm.Model{ID: id}, ChannelID: channelID}); err != nil {
+		return err
+	}
+	return s.store.Transition(id, StatusDiscovered, "频道重新获取到")
+}
+
+// FillDownload 填充下载地址，处理刚获取到的视频和获取地址失败的视频，
+// 同时处理 conf.BrowserTabs 个视频，和浏览器同时打开的页面数一致。
+// 有视频没有获取到地址时返回 errResolveFailed，带上失败的个数
 func (s *Server) FillDownload(ctx context.Context, conf Conf) error {
-	videos, err := s.store.GetEmptyDownload(ctx)
+	videos, err := s.store.ListByStatus(ctx, StatusDiscovered, StatusFailed)
 	if err != nil {
 		return err
 	}
 
+	workers := conf.BrowserTabs
+	if workers <= 0 {
+		workers = 1
+	}
+	jobs := make(chan Video)
+	var wg sync.WaitGroup
+	var failed atomic.Int64
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for item := range jobs {
+				if err := s.resolveVideo(ctx, conf, item); err != nil {
+					log.Println("获取下载链接错误", item.SaveName, err)
+					failed.Add(1)
+				}
+			}
+		}()
+	}
+
+feed:
 	for _, item := range videos {
+		// 下载失败的视频已经有地址，由 DownloadNotExist 重新下载
+		if item.Status == StatusFailed && (item.WebDownloadUrl != "" || item.MDownloadUrl != "") {
+			continue
+		}
 		select {
 		case <-ctx.Done():
-			return ctx.Err()
-		default:
-		}
-
-		log.Println("获取下载链接", item.SaveName)
-		var errs error
-		if item.WebDownloadUrl == "" {
-			item.WebDownloadUrl, err = s.GetDownloadUrlParse(ctx, item.WebUrl)
-			errs = errors.Join(errs, err)
-		}
-		if item.MUrl == "" || item.MDownloadUrl == "" {
-			item.MDownloadUrl, err = s.GetDownloadUrlChrome(ctx, conf, item.MDownloadUrl)
-			errs = errors.Join(errs, err)
-		}
-		if errs != nil {
-			item.ErrorMsg = err.Error()
-		}
-		if err = s.store.Update(item); err != nil {
-			log.Println("更新数据错误", err)
-			continue
+			break feed
+		case jobs <- item:
 		}
 	}
+	close(jobs)
+	wg.Wait()
+	if err = ctx.Err(); err != nil {
+		return err
+	}
+	if n := failed.Load(); n > 0 {
+		return fmt.Errorf("%d %w", n, errResolveFailed)
+	}
 	return nil
 }
 
-func (s *Server) GetDownloadUrlChrome(ctx context.Context, conf Conf, webUrl string) (string, error) {
-	options := []chromedp.ExecAllocatorOption{
-		chromedp.Flag("headless", !conf.ShowBrowser), // debug使用
-		chromedp.UserAgent(`Mozilla/5.0 (Linux; Android 6.0; Nexus 5 Build/MRA58N) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/113.0.0.0 Mobile Safari/537.36`),
-	}
-	//初始化参数，先传一个空的数据
-	options = append(chromedp.DefaultExecAllocatorOptions[:], options...)
-
-	c, c1 := chromedp.NewExecAllocator(ctx, options...)
-	defer c1()
-	chromeCtx, c2 := chromedp.NewContext(c, chromedp.WithLogf(log.Printf))
-	defer c2()
-
-	var downloadUrl string
-	timeout, _ := context.WithTimeout(chromeCtx, time.Second*20)
-	err := chromedp.Run(timeout, chromedp.Navigate(webUrl),
-		chromedp.Sleep(time.Second*time.Duration(rand.Intn(5)+2)),
-		//chromedp.WaitVisible("video", chromedp.ByQueryAll),
-		chromedp.OuterHTML("video", &downloadUrl, chromedp.ByQuery))
-	if err != nil {
-		return downloadUrl, err
+// resolveVideo 获取一个视频还没有的下载地址并保存结果，获取到任意一个地址时切换到 resolved，否则切换到 failed
+func (s *Server) resolveVideo(ctx context.Context, conf Conf, item Video) error {
+	if err := s.store.Transition(item.ID, StatusResolving, ""); err != nil {
+		return err
 	}
-	if downloadUrl != "" {
-		dom, err := goquery.NewDocumentFromReader(strings.NewReader(downloadUrl))
-		if err != nil {
-			return downloadUrl, err
-		}
-		dom.Find("video[mediatype]").Each(func(i int, selection *goquery.Selection) {
-			for i2 := range selection.Nodes[0].Attr {
-				if selection.Nodes[0].Attr[i2].Key == "src" {
-					downloadUrl = "https:" + selection.Nodes[0].Attr[i2].Val
-					break
-				}
-			}
-		})
-	} else {
-		return "", errors.New("downloadUrl not found")
+	log.Println("获取下载链接", item.SaveName)
+	var errs error
+	var attempts int
+	if item.WebDownloadUrl == "" {
+		n, err := s.refreshDownloadUrl(ctx, conf, &item, false)
+		attempts += n
+		errs = errors.Join(errs, err)
+	}
+	if item.MUrl != "" && item.MDownloadUrl == "" {
+		n, err := s.refreshDownloadUrl(ctx, conf, &item, true)
+		attempts += n
+		errs = errors.Join(errs, err)
 	}
-	return downloadUrl, nil
+	now := time.Now()
+	item.ResolveAttempts = attempts
+	item.LastResolveAt = &now
+	item.ErrorMsg = ""
+	if errs != nil {
+		item.ErrorMsg = errs.Error()
+	}
+	if err := s.store.UpdateResolve(item); err != nil {
+		return err
+	}
+
+	to, reason := StatusResolved, ""
+	switch {
+	case ctx.Err() != nil:
+		to, reason = StatusDiscovered, "已取消"
+	case item.WebDownloadUrl == "" && item.MDownloadUrl == "":
+		to, reason = StatusFailed, item.ErrorMsg
+	}
+	if err := s.store.Transition(item.ID, to, reason); err != nil {
+		return err
+	}
+	switch to {
+	case StatusResolved:
+		s.events.Publish(Event{Type: EventUrlResolved, Stage: StageResolve, VideoID: item.ID, Title: item.SaveName})
+		return nil
+	case StatusFailed:
+		s.publishError(StageResolve, item, firstNonEmpty(reason, "没有获取到下载地址"))
+	}
+	return errs
 }
 
-func (s *Server) GetDownloadUrlParse(ctx context.Context, webUrl string) (string, error) {
+// GetDownloadUrlChrome 用浏览器打开手机端的播放页面获取下载地址，只有支持手机端页面的平台可以使用
+func (s *Server) GetDownloadUrlChrome(ctx context.Context, conf Conf, v Video) (string, error) {
+	src, err := resolveSource(v.Source, v.MUrl)
+	if err != nil {
+		return "", err
+	}
+	mr, ok := src.(MobileResolver)
+	if !ok {
+		return "", fmt.Errorf("%s 不支持手机端页面", src.Name())
+	}
+	return mr.ResolveMobileUrl(ctx, conf, v.MUrl)
+}
 
-	u, err := url.Parse(webUrl)
-	videoId := strings.Split(u.Path, "/")[1]
-	id, err := parser.ParseVideoId(parser.SourceXiGua, videoId)
+// GetDownloadUrlParse 通过平台的解析接口获取下载地址
+func (s *Server) GetDownloadUrlParse(ctx context.Context, v Video) (string, error) {
+	src, err := resolveSource(v.Source, v.WebUrl)
 	if err != nil {
 		return "", err
 	}
-	return id.VideoUrl, nil
+	return src.ResolveDownloadUrl(ctx, v.WebUrl)
 }
 
+// DownloadNotExist 下载有地址还没有下载的视频，本地已经有文件的直接标记为已下载，
+// 已下载的视频本地文件被删除或者移走时重新下载
 func (s *Server) DownloadNotExist(ctx context.Context, conf Conf) error {
 	if conf.DownloadPath == "" {
 		return errors.New("请填写保存地址")
 	}
-	// 获取数据库所有数据
-	allMedias := make(map[string]Video)
-	list, err := s.store.List()
+	paths, err := s.videoPaths(conf)
 	if err != nil {
 		return err
 	}
-	for i := range list {
-		allMedias[list[i].SaveName] = list[i]
+	// 保存路径相同的视频先加上序号，避免互相覆盖
+	all, err := s.store.List()
+	if err != nil {
+		return err
 	}
-
-	dir, err := os.ReadDir(conf.DownloadPath)
+	if err = s.assignSuffixes(paths, all); err != nil {
+		return err
+	}
+	list, err := s.store.ListByStatus(ctx, StatusResolved, StatusQueued, StatusFailed, StatusDownloaded)
 	if err != nil {
 		return err
 	}
-	for i := range dir {
-		name := dir[i].Name()
-		if strings.HasSuffix(name, ".mp4") {
-			s2 := strings.ReplaceAll(name, ".mp4", "")
-			delete(allMedias, s2)
-		}
+	downloaded, err := paths.Downloaded()
+	if err != nil {
+		return err
 	}
-
-	s.stats.TotalFiles = int64(len(allMedias))
-	for s2 := range allMedias {
-
-		select {
-		case <-ctx.Done():
-			return ctx.Err()
-		default:
-		}
-
-		s.stats.DownloadedFiles++
-		niugexi := allMedias[s2]
-		if !niugexi.NeedDownload {
+	var todo []Video
+	for i := range list {
+		v := list[i]
+		if v.Status == StatusFailed && v.WebDownloadUrl == "" && v.MDownloadUrl == "" {
 			continue
 		}
-		var errs error
-
-		niugexi.WebDownloadUrl, _ = s.GetDownloadUrlParse(ctx, niugexi.WebUrl)
-		if niugexi.WebDownloadUrl != "" {
-			log.Println("下载", niugexi.SaveName)
-			err = s.DownloadFile(Download{
-				Url:   niugexi.WebDownloadUrl,
-				Path:  conf.DownloadPath + niugexi.SaveName + ".mp4",
-				Title: niugexi.SaveName + ".mp4",
-			})
-			errs = errors.Join(errs, err)
+		path := paths.File(v)
+		if downloaded[path] {
+			if v.Status == StatusDownloaded {
+				continue
+			}
+			if err = s.store.Transition(v.ID, StatusDownloaded, "本地已有文件"); err != nil {
+				log.Println("更新状态错误", v.SaveName, err)
+			}
+			continue
 		}
-
-		if niugexi.MDownloadUrl != "" && errs != nil {
-			log.Println("下载", niugexi.SaveName)
-			err = s.DownloadFile(Download{
-				Url:   niugexi.MDownloadUrl,
-				Path:  conf.DownloadPath + niugexi.SaveName + ".mp4",
-				Title: niugexi.SaveName + ".mp4",
-			})
-			errs = errors.Join(errs, err)
+		reason := ""
+		if v.Status == StatusDownloaded {
+			reason = "本地文件不存在，重新下载"
+			log.Println(reason, path)
 		}
-		if errs != nil {
-			niugexi.DownloadErr = errs.Error()
+		if err = s.store.Transition(v.ID, StatusQueued, reason); err != nil {
+			log.Println("更新状态错误", v.SaveName, err)
+			continue
 		}
-		_ = s.store.Update(niugexi)
+		todo = append(todo, v)
 	}
-	return nil
+	s.stats.SetTotal(int64(len(todo)))
 
-}
-
-// DownloadFile will download a url to a local file. It's efficient because it will
-// write as it downloads and not load the whole file into memory.
-func (s *Server) DownloadFile(d Download) error {
-	s.stats.CurFile = d.Title
-	s.stats.CurFileSize = 0
-	s.stats.CurFileDownSize = 0
-	s.stats.BytesCopied = 0
-	s.stats.LastUpdateTime = time.Time{}
-	s.stats.LastBytes = 0
-	s.stats.Speed = 0
-
-	client := &http.Client{}
-
-	// 创建一个 GET 请求
-	req, err := http.NewRequest("GET", d.Url, nil)
-	if err != nil {
-		return err
+	workers := conf.Concurrency
+	if workers <= 0 {
+		workers = 1
+	}
+	jobs := make(chan Video)
+	var wg sync.WaitGroup
+	for w := 1; w <= workers; w++ {
+		wg.Add(1)
+		go func(worker int) {
+			defer wg.Done()
+			for niugexi := range jobs {
+				err := s.downloadQueued(ctx, conf, worker, paths.File(niugexi), niugexi)
+				// 取消的视频还会再下载，不算失败
+				if ctx.Err() == nil {
+					s.stats.FileDone(err == nil)
+				}
+			}
+		}(w)
 	}
 
-	//// 设置请求头
-	req.Header.Set("accept", "text/html,application/xhtml+xml,application/xml;q=0.9,image/avif,image/webp,image/apng,*/*;q=0.8,application/signed-exchange;v=b3;q=0.7")
-	req.Header.Set("accept-language", "zh-CN,zh;q=0.9")
-	req.Header.Set("cache-control", "max-age=0")
-	req.Header.Set("if-range", "d897f936db2114cf331695bf62c1f79c")
-	req.Header.Set("sec-ch-ua", "Chromium;v=\"122\", \"Not(A:Brand\";v=\"24\", \"Google Chrome\";v=\"122\"")
-	req.Header.Set("sec-ch-ua-platform", "Android")
-	req.Header.Set("sec-fetch-dest", "document")
-	req.Header.Set("sec-fetch-mode", "navigate")
-	req.Header.Set("sec-fetch-site", "none")
-	req.Header.Set("sec-fetch-user", "?1")
-	req.Header.Set("upgrade-insecure-requests", "1")
-
-	// 发送请求并获取响应
-	resp, err := client.Do(req)
+feed:
+	for i := range todo {
+		select {
+		case <-ctx.Done():
+			break feed
+		case jobs <- todo[i]:
+		}
+	}
+	close(jobs)
+	wg.Wait()
+	return ctx.Err()
+}
 
-	// Get the data
+// channelFolders 返回频道ID对应的下载子目录
+func (s *Server) channelFolders() (map[uint]string, error) {
+	channels, err := s.store.ListChannels()
 	if err != nil {
-		return err
+		return nil, err
 	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode > 300 {
-		return fmt.Errorf("httpcode: %d, status: %s", resp.StatusCode, resp.Status)
+	folders := make(map[uint]string, len(channels))
+	for i := range channels {
+		folders[channels[i].ID] = channels[i].Folder
 	}
+	return folders, nil
+}
 
-	length := resp.Header.Get("Content-Length")
-	size, _ := strconv.ParseInt(length, 10, 64)
-	s.stats.CurFileSize = size
-	s2 := d.Path + ".download"
-	out, err := os.Create(s2)
-	if err != nil {
+// downloadQueued 下载一个排队中的视频，并根据结果切换状态，取消时回到排队中
+func (s *Server) downloadQueued(ctx context.Context, conf Conf, worker int, path string, v Video) error {
+	if err := s.store.Transition(v.ID, StatusDownloading, ""); err != nil {
 		return err
 	}
-	defer os.Rename(s2, d.Path)
-	defer out.Close()
-	copier := &statsWriter{
-		writer: out,
-		stats:  &s.stats,
+	err := s.downloadVideo(ctx, conf, worker, path, v)
+	to, reason := StatusDownloaded, ""
+	switch {
+	case ctx.Err() != nil:
+		to, reason = StatusQueued, "已取消"
+	case err != nil:
+		to, reason = StatusFailed, err.Error()
+	}
+	if terr := s.store.Transition(v.ID, to, reason); terr != nil {
+		log.Println("更新状态错误", v.SaveName, terr)
+	}
+	switch to {
+	case StatusDownloaded:
+		s.events.Publish(Event{Type: EventDownloaded, Stage: StageDownload, VideoID: v.ID, Title: v.SaveName})
+	case StatusFailed:
+		s.publishError(StageDownload, v, reason)
 	}
-	_, err = io.Copy(copier, resp.Body)
 	return err
 }
 
-type statsWriter struct {
-	writer io.Writer
-	stats  *Stats
-}
-
-func (sw *statsWriter) Write(p []byte) (int, error) {
-	n, err := sw.writer.Write(p)
-	if n > 0 {
-		sw.stats.BytesCopied += int64(n)
+// downloadVideo 下载一个视频并保存下载结果，优先使用网页端的地址，失败后再尝试手机端的地址。
+// 地址还没有过期时直接使用，过期了或者服务器返回 403 时重新获取
+func (s *Server) downloadVideo(ctx context.Context, conf Conf, worker int, path string, niugexi Video) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	d := Download{
+		Path:         path,
+		Title:        niugexi.SaveName + ".mp4",
+		ETag:         niugexi.ETag,
+		LastModified: niugexi.LastModified,
+		CheckMp4:     conf.CheckMp4,
+		Worker:       worker,
+	}
 
-		now := time.Now()
-		if !sw.stats.LastUpdateTime.IsZero() {
-			elapsed := now.Sub(sw.stats.LastUpdateTime).Seconds()
-			if elapsed > 0 {
-				bytesDiff := sw.stats.BytesCopied - sw.stats.LastBytes
-				sw.stats.Speed = (float64(bytesDiff) / 1024 / 1024) / elapsed
+	var attempts int
+	download := func(u string) error {
+		log.Println("下载", niugexi.SaveName)
+		d.Url = u
+		n, err := conf.Retry.Do(ctx, "下载 "+niugexi.SaveName, func() error {
+			return s.DownloadFile(ctx, &d)
+		})
+		attempts += n
+		return err
+	}
+	current := func(mobile bool) (string, *time.Time) {
+		if mobile {
+			return niugexi.MDownloadUrl, niugexi.MResolvedAt
+		}
+		return niugexi.WebDownloadUrl, niugexi.WebResolvedAt
+	}
+	// 重新获取过下载地址时保存新的地址和获取时间
+	var resolved bool
+	downloadFresh := func(mobile bool) error {
+		u, resolvedAt := current(mobile)
+		var refreshed bool
+		if !urlValid(u, resolvedAt, time.Now()) {
+			if _, err := s.refreshDownloadUrl(ctx, conf, &niugexi, mobile); err != nil {
+				log.Println("获取下载地址失败", niugexi.SaveName, err)
+				// 获取失败时还是试一下原来的地址
+				if u == "" {
+					return err
+				}
+			} else {
+				refreshed, resolved = true, true
+				u, _ = current(mobile)
 			}
 		}
-		sw.stats.LastUpdateTime = now
-		sw.stats.LastBytes = sw.stats.BytesCopied
+		err := download(u)
+		// 签名过期或者失效，重新获取一次地址
+		if urlForbidden(err) && !refreshed && ctx.Err() == nil {
+			log.Println("下载地址已失效，重新获取", niugexi.SaveName)
+			if _, rerr := s.refreshDownloadUrl(ctx, conf, &niugexi, mobile); rerr != nil {
+				return errors.Join(err, rerr)
+			}
+			resolved = true
+			u, _ = current(mobile)
+			err = download(u)
+		}
+		return err
+	}
+	errs := downloadFresh(false)
+	// 网页端的地址获取失败或者下载失败，再用手机端的地址下载
+	if errs != nil && niugexi.MDownloadUrl != "" && ctx.Err() == nil {
+		if err := downloadFresh(true); err != nil {
+			errs = errors.Join(errs, err)
+		} else {
+			errs = nil
+		}
+	}
+	if attempts == 0 {
+		errs = errors.Join(errors.New("没有可用的下载地址"), errs)
+	}
+	now := time.Now()
+	niugexi.DownloadAttempts = attempts
+	niugexi.LastDownloadAt = &now
+	niugexi.DownloadErr = ""
+	if errs != nil {
+		niugexi.DownloadErr = errs.Error()
+	}
+	niugexi.ETag = d.ETag
+	niugexi.LastModified = d.LastModified
+	niugexi.FileSize = d.Size
+	niugexi.PartialSize = PartialSize(d.Path)
+	if resolved {
+		if err := s.store.UpdateResolve(niugexi); err != nil {
+			log.Println("保存下载地址错误", err)
+		}
+	}
+	if err := s.store.UpdateDownload(niugexi); err != nil {
+		log.Println("保存下载状态错误", err)
 	}
-	return n, err
+	return errs
 }
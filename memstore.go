@@ -0,0 +1,339 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sort"
+	"sync"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// MemoryStore 保存在内存中的 Repository，行为和 Store 一致，用于测试和试运行
+type MemoryStore struct {
+	mu       sync.Mutex
+	videos   map[uint]*Video
+	channels map[uint]*Channel
+	events   []VideoEvent
+	runs     []RunHistory
+	nextID   uint
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{videos: make(map[uint]*Video), channels: make(map[uint]*Channel)}
+}
+
+func (m *MemoryStore) newID() uint {
+	m.nextID++
+	return m.nextID
+}
+
+// sortedVideos 按ID排列的视频副本，调用时需要持有锁
+func (m *MemoryStore) sortedVideos(keep func(v *Video) bool) []Video {
+	list := make([]Video, 0, len(m.videos))
+	for _, v := range m.videos {
+		if keep == nil || keep(v) {
+			list = append(list, *v)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	return list
+}
+
+func (m *MemoryStore) Save(media []Video) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	// 和数据库的唯一索引一样，播放地址不能重复
+	seen := make(map[string]bool, len(m.videos)+len(media))
+	for _, v := range m.videos {
+		seen[v.WebUrl] = true
+	}
+	for i := range media {
+		if seen[media[i].WebUrl] {
+			return fmt.Errorf("UNIQUE constraint failed: biz_videos.web_url %q", media[i].WebUrl)
+		}
+		seen[media[i].WebUrl] = true
+	}
+	now := time.Now()
+	for i := range media {
+		media[i].ID = m.newID()
+		media[i].CreatedAt, media[i].UpdatedAt = now, now
+		v := media[i]
+		m.videos[v.ID] = &v
+	}
+	return nil
+}
+
+func (m *MemoryStore) List() ([]Video, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.sortedVideos(nil), nil
+}
+
+func (m *MemoryStore) ListPage(ctx context.Context, offset, limit int) ([]Video, int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	list := m.sortedVideos(nil)
+	total := int64(len(list))
+	if offset > len(list) {
+		offset = len(list)
+	}
+	list = list[offset:]
+	if limit >= 0 && limit < len(list) {
+		list = list[:limit]
+	}
+	return list, total, nil
+}
+
+func (m *MemoryStore) GetVideo(id uint) (Video, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if v, ok := m.videos[id]; ok {
+		return *v, nil
+	}
+	return Video{}, gorm.ErrRecordNotFound
+}
+
+// Update 和 gorm 的 Updates 一样只保存非零值的字段
+func (m *MemoryStore) Update(v Video) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	old, ok := m.videos[v.ID]
+	if !ok {
+		return nil
+	}
+	src := reflect.ValueOf(v)
+	dst := reflect.ValueOf(old).Elem()
+	for i := 0; i < src.NumField(); i++ {
+		switch src.Type().Field(i).Name {
+		case "Model", "Status", "StatusAt":
+			continue
+		}
+		if f := src.Field(i); !f.IsZero() {
+			dst.Field(i).Set(f)
+		}
+	}
+	old.UpdatedAt = time.Now()
+	return nil
+}
+
+func (m *MemoryStore) UpdateDownload(v Video) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if old, ok := m.videos[v.ID]; ok {
+		old.DownloadErr, old.ETag, old.LastModified = v.DownloadErr, v.ETag, v.LastModified
+		old.FileSize, old.PartialSize = v.FileSize, v.PartialSize
+		old.DownloadAttempts, old.LastDownloadAt = v.DownloadAttempts, v.LastDownloadAt
+		old.UpdatedAt = time.Now()
+	}
+	return nil
+}
+
+func (m *MemoryStore) UpdateResolve(v Video) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if old, ok := m.videos[v.ID]; ok {
+		old.WebDownloadUrl, old.MDownloadUrl, old.ErrorMsg = v.WebDownloadUrl, v.MDownloadUrl, v.ErrorMsg
+		old.WebResolvedAt, old.MResolvedAt = v.WebResolvedAt, v.MResolvedAt
+		old.ResolveAttempts, old.LastResolveAt = v.ResolveAttempts, v.LastResolveAt
+		old.UpdatedAt = time.Now()
+	}
+	return nil
+}
+
+func (m *MemoryStore) UpdateSeries(v Video) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if old, ok := m.videos[v.ID]; ok {
+		old.Series, old.Part, old.Episode, old.Subtitle = v.Series, v.Part, v.Episode, v.Subtitle
+		old.UpdatedAt = time.Now()
+	}
+	return nil
+}
+
+func (m *MemoryStore) UpdateFileSuffix(id uint, n int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if v, ok := m.videos[id]; ok {
+		v.FileSuffix = n
+		v.UpdatedAt = time.Now()
+	}
+	return nil
+}
+
+func (m *MemoryStore) UpdateSaveName(id uint, name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if v, ok := m.videos[id]; ok {
+		v.SaveName = name
+		v.UpdatedAt = time.Now()
+	}
+	return nil
+}
+
+func (m *MemoryStore) findByWebUrl(ctx context.Context, weburl string) (Video, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, v := range m.sortedVideos(nil) {
+		if v.WebUrl == weburl {
+			return v, nil
+		}
+	}
+	return Video{}, gorm.ErrRecordNotFound
+}
+
+func (m *MemoryStore) Transition(id uint, to VideoStatus, reason string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	v, ok := m.videos[id]
+	if !ok {
+		return gorm.ErrRecordNotFound
+	}
+	return m.transition(v, to, reason)
+}
+
+// transition 调用时需要持有锁
+func (m *MemoryStore) transition(v *Video, to VideoStatus, reason string) error {
+	if v.Status == to {
+		return nil
+	}
+	if !CanTransition(v.Status, to) {
+		return &TransitionError{VideoID: v.ID, From: v.Status, To: to}
+	}
+	now := time.Now()
+	if to == StatusSkipped {
+		v.NeedDownload = false
+	} else if v.Status == StatusSkipped {
+		v.NeedDownload = true
+	}
+	m.events = append(m.events, VideoEvent{ID: uint(len(m.events) + 1), VideoID: v.ID, From: v.Status, To: to,
+		Reason: truncate(reason, 512), CreatedAt: now})
+	v.Status = to
+	v.StatusAt = &now
+	v.UpdatedAt = now
+	return nil
+}
+
+func (m *MemoryStore) ListByStatus(ctx context.Context, statuses ...VideoStatus) ([]Video, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.sortedVideos(func(v *Video) bool {
+		for _, st := range statuses {
+			if v.Status == st {
+				return true
+			}
+		}
+		return false
+	}), nil
+}
+
+func (m *MemoryStore) CountByStatus() (map[VideoStatus]int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	counts := make(map[VideoStatus]int64)
+	for _, v := range m.videos {
+		counts[v.Status]++
+	}
+	return counts, nil
+}
+
+func (m *MemoryStore) ListEvents(videoID uint) ([]VideoEvent, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var events []VideoEvent
+	for _, e := range m.events {
+		if e.VideoID == videoID {
+			events = append(events, e)
+		}
+	}
+	return events, nil
+}
+
+func (m *MemoryStore) ListChannels() ([]Channel, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	list := make([]Channel, 0, len(m.channels))
+	for _, c := range m.channels {
+		list = append(list, *c)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	return list, nil
+}
+
+func (m *MemoryStore) SaveChannel(c *Channel) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now()
+	if c.ID == 0 {
+		c.ID = m.newID()
+		c.CreatedAt = now
+	}
+	c.UpdatedAt = now
+	saved := *c
+	m.channels[c.ID] = &saved
+	return nil
+}
+
+func (m *MemoryStore) GetChannel(id uint) (Channel, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if c, ok := m.channels[id]; ok {
+		return *c, nil
+	}
+	return Channel{}, gorm.ErrRecordNotFound
+}
+
+func (m *MemoryStore) DeleteChannel(id uint) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, v := range m.videos {
+		if v.ChannelID == id && v.Status != StatusRemoved {
+			if err := m.transition(v, StatusRemoved, "频道已删除"); err != nil {
+				return err
+			}
+		}
+	}
+	delete(m.channels, id)
+	return nil
+}
+
+func (m *MemoryStore) findChannelByUrl(url string) (Channel, error) {
+	channels, _ := m.ListChannels()
+	for _, c := range channels {
+		if c.Url == url {
+			return c, nil
+		}
+	}
+	return Channel{}, gorm.ErrRecordNotFound
+}
+
+func (m *MemoryStore) AssignChannel(channelID uint) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, v := range m.videos {
+		if v.ChannelID == 0 {
+			v.ChannelID = channelID
+		}
+	}
+	return nil
+}
+
+func (m *MemoryStore) SaveRun(r *RunHistory) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	r.ID = uint(len(m.runs) + 1)
+	m.runs = append(m.runs, *r)
+	return nil
+}
+
+func (m *MemoryStore) ListRuns(limit int) ([]RunHistory, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var runs []RunHistory
+	for i := len(m.runs) - 1; i >= 0 && (limit <= 0 || len(runs) < limit); i-- {
+		runs = append(runs, m.runs[i])
+	}
+	return runs, nil
+}
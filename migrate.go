@@ -0,0 +1,364 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// SchemaVersion 已经执行的数据库升级
+type SchemaVersion struct {
+	Version   int       `gorm:"column:version;primaryKey;autoIncrement:false" json:"version"`
+	Name      string    `gorm:"column:name;type:varchar(255)" json:"name"`
+	AppliedAt time.Time `gorm:"column:applied_at" json:"appliedAt"`
+}
+
+func (m *SchemaVersion) TableName() string {
+	return "schema_version"
+}
+
+// migration 一次数据库升级，版本号从1开始连续递增，已经发布的升级不能修改，只能追加。
+// 升级中不能用 AutoMigrate 当前的模型，否则以后添加的列会在前面的升级中创建，新加的列要在新的升级中单独添加
+type migration struct {
+	version int
+	name    string
+	up      func(tx *gorm.DB, dialect string) error
+}
+
+// migrations 按版本号排列的所有升级
+var migrations = []migration{
+	{1, "创建视频、频道、运行记录、状态记录表", func(tx *gorm.DB, dialect string) error {
+		// 旧版用 AutoMigrate 创建的数据库也从这里开始，已有的表只会补充缺少的列
+		return tx.AutoMigrate(&videoV1{}, &channelV1{}, &runHistoryV1{}, &videoEventV1{})
+	}},
+	{2, "补充旧版视频的状态", func(tx *gorm.DB, dialect string) error {
+		var videos []Video
+		err := tx.Model(&Video{}).Where("status = '' or status is null").Find(&videos).Error
+		if err != nil {
+			return err
+		}
+		now := time.Now()
+		for i := range videos {
+			err = tx.Model(&Video{}).Where("id =?", videos[i].ID).
+				Updates(map[string]interface{}{"status": inferStatus(videos[i]), "status_at": now}).Error
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}},
+	{3, "删除重复的播放地址，web_url 添加唯一索引", func(tx *gorm.DB, dialect string) error {
+		if err := removeDuplicateVideos(tx); err != nil {
+			return err
+		}
+		if dialect == "mysql" {
+			// utf8mb4 下索引最长 3072 字节
+			if err := tx.Exec("alter table biz_videos modify web_url varchar(768)").Error; err != nil {
+				return err
+			}
+		}
+		return tx.Exec("create unique index idx_videos_web_url on biz_videos (web_url)").Error
+	}},
+	{4, "视频添加剧名、第几部、第几集、副标题", func(tx *gorm.DB, dialect string) error {
+		// 已有的视频在下次运行时按名称规则识别
+		if err := addColumns(tx, &Video{}, "Series", "Part", "Episode", "Subtitle"); err != nil {
+			return err
+		}
+		if tx.Migrator().HasIndex(&Video{}, "Series") {
+			return nil
+		}
+		return tx.Migrator().CreateIndex(&Video{}, "Series")
+	}},
+	{5, "视频添加文件名重复时的序号", func(tx *gorm.DB, dialect string) error {
+		return addColumns(tx, &Video{}, "FileSuffix")
+	}},
+	{6, "视频添加获取到下载地址的时间", func(tx *gorm.DB, dialect string) error {
+		// 已有的地址不知道获取的时间，下载前重新获取
+		return addColumns(tx, &Video{}, "WebResolvedAt", "MResolvedAt")
+	}},
+}
+
+// addColumns 添加 model 中的字段对应的列，已经有的列跳过。
+// 旧版用 AutoMigrate 创建的数据库可能已经有这些列
+func addColumns(tx *gorm.DB, model interface{}, fields ...string) error {
+	m := tx.Migrator()
+	for _, field := range fields {
+		if m.HasColumn(model, field) {
+			continue
+		}
+		if err := m.AddColumn(model, field); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// duplicateVideo 播放地址重复的视频，包括已经软删除的
+type duplicateVideo struct {
+	ID        uint
+	WebUrl    string
+	SaveName  string
+	ChannelID uint
+	Status    VideoStatus
+	DeletedAt *time.Time
+}
+
+// better 同一个播放地址保留哪一条：没有删除的优先，然后是已经下载的，最后是最早的
+func (v duplicateVideo) better(o duplicateVideo) bool {
+	if (v.DeletedAt == nil) != (o.DeletedAt == nil) {
+		return v.DeletedAt == nil
+	}
+	if (v.Status == StatusDownloaded) != (o.Status == StatusDownloaded) {
+		return v.Status == StatusDownloaded
+	}
+	return v.ID < o.ID
+}
+
+// removeDuplicateVideos 同一个播放地址只保留一条，保留的视频没有保存名称、频道时用删除的补充，删除的记录写到日志中
+func removeDuplicateVideos(tx *gorm.DB) error {
+	var rows []duplicateVideo
+	err := tx.Raw(`select id, web_url, save_name, channel_id, status, deleted_at from biz_videos
+		where web_url in (select web_url from biz_videos group by web_url having count(*) > 1)
+		order by web_url, id`).Scan(&rows).Error
+	if err != nil {
+		return err
+	}
+	groups := make(map[string][]duplicateVideo)
+	var urls []string
+	for _, row := range rows {
+		if _, ok := groups[row.WebUrl]; !ok {
+			urls = append(urls, row.WebUrl)
+		}
+		groups[row.WebUrl] = append(groups[row.WebUrl], row)
+	}
+	for _, u := range urls {
+		group := groups[u]
+		keep := group[0]
+		for _, v := range group[1:] {
+			if v.better(keep) {
+				keep = v
+			}
+		}
+		updates := make(map[string]interface{})
+		var ids []uint
+		for _, v := range group {
+			if v.ID == keep.ID {
+				continue
+			}
+			ids = append(ids, v.ID)
+			if keep.SaveName == "" && v.SaveName != "" {
+				keep.SaveName = v.SaveName
+				updates["save_name"] = v.SaveName
+			}
+			if keep.ChannelID == 0 && v.ChannelID != 0 {
+				keep.ChannelID = v.ChannelID
+				updates["channel_id"] = v.ChannelID
+			}
+			log.Printf("删除重复的视频 %d %q（%s），播放地址 %s，保留 %d", v.ID, v.SaveName, v.Status, u, keep.ID)
+		}
+		if len(updates) > 0 {
+			if err = tx.Table("biz_videos").Where("id = ?", keep.ID).Updates(updates).Error; err != nil {
+				return err
+			}
+		}
+		if err = tx.Where("video_id in ?", ids).Delete(&VideoEvent{}).Error; err != nil {
+			return err
+		}
+		if err = tx.Unscoped().Where("id in ?", ids).Delete(&Video{}).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// MigrationStatus 一次升级的执行情况
+type MigrationStatus struct {
+	Version   int
+	Name      string
+	Applied   bool
+	AppliedAt time.Time
+}
+
+// PendingMigrationsError 数据库还有没有执行的升级
+type PendingMigrationsError struct {
+	Pending []MigrationStatus
+}
+
+func (e *PendingMigrationsError) Error() string {
+	return fmt.Sprintf("数据库有 %d 个升级没有执行，请先运行 migrate -apply 或者在界面中升级数据库", len(e.Pending))
+}
+
+// Migrator 执行数据库升级
+type Migrator struct {
+	db      *gorm.DB
+	dialect string
+}
+
+func newMigrator(db *gorm.DB) *Migrator {
+	return &Migrator{db: db, dialect: db.Dialector.Name()}
+}
+
+// Status 所有升级的执行情况，按版本号排列
+func (m *Migrator) Status() ([]MigrationStatus, error) {
+	if err := m.db.AutoMigrate(&SchemaVersion{}); err != nil {
+		return nil, err
+	}
+	var applied []SchemaVersion
+	if err := m.db.Model(&SchemaVersion{}).Find(&applied).Error; err != nil {
+		return nil, err
+	}
+	done := make(map[int]SchemaVersion, len(applied))
+	for _, v := range applied {
+		done[v.Version] = v
+	}
+	list := make([]MigrationStatus, 0, len(migrations))
+	for _, mg := range migrations {
+		v, ok := done[mg.version]
+		list = append(list, MigrationStatus{Version: mg.version, Name: mg.name, Applied: ok, AppliedAt: v.AppliedAt})
+	}
+	return list, nil
+}
+
+// Pending 没有执行的升级
+func (m *Migrator) Pending() ([]MigrationStatus, error) {
+	list, err := m.Status()
+	if err != nil {
+		return nil, err
+	}
+	var pending []MigrationStatus
+	for _, st := range list {
+		if !st.Applied {
+			pending = append(pending, st)
+		}
+	}
+	return pending, nil
+}
+
+// Apply 按顺序执行没有执行的升级，返回执行的个数，出错时停在出错的升级
+func (m *Migrator) Apply() (int, error) {
+	pending, err := m.Pending()
+	if err != nil {
+		return 0, err
+	}
+	var n int
+	for _, st := range pending {
+		mg := migrations[st.Version-1]
+		// mysql 的 DDL 会隐式提交，出错时已经执行的 DDL 不会回滚
+		err = m.db.Transaction(func(tx *gorm.DB) error {
+			if err := mg.up(tx, m.dialect); err != nil {
+				return err
+			}
+			return tx.Create(&SchemaVersion{Version: mg.version, Name: mg.name, AppliedAt: time.Now()}).Error
+		})
+		if err != nil {
+			return n, fmt.Errorf("执行升级 %d %s 失败: %w", mg.version, mg.name, err)
+		}
+		n++
+	}
+	return n, nil
+}
+
+// fresh 判断是不是新建的数据库，还没有视频表时执行所有升级都是安全的
+func (m *Migrator) fresh() bool {
+	return !m.db.Migrator().HasTable(&Video{})
+}
+
+// prepare 新建的数据库直接执行所有升级，已有的数据库有没有执行的升级时返回 *PendingMigrationsError
+func (m *Migrator) prepare() error {
+	if m.fresh() {
+		_, err := m.Apply()
+		return err
+	}
+	pending, err := m.Pending()
+	if err != nil {
+		return err
+	}
+	if len(pending) > 0 {
+		return &PendingMigrationsError{Pending: pending}
+	}
+	return nil
+}
+
+// IsPendingMigrations 判断是不是因为数据库需要升级而打开失败
+func IsPendingMigrations(err error) bool {
+	var pe *PendingMigrationsError
+	return errors.As(err, &pe)
+}
+
+// 升级 1 创建的表结构，不随模型修改
+
+type videoV1 struct {
+	gorm.Model
+	ChannelID      uint   `gorm:"column:channel_id;index;comment:所属频道"`
+	WebUrl         string `gorm:"column:web_url;type:varchar(768);comment:唯一索引在升级3中创建"`
+	MUrl           string `gorm:"column:m_url;type:varchar(1024);comment:手机端url"`
+	Source         string `gorm:"column:source;type:varchar(32);comment:视频平台"`
+	OriginName     string `gorm:"column:origin_name;type:varchar(255);comment:原始名称"`
+	SaveName       string `gorm:"column:save_name;type:varchar(255);comment:保存名称"`
+	WebDownloadUrl string `gorm:"column:web_download_url;type:varchar(1024);comment:浏览器下载地址"`
+	MDownloadUrl   string `gorm:"column:m_download_url;type:varchar(1024);comment:手机端下载地址"`
+	NeedDownload   bool   `gorm:"column:need_download"`
+	ErrorMsg       string `gorm:"column:error_msg;type:varchar(512)"`
+	DownloadErr    string `gorm:"column:download_err;type:varchar(512)"`
+	ETag           string `gorm:"column:etag;type:varchar(255);comment:断点续传校验"`
+	LastModified   string `gorm:"column:last_modified;type:varchar(64);comment:断点续传校验"`
+	FileSize       int64  `gorm:"column:file_size;comment:文件大小"`
+	PartialSize    int64  `gorm:"column:partial_size;comment:未完成的临时文件大小"`
+
+	ResolveAttempts  int        `gorm:"column:resolve_attempts;comment:最近一次获取下载地址的尝试次数"`
+	LastResolveAt    *time.Time `gorm:"column:last_resolve_at;comment:最近一次获取下载地址的时间"`
+	DownloadAttempts int        `gorm:"column:download_attempts;comment:最近一次下载的尝试次数"`
+	LastDownloadAt   *time.Time `gorm:"column:last_download_at;comment:最近一次下载的时间"`
+
+	Status   string     `gorm:"column:status;type:varchar(16);index;comment:状态，只能通过 Transition 修改"`
+	StatusAt *time.Time `gorm:"column:status_at;comment:最近一次状态切换的时间"`
+}
+
+func (m *videoV1) TableName() string {
+	return "biz_videos"
+}
+
+type channelV1 struct {
+	gorm.Model
+	Url     string            `gorm:"column:url;type:varchar(1024)"`
+	Source  string            `gorm:"column:source;type:varchar(32);comment:视频平台，为空时根据地址判断"`
+	Name    string            `gorm:"column:name;type:varchar(255);comment:显示名称"`
+	Folder  string            `gorm:"column:folder;type:varchar(255);comment:下载子目录"`
+	Replace map[string]string `gorm:"column:replace_rules;type:text;serializer:json;comment:额外的名称替换规则"`
+	Enabled bool              `gorm:"column:enabled"`
+}
+
+func (m *channelV1) TableName() string {
+	return "biz_channels"
+}
+
+type runHistoryV1 struct {
+	ID         uint      `gorm:"primarykey"`
+	StartedAt  time.Time `gorm:"column:started_at"`
+	FinishedAt time.Time `gorm:"column:finished_at"`
+	Trigger    string    `gorm:"column:trigger_by;type:varchar(16);comment:触发方式 schedule、manual、cli"`
+	Status     string    `gorm:"column:status;type:varchar(16);comment:success、failed、skipped、canceled"`
+	Error      string    `gorm:"column:error;type:varchar(512)"`
+	Downloaded int64     `gorm:"column:downloaded;comment:下载成功的文件数"`
+	Failed     int64     `gorm:"column:failed;comment:下载失败的文件数"`
+}
+
+func (m *runHistoryV1) TableName() string {
+	return "biz_runs"
+}
+
+type videoEventV1 struct {
+	ID        uint      `gorm:"primarykey"`
+	VideoID   uint      `gorm:"column:video_id;index"`
+	From      string    `gorm:"column:from_status;type:varchar(16)"`
+	To        string    `gorm:"column:to_status;type:varchar(16)"`
+	Reason    string    `gorm:"column:reason;type:varchar(512)"`
+	CreatedAt time.Time `gorm:"column:created_at"`
+}
+
+func (m *videoEventV1) TableName() string {
+	return "biz_video_events"
+}
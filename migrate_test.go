@@ -0,0 +1,164 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+func TestMigrationVersions(t *testing.T) {
+	for i, mg := range migrations {
+		if mg.version != i+1 {
+			t.Errorf("migration %q has version %d, want %d", mg.name, mg.version, i+1)
+		}
+	}
+}
+
+func TestMigrateFresh(t *testing.T) {
+	store := newTestStore(t)
+	m := newMigrator(store.db)
+	pending, err := m.Pending()
+	if err != nil || len(pending) != 0 {
+		t.Fatalf("pending = %v, %v", pending, err)
+	}
+	// 升级后的表和当前的模型一致
+	assertVideoColumns(t, store.db)
+	if err = store.Save([]Video{{WebUrl: "https://a"}}); err != nil {
+		t.Fatal(err)
+	}
+	if err = store.Save([]Video{{WebUrl: "https://a"}}); err == nil {
+		t.Error("duplicate web_url should be rejected")
+	}
+}
+
+// baselineVideo 最早的版本用 AutoMigrate 创建的视频表，没有状态、频道、文件大小、剧集这些列
+type baselineVideo struct {
+	gorm.Model
+	WebUrl         string `gorm:"column:web_url;type:varchar(1024)"`
+	MUrl           string `gorm:"column:m_url;type:varchar(1024)"`
+	OriginName     string `gorm:"column:origin_name;type:varchar(255)"`
+	SaveName       string `gorm:"column:save_name;type:varchar(255)"`
+	WebDownloadUrl string `gorm:"column:web_download_url;type:varchar(1024)"`
+	MDownloadUrl   string `gorm:"column:m_download_url;type:varchar(1024)"`
+	NeedDownload   bool   `gorm:"column:need_download"`
+	ErrorMsg       string `gorm:"column:error_msg;type:varchar(512)"`
+	DownloadErr    string `gorm:"column:download_err;type:varchar(512)"`
+}
+
+func (m *baselineVideo) TableName() string {
+	return "biz_videos"
+}
+
+// assertVideoColumns 视频表有当前模型的所有列
+func assertVideoColumns(t *testing.T, db *gorm.DB) {
+	t.Helper()
+	stmt := &gorm.Statement{DB: db}
+	if err := stmt.Parse(&Video{}); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range stmt.Schema.DBNames {
+		if !db.Migrator().HasColumn(&Video{}, name) {
+			t.Errorf("biz_videos has no column %s", name)
+		}
+	}
+	if !db.Migrator().HasIndex(&Video{}, "Series") {
+		t.Error("biz_videos has no index on series")
+	}
+}
+
+func TestMigrateLegacy(t *testing.T) {
+	db := newTestDB(t)
+	// 旧版直接用 AutoMigrate 创建的数据库，有重复的播放地址，没有状态
+	if err := db.AutoMigrate(&baselineVideo{}); err != nil {
+		t.Fatal(err)
+	}
+	videos := []baselineVideo{
+		{WebUrl: "https://a", SaveName: "a", NeedDownload: true},
+		{WebUrl: "https://a", SaveName: "a2", NeedDownload: true},
+		{WebUrl: "https://b", SaveName: "b", WebDownloadUrl: "https://cdn/b", NeedDownload: true},
+		{WebUrl: "https://c", SaveName: "c", WebDownloadUrl: "https://cdn/c", DownloadErr: "timeout", NeedDownload: true},
+		{WebUrl: "https://d", SaveName: "d"},
+	}
+	if err := db.Create(&videos).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	m := newMigrator(db)
+	err := m.prepare()
+	if !IsPendingMigrations(err) {
+		t.Fatalf("prepare err = %v, want pending migrations", err)
+	}
+	n, err := m.Apply()
+	if err != nil || n != len(migrations) {
+		t.Fatalf("apply = %d, %v", n, err)
+	}
+	if err = m.prepare(); err != nil {
+		t.Fatalf("prepare after apply: %v", err)
+	}
+	assertVideoColumns(t, db)
+	for _, table := range []interface{}{&Channel{}, &RunHistory{}, &VideoEvent{}} {
+		if !db.Migrator().HasTable(table) {
+			t.Errorf("table %T not created", table)
+		}
+	}
+
+	store := &Store{db: db}
+	list, err := store.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 4 || list[0].SaveName != "a" {
+		t.Fatalf("list = %+v", list)
+	}
+	want := []VideoStatus{StatusDiscovered, StatusResolved, StatusFailed, StatusSkipped}
+	for i, v := range list {
+		if v.Status != want[i] || v.StatusAt == nil {
+			t.Errorf("%s status = %s, want %s", v.SaveName, v.Status, want[i])
+		}
+		if v.ChannelID != 0 || v.Series != "" || v.FileSuffix != 0 || v.WebResolvedAt != nil {
+			t.Errorf("%s new columns = %+v", v.SaveName, v)
+		}
+	}
+	if err = store.Save([]Video{{WebUrl: "https://b"}}); err == nil {
+		t.Error("duplicate web_url should be rejected")
+	}
+}
+
+// TestMigrateDuplicates 重复的播放地址保留没有删除的、已经下载的视频，补充保存名称和频道
+func TestMigrateDuplicates(t *testing.T) {
+	db := newTestDB(t)
+	// 升级 1 创建的表，已经有状态和频道
+	if err := db.AutoMigrate(&videoV1{}); err != nil {
+		t.Fatal(err)
+	}
+	deleted := gorm.DeletedAt{Time: time.Now(), Valid: true}
+	videos := []videoV1{
+		{WebUrl: "https://a", SaveName: "a", Status: string(StatusDiscovered)},
+		{WebUrl: "https://a", SaveName: "第一集", ChannelID: 5, Status: string(StatusDownloaded)},
+		{WebUrl: "https://a", Status: string(StatusResolved)},
+		{WebUrl: "https://b", SaveName: "b", ChannelID: 7, Status: string(StatusDownloaded)},
+		{WebUrl: "https://b", Status: string(StatusDiscovered)},
+	}
+	videos[3].DeletedAt = deleted
+	if err := db.Create(&videos).Error; err != nil {
+		t.Fatal(err)
+	}
+	if _, err := newMigrator(db).Apply(); err != nil {
+		t.Fatal(err)
+	}
+
+	var list []Video
+	if err := db.Unscoped().Order("id").Find(&list).Error; err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 2 {
+		t.Fatalf("list = %+v", list)
+	}
+	if v := list[0]; v.ID != videos[1].ID || v.SaveName != "第一集" || v.ChannelID != 5 {
+		t.Errorf("https://a kept %+v", v)
+	}
+	if v := list[1]; v.ID != videos[4].ID || v.SaveName != "b" || v.ChannelID != 7 || v.DeletedAt.Valid {
+		t.Errorf("https://b kept %+v", v)
+	}
+}
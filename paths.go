@@ -0,0 +1,361 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// 保存路径模板，相对于保存地址，用 / 分隔目录
+const (
+	// DefaultPathTemplate 频道设置了子目录时保存到子目录中
+	DefaultPathTemplate = "{channel}/{name}.mp4"
+	// SeriesPathTemplate 识别到集数的视频再保存到剧名的目录中
+	SeriesPathTemplate = "{channel}/{series}/{name}.mp4"
+)
+
+// pathFields 模板中可以使用的占位符
+var pathFields = []string{"channel", "name", "series", "part", "episode", "subtitle", "date", "year", "month", "id"}
+
+// numberFields 可以用 {episode:2} 这样的写法在前面补零的占位符
+var numberFields = map[string]bool{"part": true, "episode": true}
+
+type pathToken struct {
+	text  string // 普通文字
+	field string // 占位符，为空时是普通文字
+	width int    // 数字补零后的宽度
+}
+
+// PathTemplate 解析后的保存路径模板，最后一层是文件名。
+// 占位符的值为空时（例如没有识别到集数），这一层目录省略，文件名改为 {name}.mp4
+type PathTemplate struct {
+	segments [][]pathToken
+}
+
+// ParsePathTemplate 解析保存路径模板，为空时使用默认模板，文件名没有 .mp4 时自动加上
+func ParsePathTemplate(s string) (*PathTemplate, error) {
+	s = strings.ReplaceAll(strings.TrimSpace(s), `\`, "/")
+	if s == "" {
+		s = DefaultPathTemplate
+	}
+	if strings.HasPrefix(s, "/") || filepath.IsAbs(s) || filepath.VolumeName(s) != "" {
+		return nil, errors.New("需要是相对于保存地址的路径")
+	}
+	if strings.HasSuffix(strings.ToLower(s), ".mp4") {
+		s = s[:len(s)-len(".mp4")]
+	}
+	s += ".mp4"
+	t := &PathTemplate{}
+	for _, seg := range strings.Split(s, "/") {
+		if seg == "" || seg == "." || seg == ".." {
+			return nil, fmt.Errorf("目录名不能为空或者是 %q", seg)
+		}
+		tokens, err := parsePathSegment(seg)
+		if err != nil {
+			return nil, err
+		}
+		t.segments = append(t.segments, tokens)
+	}
+	var hasField bool
+	for _, tok := range t.segments[len(t.segments)-1] {
+		hasField = hasField || tok.field != ""
+	}
+	if !hasField {
+		return nil, errors.New("文件名中需要有占位符，例如 {name}，否则所有视频保存到同一个文件")
+	}
+	return t, nil
+}
+
+// parsePathSegment 解析一层目录或者文件名中的文字和占位符
+func parsePathSegment(seg string) ([]pathToken, error) {
+	var tokens []pathToken
+	for seg != "" {
+		open := strings.IndexByte(seg, '{')
+		if open < 0 {
+			tokens = append(tokens, pathToken{text: seg})
+			break
+		}
+		if open > 0 {
+			tokens = append(tokens, pathToken{text: seg[:open]})
+		}
+		end := strings.IndexByte(seg[open:], '}')
+		if end < 0 {
+			return nil, fmt.Errorf("%q 缺少 }", seg)
+		}
+		field, width, _ := strings.Cut(seg[open+1:open+end], ":")
+		tok := pathToken{field: field}
+		if !containsString(pathFields, field) {
+			return nil, fmt.Errorf("不支持的占位符 {%s}，可选 {%s}", field, strings.Join(pathFields, "}、{"))
+		}
+		if width != "" {
+			n, err := strconv.Atoi(width)
+			if err != nil || n < 1 || n > 9 || !numberFields[field] {
+				return nil, fmt.Errorf("{%s:%s} 格式错误，只有 {part}、{episode} 可以补零，例如 {episode:2}", field, width)
+			}
+			tok.width = n
+		}
+		tokens = append(tokens, tok)
+		seg = seg[open+end+1:]
+	}
+	return tokens, nil
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// Depth 模板最多有几层目录
+func (t *PathTemplate) Depth() int {
+	return len(t.segments) - 1
+}
+
+// uses 模板中是否用到了占位符 field
+func (t *PathTemplate) uses(field string) bool {
+	for _, seg := range t.segments {
+		for _, tok := range seg {
+			if tok.field == field {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Path 视频保存的完整路径，folder 为频道的下载子目录。每一层都会转换成各个系统都可以使用的名称，
+// 文件名重复时加上数据库中记录的序号
+func (t *PathTemplate) Path(root, folder string, v Video) string {
+	values := pathValues(v, folder)
+	parts := []string{root}
+	last := len(t.segments) - 1
+	for i, seg := range t.segments {
+		name, ok := renderSegment(seg, values)
+		if i == last && !ok {
+			name, ok = values["name"]+".mp4", true
+		}
+		if !ok {
+			continue
+		}
+		// 频道的子目录可能有多层
+		dirs := strings.Split(name, "/")
+		if i == last {
+			name, dirs = dirs[len(dirs)-1], dirs[:len(dirs)-1]
+		}
+		for _, dir := range dirs {
+			if dir != "" {
+				parts = append(parts, SanitizeFileName(dir, maxComponentBytes))
+			}
+		}
+		if i == last {
+			stem := strings.TrimSuffix(name, ".mp4")
+			parts = append(parts, SanitizeFileName(stem, maxNameBytes)+fileSuffix(v.FileSuffix)+".mp4")
+		}
+	}
+	return filepath.Join(parts...)
+}
+
+// renderSegment 替换一层中的占位符，有占位符为空时返回 false
+func renderSegment(seg []pathToken, values map[string]string) (string, bool) {
+	var b strings.Builder
+	for _, tok := range seg {
+		if tok.field == "" {
+			b.WriteString(tok.text)
+			continue
+		}
+		v := values[tok.field]
+		if v == "" {
+			return "", false
+		}
+		if len(v) < tok.width {
+			b.WriteString(strings.Repeat("0", tok.width-len(v)))
+		}
+		b.WriteString(v)
+	}
+	name := b.String()
+	if trimmed := strings.TrimSpace(name); trimmed == "" || trimmed == "." || trimmed == ".." {
+		return "", false
+	}
+	return name, true
+}
+
+// pathName 名称中的路径分隔符，避免多出一层目录
+var pathName = strings.NewReplacer("/", "-", `\`, "-")
+
+// pathValues 视频在模板中各个占位符的值，没有这个信息时为空
+func pathValues(v Video, folder string) map[string]string {
+	values := map[string]string{
+		"channel":  filepath.ToSlash(filepath.Clean(folder)),
+		"name":     pathName.Replace(v.SaveName),
+		"subtitle": pathName.Replace(v.Subtitle),
+		"id":       videoID(v),
+	}
+	if values["channel"] == "." {
+		values["channel"] = ""
+	}
+	// 没有识别到集数的视频不算剧集
+	if v.Series != "" && (v.Episode > 0 || v.Part > 0) {
+		values["series"] = pathName.Replace(v.Series)
+	}
+	if v.Part > 0 {
+		values["part"] = strconv.Itoa(v.Part)
+	}
+	if v.Episode > 0 {
+		values["episode"] = strconv.Itoa(v.Episode)
+	}
+	if t, ok := uploadTime(v); ok {
+		values["date"] = t.Format("2006-01-02")
+		values["year"] = t.Format("2006")
+		values["month"] = t.Format("01")
+	}
+	return values
+}
+
+// videoID 播放地址中的视频ID，没有时使用数据库中的ID
+func videoID(v Video) string {
+	if u, err := url.Parse(v.WebUrl); err == nil {
+		if id := path.Base(strings.TrimRight(u.Path, "/")); id != "." && id != "/" && id != "" {
+			return id
+		}
+	}
+	if v.ID == 0 {
+		return ""
+	}
+	return strconv.FormatUint(uint64(v.ID), 10)
+}
+
+// uploadTime 视频的上传时间，平台不能从地址中得到时使用第一次获取到这个视频的时间
+func uploadTime(v Video) (time.Time, bool) {
+	if src, err := resolveSource(v.Source, v.WebUrl); err == nil {
+		if ut, ok := src.(UploadTimer); ok {
+			if t, ok := ut.UploadTime(v.WebUrl); ok {
+				return t, true
+			}
+		}
+	}
+	return v.CreatedAt, !v.CreatedAt.IsZero()
+}
+
+// videoPaths 按保存路径模板计算视频的保存路径
+type videoPaths struct {
+	root     string
+	template *PathTemplate
+	folders  map[uint]string // 频道ID对应的下载子目录
+}
+
+// videoPaths 读取频道的下载子目录，按 conf 中的模板计算路径
+func (s *Server) videoPaths(conf Conf) (videoPaths, error) {
+	t, err := ParsePathTemplate(conf.PathTemplate)
+	if err != nil {
+		return videoPaths{}, err
+	}
+	folders, err := s.channelFolders()
+	if err != nil {
+		return videoPaths{}, err
+	}
+	return videoPaths{root: conf.DownloadPath, template: t, folders: folders}, nil
+}
+
+// File 视频保存的路径
+func (p videoPaths) File(v Video) string {
+	return p.template.Path(p.root, p.folders[v.ChannelID], v)
+}
+
+// Downloaded 扫描保存目录中模板可能生成的各层目录，返回已经下载完成的 mp4 文件路径
+func (p videoPaths) Downloaded() (map[string]bool, error) {
+	depth := p.template.Depth()
+	// 频道的子目录可能有多层
+	if p.template.uses("channel") {
+		var extra int
+		for _, folder := range p.folders {
+			if n := strings.Count(filepath.Clean(folder), string(filepath.Separator)); n > extra {
+				extra = n
+			}
+		}
+		depth += extra
+	}
+	root := filepath.Clean(p.root)
+	files := make(map[string]bool)
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			if rel, _ := filepath.Rel(root, path); rel != "." && strings.Count(rel, string(filepath.Separator))+1 > depth {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if strings.HasSuffix(d.Name(), ".mp4") {
+			files[path] = true
+		}
+		return nil
+	})
+	return files, err
+}
+
+// moveVideoFile 把已经下载的文件移动到新的路径，原来的文件不存在时不处理
+func moveVideoFile(oldPath, newPath string) (bool, error) {
+	if oldPath == newPath {
+		return false, nil
+	}
+	if _, err := os.Stat(oldPath); err != nil {
+		return false, nil
+	}
+	if _, err := os.Stat(newPath); err == nil {
+		return false, fmt.Errorf("文件已存在 %s", filepath.Base(newPath))
+	}
+	if err := os.MkdirAll(filepath.Dir(newPath), 0o755); err != nil {
+		return false, err
+	}
+	if err := os.Rename(oldPath, newPath); err != nil {
+		return false, err
+	}
+	// 原来的目录空了就删掉，删除失败说明还有其他文件
+	_ = os.Remove(filepath.Dir(oldPath))
+	return true, nil
+}
+
+// RelocateFiles 保存路径模板修改后，把按 from 模板保存的已下载文件移动到 conf 中模板的路径，返回移动的个数
+func (s *Server) RelocateFiles(conf Conf, from string) (int, error) {
+	if conf.DownloadPath == "" {
+		return 0, errors.New("请填写保存地址")
+	}
+	if err := s.openStore(conf); err != nil {
+		return 0, err
+	}
+	old, err := ParsePathTemplate(from)
+	if err != nil {
+		return 0, err
+	}
+	paths, err := s.videoPaths(conf)
+	if err != nil {
+		return 0, err
+	}
+	list, err := s.store.List()
+	if err != nil {
+		return 0, err
+	}
+	var n int
+	var errs error
+	for _, v := range list {
+		moved, err := moveVideoFile(old.Path(paths.root, paths.folders[v.ChannelID], v), paths.File(v))
+		if err != nil {
+			errs = errors.Join(errs, fmt.Errorf("%s: %w", v.SaveName, err))
+		}
+		if moved {
+			n++
+		}
+	}
+	return n, errs
+}
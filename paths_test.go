@@ -0,0 +1,162 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+func TestParsePathTemplate(t *testing.T) {
+	for _, s := range []string{"", DefaultPathTemplate, SeriesPathTemplate, `{channel}\{series}\{name}`, "{year}/{series} 第{episode:2}集.mp4"} {
+		if _, err := ParsePathTemplate(s); err != nil {
+			t.Errorf("ParsePathTemplate(%q) = %v", s, err)
+		}
+	}
+	for _, s := range []string{"/{name}.mp4", "{channel}//{name}", "../{name}", "{title}.mp4", "{name", "{name:2}", "{episode:x}", "{channel}/视频.mp4"} {
+		if _, err := ParsePathTemplate(s); err == nil {
+			t.Errorf("ParsePathTemplate(%q) should fail", s)
+		}
+	}
+}
+
+func TestPathTemplatePath(t *testing.T) {
+	root := filepath.Join("data", "videos")
+	episode := Video{
+		Model:    gorm.Model{ID: 9, CreatedAt: time.Date(2024, 5, 6, 12, 0, 0, 0, time.Local)},
+		WebUrl:   "https://www.ixigua.com/7210000000000000001/",
+		SaveName: "三看亲家第3集",
+		Series:   "三看/亲家",
+		Episode:  3,
+		Subtitle: "大结局",
+	}
+	single := Video{Model: gorm.Model{ID: 10}, WebUrl: "https://v.douyin.com/abc/", SaveName: "春节晚会", Series: "春节晚会"}
+
+	tests := []struct {
+		template string
+		folder   string
+		v        Video
+		want     string
+	}{
+		{DefaultPathTemplate, "", episode, "三看亲家第3集.mp4"},
+		{DefaultPathTemplate, "平南", episode, "平南/三看亲家第3集.mp4"},
+		{SeriesPathTemplate, "平南", episode, "平南/三看-亲家/三看亲家第3集.mp4"},
+		// 没有识别到集数时省略剧名的目录
+		{SeriesPathTemplate, "平南", single, "平南/春节晚会.mp4"},
+		{"{series}/{series} 第{episode:2}集 {subtitle}", "", episode, "三看-亲家/三看-亲家 第03集 大结局.mp4"},
+		// 文件名中的占位符为空时使用保存名称
+		{"{series}/{series} 第{episode:2}集", "", single, "春节晚会.mp4"},
+		{"{year}/{date} {id}.mp4", "", episode, "2023/2023-03-13 7210000000000000001.mp4"},
+		{"{year}/{date} {id}.mp4", "", single, "春节晚会.mp4"},
+		{"{channel}/{name}.mp4", "平南/牛歌戏", episode, "平南/牛歌戏/三看亲家第3集.mp4"},
+	}
+	for _, tt := range tests {
+		tmpl, err := ParsePathTemplate(tt.template)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := filepath.Join(root, filepath.FromSlash(tt.want))
+		if got := tmpl.Path(root, tt.folder, tt.v); got != want {
+			t.Errorf("%s: Path = %s, want %s", tt.template, got, want)
+		}
+	}
+
+	single.CreatedAt = time.Date(2024, 5, 6, 12, 0, 0, 0, time.Local)
+	tmpl, _ := ParsePathTemplate("{date}/{id}")
+	if got := tmpl.Path(root, "", single); got != filepath.Join(root, "2024-05-06", "abc.mp4") {
+		t.Errorf("Path with created date = %s", got)
+	}
+}
+
+func TestVideoPathsDownloaded(t *testing.T) {
+	root := t.TempDir()
+	tmpl, _ := ParsePathTemplate(SeriesPathTemplate)
+	paths := videoPaths{root: root, template: tmpl, folders: map[uint]string{1: "平南"}}
+	files := []string{
+		"a.mp4",
+		"平南/b.mp4",
+		"平南/三看亲家/c.mp4",
+		"平南/三看亲家/d.mp4.download",
+		"平南/三看亲家/太深/e.mp4",
+	}
+	for _, f := range files {
+		path := filepath.Join(root, filepath.FromSlash(f))
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte("mp4"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	got, err := paths.Downloaded()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, f := range files {
+		if want := i < 3; got[filepath.Join(root, filepath.FromSlash(f))] != want {
+			t.Errorf("%s downloaded = %v, want %v", f, !want, want)
+		}
+	}
+
+	v := Video{ChannelID: 1, SaveName: "c", Series: "三看亲家", Episode: 1}
+	if !got[paths.File(v)] {
+		t.Errorf("%s should be downloaded", paths.File(v))
+	}
+}
+
+func TestRelocateFiles(t *testing.T) {
+	store := NewMemoryStore()
+	ch := Channel{Url: "https://www.ixigua.com/home/1/", Folder: "平南"}
+	if err := store.SaveChannel(&ch); err != nil {
+		t.Fatal(err)
+	}
+	err := store.Save([]Video{
+		{ChannelID: ch.ID, WebUrl: "https://a/1", SaveName: "三看亲家第1集", Series: "三看亲家", Episode: 1},
+		{ChannelID: ch.ID, WebUrl: "https://a/2", SaveName: "三看亲家第2集", Series: "三看亲家", Episode: 2},
+		{ChannelID: ch.ID, WebUrl: "https://a/3", SaveName: "春节晚会", Series: "春节晚会"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf := DefaultConf()
+	conf.DownloadPath = t.TempDir()
+	for _, name := range []string{"三看亲家第1集", "春节晚会"} {
+		if err = os.MkdirAll(filepath.Join(conf.DownloadPath, "平南"), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err = os.WriteFile(filepath.Join(conf.DownloadPath, "平南", name+".mp4"), []byte("mp4"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	s := &Server{store: store}
+	conf.PathTemplate = SeriesPathTemplate
+	n, err := s.RelocateFiles(conf, DefaultPathTemplate)
+	if err != nil || n != 1 {
+		t.Fatalf("RelocateFiles = %d, %v", n, err)
+	}
+	if _, err = os.Stat(filepath.Join(conf.DownloadPath, "平南", "三看亲家", "三看亲家第1集.mp4")); err != nil {
+		t.Error(err)
+	}
+	if _, err = os.Stat(filepath.Join(conf.DownloadPath, "平南", "春节晚会.mp4")); err != nil {
+		t.Error(err)
+	}
+
+	// 移动后按新的模板扫描可以找到所有文件
+	items, err := s.Library(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var onDisk []string
+	for _, item := range items {
+		if item.OnDisk {
+			onDisk = append(onDisk, item.SaveName)
+		}
+	}
+	if strings.Join(onDisk, ",") != "三看亲家第1集,春节晚会" {
+		t.Errorf("on disk = %v", onDisk)
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// fakeSource 测试用的视频平台，视频列表和下载地址都是固定的
+type fakeSource struct {
+	videos    []SourceVideo
+	downloads map[string]string // 播放页面地址 -> 下载地址
+}
+
+func (fakeSource) Name() string { return "fake" }
+
+func (fakeSource) Match(u *url.URL) bool { return u.Hostname() == "fake.test" }
+
+func (f fakeSource) ListVideos(ctx context.Context, conf Conf, channelUrl string) ([]SourceVideo, error) {
+	return f.videos, nil
+}
+
+func (fakeSource) CanonicalUrl(href string) string { return href }
+
+func (f fakeSource) ResolveDownloadUrl(ctx context.Context, pageUrl string) (string, error) {
+	if u, ok := f.downloads[pageUrl]; ok {
+		return u, nil
+	}
+	return "", errors.New("视频不存在")
+}
+
+// useSource 在测试期间注册视频平台
+func useSource(t *testing.T, src Source) {
+	old := sources
+	sources = append(append([]Source(nil), sources...), src)
+	t.Cleanup(func() { sources = old })
+}
+
+func TestPipelineMemoryStore(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("video " + r.URL.Path))
+	}))
+	defer srv.Close()
+
+	useSource(t, fakeSource{
+		videos: []SourceVideo{
+			{Title: "牛歌戏第一集", PageUrl: "https://fake.test/v/1"},
+			{Title: "牛歌戏第二集", PageUrl: "https://fake.test/v/2"},
+			{Title: "已下架", PageUrl: "https://fake.test/v/3"},
+		},
+		downloads: map[string]string{
+			"https://fake.test/v/1": srv.URL + "/1.mp4",
+			"https://fake.test/v/2": srv.URL + "/2.mp4",
+		},
+	})
+
+	store := NewMemoryStore()
+	if err := store.SaveChannel(&Channel{Url: "https://fake.test/home", Source: "fake", Folder: "牛歌戏", Enabled: true}); err != nil {
+		t.Fatal(err)
+	}
+	conf := DefaultConf()
+	conf.DownloadPath = t.TempDir()
+	conf.TitleRules = []TitleRule{{Type: RuleLiteral, Find: "牛歌戏"}}
+	conf.Retry = RetryPolicy{MaxAttempts: 1}
+	// 一个一个获取下载地址，事件的顺序是固定的
+	conf.BrowserTabs = 1
+	conf.GetUrl, conf.FillUrl, conf.Download = true, true, true
+
+	s := &Server{store: store}
+	stop := collectEvents(s)
+	// 已下架的视频获取不到地址，其他的照常下载
+	if err := s.Run(context.Background(), conf); !errors.Is(err, errResolveFailed) {
+		t.Fatalf("Run err = %v", err)
+	}
+	var types []string
+	for _, e := range stop() {
+		types = append(types, string(e.Type)+" "+e.Stage)
+	}
+	want := []string{
+		"runStarted ",
+		"stageStarted crawl", "videoDiscovered crawl", "videoDiscovered crawl", "videoDiscovered crawl", "stageFinished crawl",
+		"stageStarted resolve", "urlResolved resolve", "urlResolved resolve", "error resolve", "stageFinished resolve",
+		"stageStarted download", "downloaded download", "downloaded download", "stageFinished download",
+		"runFinished ",
+	}
+	if strings.Join(types, ",") != strings.Join(want, ",") {
+		t.Errorf("events = %q", types)
+	}
+
+	counts, _ := store.CountByStatus()
+	if counts[StatusDownloaded] != 2 || counts[StatusFailed] != 1 {
+		t.Errorf("counts = %v", counts)
+	}
+	data, err := os.ReadFile(filepath.Join(conf.DownloadPath, "牛歌戏", "第一集.mp4"))
+	if err != nil || string(data) != "video /1.mp4" {
+		t.Errorf("第一集.mp4 = %q, %v", data, err)
+	}
+	failed, _ := store.ListByStatus(context.Background(), StatusFailed)
+	if len(failed) != 1 || !strings.Contains(failed[0].ErrorMsg, "视频不存在") {
+		t.Errorf("failed = %+v", failed)
+	}
+
+	// 再次运行时不会重复保存和下载
+	if err = s.Run(context.Background(), conf); !errors.Is(err, errResolveFailed) {
+		t.Fatalf("Run err = %v", err)
+	}
+	list, _ := store.List()
+	if len(list) != 3 {
+		t.Errorf("videos = %d", len(list))
+	}
+	if snap := s.stats.Snapshot(); snap.TotalFiles != 0 {
+		t.Errorf("second run downloaded %d files", snap.TotalFiles)
+	}
+
+	// 本地文件被删除的已下载视频重新下载
+	if err = os.Remove(filepath.Join(conf.DownloadPath, "牛歌戏", "第一集.mp4")); err != nil {
+		t.Fatal(err)
+	}
+	if err = s.Run(context.Background(), conf); !errors.Is(err, errResolveFailed) {
+		t.Fatalf("Run err = %v", err)
+	}
+	if snap := s.stats.Snapshot(); snap.TotalFiles != 1 || snap.DownloadedFiles != 1 {
+		t.Errorf("third run = %+v", snap)
+	}
+	if data, err := os.ReadFile(filepath.Join(conf.DownloadPath, "牛歌戏", "第一集.mp4")); err != nil || string(data) != "video /1.mp4" {
+		t.Errorf("第一集.mp4 = %q, %v", data, err)
+	}
+	v, _ := store.findByWebUrl(context.Background(), "https://fake.test/v/1")
+	events, _ := store.ListEvents(v.ID)
+	var requeued bool
+	for _, e := range events {
+		requeued = requeued || (e.From == StatusDownloaded && e.To == StatusQueued && strings.Contains(e.Reason, "本地文件不存在"))
+	}
+	if v.Status != StatusDownloaded || !requeued {
+		t.Errorf("status = %s, events = %+v", v.Status, events)
+	}
+}
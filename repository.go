@@ -0,0 +1,71 @@
+package main
+
+import "context"
+
+// Repository 视频、频道、运行记录的存储，Store 保存到数据库，MemoryStore 保存在内存中用于测试
+type Repository interface {
+	// Save 新增视频，保存后 ID 会写回 media
+	Save(media []Video) error
+	List() ([]Video, error)
+	// ListPage 按ID分页查询，同时返回总数
+	ListPage(ctx context.Context, offset, limit int) ([]Video, int64, error)
+	GetVideo(id uint) (Video, error)
+	// Update 保存非零值的字段，状态只能通过 Transition 修改
+	Update(v Video) error
+	// UpdateDownload 保存下载结果，零值也会写入
+	UpdateDownload(v Video) error
+	// UpdateResolve 保存获取下载地址的结果，零值也会写入
+	UpdateResolve(v Video) error
+	UpdateSaveName(id uint, name string) error
+	// UpdateSeries 保存识别的剧名和集数，零值也会写入
+	UpdateSeries(v Video) error
+	// UpdateFileSuffix 保存文件名重复时加的序号
+	UpdateFileSuffix(id uint, n int) error
+	findByWebUrl(ctx context.Context, weburl string) (Video, error)
+
+	// Transition 切换视频的状态，不允许的切换返回 *TransitionError
+	Transition(id uint, to VideoStatus, reason string) error
+	// ListByStatus 指定状态的视频，按ID排列。代替了旧版的 GetEmptyDownload：
+	// 还没有下载地址的视频为 ListByStatus(ctx, StatusDiscovered, StatusFailed)，
+	// 有地址等待下载的视频为 ListByStatus(ctx, StatusResolved, StatusQueued, StatusFailed)
+	ListByStatus(ctx context.Context, statuses ...VideoStatus) ([]Video, error)
+	CountByStatus() (map[VideoStatus]int64, error)
+	ListEvents(videoID uint) ([]VideoEvent, error)
+
+	ListChannels() ([]Channel, error)
+	// SaveChannel 新增或修改频道，零值也会写入
+	SaveChannel(c *Channel) error
+	GetChannel(id uint) (Channel, error)
+	// DeleteChannel 删除频道，频道的视频标记为已删除
+	DeleteChannel(id uint) error
+	findChannelByUrl(url string) (Channel, error)
+	// AssignChannel 没有所属频道的视频归到指定的频道
+	AssignChannel(channelID uint) error
+
+	SaveRun(r *RunHistory) error
+	// ListRuns 最近的运行记录，limit 为0时返回全部
+	ListRuns(limit int) ([]RunHistory, error)
+}
+
+var (
+	_ Repository = (*Store)(nil)
+	_ Repository = (*MemoryStore)(nil)
+)
+
+// recoverInterrupted 上一次运行被强制结束时，把停在中间状态的视频恢复到前一个状态
+func recoverInterrupted(ctx context.Context, store Repository) error {
+	videos, err := store.ListByStatus(ctx, StatusResolving, StatusDownloading)
+	if err != nil {
+		return err
+	}
+	for i := range videos {
+		to := StatusDiscovered
+		if videos[i].Status == StatusDownloading {
+			to = StatusQueued
+		}
+		if err = store.Transition(videos[i].ID, to, "上一次运行被中断"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
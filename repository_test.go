@@ -0,0 +1,232 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// testRepositories 同一组测试在数据库和内存两种实现上运行，保证行为一致
+func testRepositories(t *testing.T, test func(t *testing.T, store Repository)) {
+	t.Run("gorm", func(t *testing.T) { test(t, newTestStore(t)) })
+	t.Run("memory", func(t *testing.T) { test(t, NewMemoryStore()) })
+}
+
+func TestRepositoryTransition(t *testing.T)   { testRepositories(t, testTransition) }
+func TestRepositoryListByStatus(t *testing.T) { testRepositories(t, testListByStatus) }
+func TestRepositoryUpdate(t *testing.T)       { testRepositories(t, testUpdate) }
+func TestRepositoryListPage(t *testing.T)     { testRepositories(t, testListPage) }
+func TestRepositoryChannels(t *testing.T)     { testRepositories(t, testChannels) }
+func TestRepositoryRuns(t *testing.T)         { testRepositories(t, testRuns) }
+
+func testTransition(t *testing.T, store Repository) {
+	v := Video{WebUrl: "https://a", SaveName: "a", NeedDownload: true, Status: StatusDiscovered}
+	if err := store.Save([]Video{v}); err != nil {
+		t.Fatal(err)
+	}
+	list, _ := store.List()
+	id := list[0].ID
+
+	for _, to := range []VideoStatus{StatusResolving, StatusResolved, StatusQueued, StatusDownloading, StatusDownloaded} {
+		if err := store.Transition(id, to, "test"); err != nil {
+			t.Fatalf("-> %s: %v", to, err)
+		}
+	}
+	var terr *TransitionError
+	if err := store.Transition(id, StatusDownloading, ""); !errors.As(err, &terr) {
+		t.Fatalf("downloaded -> downloading: err = %v", err)
+	}
+
+	events, err := store.ListEvents(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 5 || events[0].From != StatusDiscovered || events[4].To != StatusDownloaded {
+		t.Errorf("events = %+v", events)
+	}
+	got, _ := store.GetVideo(id)
+	if got.Status != StatusDownloaded || got.StatusAt == nil {
+		t.Errorf("video = %s %v", got.Status, got.StatusAt)
+	}
+
+	// skipped 时同步 need_download
+	if err = store.Transition(id, StatusSkipped, ""); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ = store.GetVideo(id); got.NeedDownload {
+		t.Error("skipped video should not need download")
+	}
+	if err = store.Transition(id, StatusResolved, ""); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ = store.GetVideo(id); !got.NeedDownload {
+		t.Error("restored video should need download")
+	}
+}
+
+func testListByStatus(t *testing.T, store Repository) {
+	err := store.Save([]Video{
+		{WebUrl: "https://a", Status: StatusDiscovered},
+		{WebUrl: "https://b", Status: StatusResolved},
+		{WebUrl: "https://c", Status: StatusDownloading},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	list, err := store.ListByStatus(context.Background(), StatusDiscovered, StatusResolved)
+	if err != nil || len(list) != 2 {
+		t.Fatalf("list = %v, %v", list, err)
+	}
+
+	if err = recoverInterrupted(context.Background(), store); err != nil {
+		t.Fatal(err)
+	}
+	counts, err := store.CountByStatus()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if counts[StatusDownloading] != 0 || counts[StatusQueued] != 1 || counts[StatusDiscovered] != 1 {
+		t.Errorf("counts = %v", counts)
+	}
+}
+
+func testUpdate(t *testing.T, store Repository) {
+	videos := []Video{{WebUrl: "https://a", SaveName: "a", NeedDownload: true, Status: StatusDiscovered}}
+	if err := store.Save(videos); err != nil {
+		t.Fatal(err)
+	}
+	id := videos[0].ID
+	if id == 0 {
+		t.Fatal("Save should set ID")
+	}
+	if err := store.Save([]Video{{WebUrl: "https://a"}}); err == nil {
+		t.Error("duplicate web_url should be rejected")
+	}
+
+	// Update 不写入零值，也不修改状态
+	if err := store.Update(Video{Model: videos[0].Model, WebDownloadUrl: "https://cdn/a", Status: StatusDownloaded}); err != nil {
+		t.Fatal(err)
+	}
+	got, _ := store.GetVideo(id)
+	if got.SaveName != "a" || got.WebDownloadUrl != "https://cdn/a" || got.Status != StatusDiscovered {
+		t.Errorf("after Update: %+v", got)
+	}
+
+	// UpdateDownload、UpdateResolve 会写入零值
+	now := time.Now()
+	got.DownloadErr, got.PartialSize, got.LastDownloadAt = "x", 10, &now
+	if err := store.UpdateDownload(got); err != nil {
+		t.Fatal(err)
+	}
+	got.DownloadErr, got.PartialSize = "", 0
+	if err := store.UpdateDownload(got); err != nil {
+		t.Fatal(err)
+	}
+	got.WebDownloadUrl, got.ErrorMsg = "", "failed"
+	if err := store.UpdateResolve(got); err != nil {
+		t.Fatal(err)
+	}
+	got, _ = store.GetVideo(id)
+	if got.DownloadErr != "" || got.PartialSize != 0 || got.LastDownloadAt == nil || got.WebDownloadUrl != "" || got.ErrorMsg != "failed" {
+		t.Errorf("after UpdateDownload/UpdateResolve: %+v", got)
+	}
+
+	if err := store.UpdateSaveName(id, "b"); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := store.findByWebUrl(context.Background(), "https://a"); err != nil || got.SaveName != "b" {
+		t.Errorf("findByWebUrl = %+v, %v", got, err)
+	}
+
+	// UpdateSeries 会写入零值
+	got.Series, got.Episode = "a", 3
+	if err := store.UpdateSeries(got); err != nil {
+		t.Fatal(err)
+	}
+	got.Series, got.Episode, got.Part = "a", 0, 1
+	if err := store.UpdateSeries(got); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ = store.GetVideo(id); got.Series != "a" || got.Episode != 0 || got.Part != 1 || got.SaveName != "b" {
+		t.Errorf("after UpdateSeries: %+v", got)
+	}
+	if err := store.UpdateFileSuffix(id, 2); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ = store.GetVideo(id); got.FileSuffix != 2 {
+		t.Errorf("FileSuffix = %d", got.FileSuffix)
+	}
+	if _, err := store.GetVideo(id + 100); err == nil {
+		t.Error("GetVideo should fail for missing id")
+	}
+}
+
+func testListPage(t *testing.T, store Repository) {
+	var videos []Video
+	for _, u := range []string{"https://a", "https://b", "https://c", "https://d", "https://e"} {
+		videos = append(videos, Video{WebUrl: u, Status: StatusDiscovered})
+	}
+	if err := store.Save(videos); err != nil {
+		t.Fatal(err)
+	}
+	page, total, err := store.ListPage(context.Background(), 1, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if total != 5 || len(page) != 2 || page[0].WebUrl != "https://b" || page[1].WebUrl != "https://c" {
+		t.Errorf("page = %+v, total = %d", page, total)
+	}
+	if page, _, _ = store.ListPage(context.Background(), 4, 10); len(page) != 1 {
+		t.Errorf("last page = %d items", len(page))
+	}
+}
+
+func testChannels(t *testing.T, store Repository) {
+	ch := Channel{Url: "https://www.ixigua.com/home/1/", Name: "a", Enabled: true}
+	if err := store.SaveChannel(&ch); err != nil || ch.ID == 0 {
+		t.Fatalf("SaveChannel = %v, id %d", err, ch.ID)
+	}
+	ch.Enabled = false
+	if err := store.SaveChannel(&ch); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := store.GetChannel(ch.ID); err != nil || got.Enabled {
+		t.Errorf("GetChannel = %+v, %v", got, err)
+	}
+	if got, err := store.findChannelByUrl(ch.Url); err != nil || got.ID != ch.ID {
+		t.Errorf("findChannelByUrl = %+v, %v", got, err)
+	}
+
+	videos := []Video{{WebUrl: "https://a", Status: StatusDiscovered}, {WebUrl: "https://b", Status: StatusDiscovered}}
+	if err := store.Save(videos); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.AssignChannel(ch.ID); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.DeleteChannel(ch.ID); err != nil {
+		t.Fatal(err)
+	}
+	list, _ := store.List()
+	for _, v := range list {
+		if v.ChannelID != ch.ID || v.Status != StatusRemoved {
+			t.Errorf("video after DeleteChannel: channel %d status %s", v.ChannelID, v.Status)
+		}
+	}
+	if channels, _ := store.ListChannels(); len(channels) != 0 {
+		t.Errorf("channels = %+v", channels)
+	}
+}
+
+func testRuns(t *testing.T, store Repository) {
+	for i := 0; i < 3; i++ {
+		if err := store.SaveRun(&RunHistory{StartedAt: time.Now(), Trigger: TriggerCLI, Downloaded: int64(i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	runs, err := store.ListRuns(2)
+	if err != nil || len(runs) != 2 || runs[0].Downloaded != 2 {
+		t.Errorf("runs = %+v, %v", runs, err)
+	}
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"syscall"
+	"time"
+)
+
+// RetryPolicy 获取下载地址、下载文件失败时的重试策略
+type RetryPolicy struct {
+	MaxAttempts int `json:"maxAttempts"` // 最多尝试次数，包括第一次
+	BaseDelay   int `json:"baseDelay"`   // 第一次重试前等待的秒数，之后每次翻倍
+	MaxDelay    int `json:"maxDelay"`    // 最长等待秒数
+}
+
+// DefaultRetryPolicy 配置文件中没有 retry 时使用
+func DefaultRetryPolicy() RetryPolicy {
+	return RetryPolicy{MaxAttempts: 3, BaseDelay: 2, MaxDelay: 30}
+}
+
+// HTTPError 服务器返回了错误的状态码
+type HTTPError struct {
+	StatusCode int
+	Status     string
+}
+
+func (e *HTTPError) Error() string {
+	return fmt.Sprintf("httpcode: %d, status: %s", e.StatusCode, e.Status)
+}
+
+// Retryable 判断错误是否值得重试：
+// 5xx、408、429、超时、连接被重置、下载不完整 重试；
+// 404、403 等其他 4xx、无效的地址、被取消 不重试；
+// 其他未知错误（比如解析库返回的错误）默认重试。
+func Retryable(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) {
+		return false
+	}
+	var httpErr *HTTPError
+	if errors.As(err, &httpErr) {
+		switch {
+		case httpErr.StatusCode >= 500:
+			return true
+		case httpErr.StatusCode == http.StatusRequestTimeout, httpErr.StatusCode == http.StatusTooManyRequests:
+			return true
+		default:
+			return false
+		}
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+	if errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.ECONNABORTED) ||
+		errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, errIncomplete) {
+		return true
+	}
+	var urlErr *url.Error
+	if errors.As(err, &urlErr) && urlErr.Op == "parse" {
+		// 地址本身有问题
+		return false
+	}
+	return true
+}
+
+// Do 执行 fn，失败时按策略等待后重试，返回实际尝试的次数
+func (p RetryPolicy) Do(ctx context.Context, name string, fn func() error) (int, error) {
+	maxAttempts := p.MaxAttempts
+	if maxAttempts <= 0 {
+		maxAttempts = 1
+	}
+	var err error
+	for attempt := 1; ; attempt++ {
+		err = fn()
+		if err == nil {
+			return attempt, nil
+		}
+		if ctx.Err() != nil {
+			return attempt, errors.Join(err, ctx.Err())
+		}
+		if attempt >= maxAttempts || !Retryable(err) {
+			return attempt, err
+		}
+		delay := p.backoff(attempt)
+		log.Println(name, "第", attempt, "次失败:", err, "，", delay, "后重试")
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return attempt, errors.Join(err, ctx.Err())
+		case <-timer.C:
+		}
+	}
+}
+
+// backoff 第 attempt 次失败后的等待时间，指数增长并加上随机抖动，避免多个协程同时重试
+func (p RetryPolicy) backoff(attempt int) time.Duration {
+	base := time.Duration(p.BaseDelay) * time.Second
+	if base <= 0 {
+		return 0
+	}
+	maxDelay := time.Duration(p.MaxDelay) * time.Second
+	d := base
+	for i := 1; i < attempt && (maxDelay <= 0 || d < maxDelay); i++ {
+		d *= 2
+	}
+	if maxDelay > 0 && d > maxDelay {
+		d = maxDelay
+	}
+	// 在 [d/2, d] 之间随机
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
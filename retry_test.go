@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+func TestRetryable(t *testing.T) {
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{&HTTPError{StatusCode: 500}, true},
+		{&HTTPError{StatusCode: 503}, true},
+		{&HTTPError{StatusCode: 429}, true},
+		{&HTTPError{StatusCode: 404}, false},
+		{&HTTPError{StatusCode: 403}, false},
+		{fmt.Errorf("下载: %w", syscall.ECONNRESET), true},
+		{context.DeadlineExceeded, true},
+		{context.Canceled, false},
+		{errIncomplete, true},
+	}
+	for _, tt := range tests {
+		if got := Retryable(tt.err); got != tt.want {
+			t.Errorf("Retryable(%v) = %v, want %v", tt.err, got, tt.want)
+		}
+	}
+}
+
+func TestRetryDownloadFile(t *testing.T) {
+	content := testContent()
+	var requests int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		switch {
+		case r.URL.Path == "/missing":
+			http.NotFound(w, r)
+		case requests < 3:
+			http.Error(w, "busy", http.StatusServiceUnavailable)
+		default:
+			_, _ = w.Write(content)
+		}
+	}))
+	defer srv.Close()
+
+	p := RetryPolicy{MaxAttempts: 3}
+	s := &Server{}
+	d := &Download{Url: srv.URL, Path: filepath.Join(t.TempDir(), "a.mp4"), Title: "a.mp4"}
+	attempts, err := p.Do(context.Background(), "下载", func() error {
+		return s.DownloadFile(context.Background(), d)
+	})
+	if err != nil || attempts != 3 {
+		t.Errorf("attempts = %d, err = %v, 期望第3次成功", attempts, err)
+	}
+
+	requests = 0
+	d = &Download{Url: srv.URL + "/missing", Path: filepath.Join(t.TempDir(), "b.mp4"), Title: "b.mp4"}
+	attempts, err = p.Do(context.Background(), "下载", func() error {
+		return s.DownloadFile(context.Background(), d)
+	})
+	var httpErr *HTTPError
+	if !errors.As(err, &httpErr) || attempts != 1 {
+		t.Errorf("404 不应该重试: attempts = %d, err = %v", attempts, err)
+	}
+}
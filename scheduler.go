@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/robfig/cron/v3"
+)
+
+// 运行记录的触发方式
+const (
+	TriggerManual   = "manual"
+	TriggerSchedule = "schedule"
+	TriggerCLI      = "cli"
+	TriggerAPI      = "api"
+)
+
+// 运行记录的结果
+const (
+	RunSuccess  = "success"
+	RunFailed   = "failed"
+	RunSkipped  = "skipped"
+	RunCanceled = "canceled"
+)
+
+// ParseSchedule 解析定时配置，支持时间间隔（6h、30m）、@every 6h、@daily 以及标准的5位 cron 表达式
+func ParseSchedule(expr string) (cron.Schedule, error) {
+	if d, err := time.ParseDuration(expr); err == nil {
+		if d < time.Minute {
+			return nil, errors.New("时间间隔不能小于1分钟")
+		}
+		return cron.Every(d), nil
+	}
+	return cron.ParseStandard(expr)
+}
+
+// RunWithHistory 执行一次任务并保存运行记录，上一次任务还没有结束时记录为跳过
+func (s *Server) RunWithHistory(ctx context.Context, conf Conf, trigger string) error {
+	if err := s.openStore(conf); err != nil {
+		return err
+	}
+	run := RunHistory{StartedAt: time.Now(), Trigger: trigger}
+	err := s.Run(ctx, conf)
+	run.FinishedAt = time.Now()
+
+	snap := s.stats.Snapshot()
+	switch {
+	case errors.Is(err, errRunning):
+		run.Status = RunSkipped
+	case errors.Is(err, context.Canceled):
+		run.Status = RunCanceled
+	case err != nil:
+		run.Status = RunFailed
+	case snap.FailedFiles > 0:
+		run.Status = RunFailed
+	default:
+		run.Status = RunSuccess
+	}
+	if run.Status != RunSkipped {
+		run.Downloaded = snap.DownloadedFiles
+		run.Failed = snap.FailedFiles
+	}
+	if err != nil {
+		run.Error = truncate(err.Error(), 512)
+	}
+	if saveErr := s.store.SaveRun(&run); saveErr != nil {
+		log.Println("保存运行记录错误", saveErr)
+	}
+	return err
+}
+
+// Scheduler 按配置的时间定期执行 获取链接、填充地址、下载文件
+type Scheduler struct {
+	s        *Server
+	conf     Conf
+	schedule cron.Schedule
+}
+
+func NewScheduler(s *Server, conf Conf) (*Scheduler, error) {
+	schedule, err := ParseSchedule(conf.Schedule)
+	if err != nil {
+		return nil, err
+	}
+	conf.GetUrl, conf.FillUrl, conf.Download = true, true, true
+	return &Scheduler{s: s, conf: conf, schedule: schedule}, nil
+}
+
+// Start 一直运行到 ctx 被取消，正在运行的任务也会被取消
+func (sc *Scheduler) Start(ctx context.Context) {
+	for {
+		next := sc.schedule.Next(time.Now())
+		log.Println("下一次定时同步", next.Format("2006-01-02 15:04:05"))
+		timer := time.NewTimer(time.Until(next))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+
+		log.Println("开始定时同步")
+		err := sc.s.RunWithHistory(ctx, sc.conf, TriggerSchedule)
+		switch {
+		case errors.Is(err, errRunning):
+			log.Println("上一次任务还没有结束，跳过这次定时同步")
+		case err != nil:
+			log.Println("定时同步失败", err)
+		default:
+			log.Println("定时同步完成")
+		}
+	}
+}
+
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	// 不截断在多字节字符的中间
+	for n > 0 && s[n]&0xC0 == 0x80 {
+		n--
+	}
+	return s[:n]
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseSchedule(t *testing.T) {
+	now := time.Date(2024, 1, 1, 10, 30, 0, 0, time.Local)
+	cases := []struct {
+		expr string
+		next time.Time
+	}{
+		{"6h", now.Add(6 * time.Hour)},
+		{"@every 30m", now.Add(30 * time.Minute)},
+		{"@daily", time.Date(2024, 1, 2, 0, 0, 0, 0, time.Local)},
+		{"0 3 * * *", time.Date(2024, 1, 2, 3, 0, 0, 0, time.Local)},
+	}
+	for _, c := range cases {
+		sched, err := ParseSchedule(c.expr)
+		if err != nil {
+			t.Fatalf("%q: %v", c.expr, err)
+		}
+		if next := sched.Next(now); !next.Equal(c.next) {
+			t.Errorf("%q: next = %v, want %v", c.expr, next, c.next)
+		}
+	}
+
+	for _, expr := range []string{"10s", "abc", "* * *"} {
+		if _, err := ParseSchedule(expr); err == nil {
+			t.Errorf("%q: expected error", expr)
+		}
+	}
+}
+
+func TestTruncate(t *testing.T) {
+	if got := truncate("下载失败", 4); got != "下" {
+		t.Errorf("truncate = %q", got)
+	}
+	if got := truncate("abc", 10); got != "abc" {
+		t.Errorf("truncate = %q", got)
+	}
+}
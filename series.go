@@ -0,0 +1,286 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// EpisodeInfo 从标题中识别出的剧名和集数
+type EpisodeInfo struct {
+	Series   string // 剧名
+	Part     int    // 第几部，上、中、下 为 1、2、3，0 为没有
+	Episode  int    // 第几集，0 为没有识别到
+	Subtitle string // 集数后面的副标题
+}
+
+var (
+	// partPattern 第2部、上部、下集 这样的分部
+	partPattern = regexp.MustCompile(`第(\d+)部|([上中下])(?:部|集|本|篇)?`)
+	// episodePattern 第3集、第3节、第3场、第3回、3集
+	episodePattern = regexp.MustCompile(`第?(\d+)[集节场回]|第(\d+)`)
+	// parenPattern 剧名(3)、剧名（三）
+	parenPattern = regexp.MustCompile(`[（(](\d+|[零〇一二两三四五六七八九十百]+)[）)]`)
+	// trailingPattern 剧名21 这样直接跟在后面的数字，最多3位，避免把年份当成集数
+	trailingPattern = regexp.MustCompile(`\D(\d{1,3})$`)
+)
+
+// seriesTrim 剧名、副标题首尾需要去掉的分隔符
+const seriesTrim = " \t-_—–:：·.、,，|/" + defaultBrackets
+
+var partNames = map[string]int{"上": 1, "中": 2, "下": 3}
+
+// ParseEpisode 从整理后的标题中识别剧名、第几部、第几集和副标题，中文数字会先转换为阿拉伯数字。
+// 没有识别到集数时整个标题为剧名
+func ParseEpisode(title string) EpisodeInfo {
+	t := strings.TrimSpace(convertNumerals(title))
+	var info EpisodeInfo
+	start, end := len(t), 0
+	mark := func(loc []int) {
+		if loc[0] < start {
+			start = loc[0]
+		}
+		if loc[1] > end {
+			end = loc[1]
+		}
+	}
+
+	for _, loc := range episodePattern.FindAllStringSubmatchIndex(t, -1) {
+		n := loc[2:4]
+		if n[0] < 0 {
+			// 第2部 是分部，不是集数
+			if n = loc[4:6]; strings.HasPrefix(t[loc[1]:], "部") {
+				continue
+			}
+		}
+		info.Episode, _ = strconv.Atoi(t[n[0]:n[1]])
+		mark(loc)
+		break
+	}
+	if info.Episode == 0 {
+		if loc := parenPattern.FindStringSubmatchIndex(t); loc != nil {
+			if n, ok := ChineseToArabic(t[loc[2]:loc[3]]); ok {
+				info.Episode = n
+			} else {
+				info.Episode, _ = strconv.Atoi(t[loc[2]:loc[3]])
+			}
+			mark(loc)
+		}
+	}
+
+	for _, loc := range partPattern.FindAllStringSubmatchIndex(t, -1) {
+		if loc[2] >= 0 {
+			info.Part, _ = strconv.Atoi(t[loc[2]:loc[3]])
+			mark(loc)
+			break
+		}
+		// 上、中、下 可能是剧名的一部分（上门女婿），只有后面跟着 部、集 或者在标题末尾时才是分部，
+		// 有集数时是一集的上下部分，留在副标题中
+		if info.Episode == 0 && (loc[1] > loc[5] || loc[1] == len(t)) {
+			info.Part = partNames[t[loc[4]:loc[5]]]
+			mark(loc)
+			break
+		}
+	}
+
+	if info.Episode == 0 && info.Part == 0 {
+		if loc := trailingPattern.FindStringSubmatchIndex(t); loc != nil {
+			info.Episode, _ = strconv.Atoi(t[loc[2]:loc[3]])
+			mark(loc[2:4])
+		}
+	}
+
+	if start > end {
+		info.Series = strings.Trim(t, seriesTrim)
+		return info
+	}
+	info.Series = strings.Trim(t[:start], seriesTrim)
+	info.Subtitle = strings.Trim(t[end:], seriesTrim)
+	// 第3集 这样以集数开头的标题，后面的内容作为剧名
+	if info.Series == "" {
+		info.Series, info.Subtitle = info.Subtitle, ""
+	}
+	return info
+}
+
+// applyTo 把识别结果保存到视频的字段中
+func (info EpisodeInfo) applyTo(v *Video) {
+	v.Series, v.Part, v.Episode, v.Subtitle = info.Series, info.Part, info.Episode, info.Subtitle
+}
+
+// EpisodeLabel 第几部、第几集的显示名称
+func EpisodeLabel(part, episode int) string {
+	var b strings.Builder
+	switch {
+	case part > 0 && part <= 3 && episode == 0:
+		b.WriteString([]string{"", "上", "中", "下"}[part])
+	case part > 0:
+		fmt.Fprintf(&b, "第%d部", part)
+	}
+	if episode > 0 {
+		fmt.Fprintf(&b, "第%d集", episode)
+	}
+	return b.String()
+}
+
+// DetectSeries 按现在的名称规则识别剧名和集数，all 为 false 时只处理还没有识别过的视频，返回有变化的个数
+func (s *Server) DetectSeries(ctx context.Context, conf Conf, all bool) (int, error) {
+	if err := s.openStore(conf); err != nil {
+		return 0, err
+	}
+	list, err := s.store.List()
+	if err != nil {
+		return 0, err
+	}
+	channels, err := s.store.ListChannels()
+	if err != nil {
+		return 0, err
+	}
+	pipelines := make(map[uint]*TitlePipeline, len(channels))
+	for _, ch := range channels {
+		if pipelines[ch.ID], err = titlePipeline(conf.TitleRules, ch); err != nil {
+			return 0, err
+		}
+	}
+	defaults, err := CompileTitleRules(conf.TitleRules)
+	if err != nil {
+		return 0, err
+	}
+	paths, err := s.videoPaths(conf)
+	if err != nil {
+		return 0, err
+	}
+
+	var n int
+	for _, v := range list {
+		if ctx.Err() != nil {
+			return n, ctx.Err()
+		}
+		if v.OriginName == "" || (!all && v.Series != "") {
+			continue
+		}
+		p, ok := pipelines[v.ChannelID]
+		if !ok {
+			p = defaults
+		}
+		before := v
+		ParseEpisode(firstNonEmpty(p.Apply(v.OriginName), v.OriginName)).applyTo(&v)
+		if before.Series == v.Series && before.Part == v.Part && before.Episode == v.Episode && before.Subtitle == v.Subtitle {
+			continue
+		}
+		// 保存路径模板用到了剧名、集数时，已经下载的文件一起移动
+		if conf.DownloadPath != "" {
+			if _, err = moveVideoFile(paths.File(before), paths.File(v)); err != nil {
+				log.Println("移动文件失败", v.SaveName, err)
+				continue
+			}
+		}
+		if err = s.store.UpdateSeries(v); err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, nil
+}
+
+// Episode 一个剧中的第几部第几集
+type Episode struct {
+	Part, Episode int
+}
+
+func (e Episode) String() string {
+	return EpisodeLabel(e.Part, e.Episode)
+}
+
+// SeriesGroup 同一个剧名的视频
+type SeriesGroup struct {
+	Series     string
+	Items      []LibraryItem // 按第几部、第几集排列
+	Downloaded int
+	Missing    []Episode // 中间缺少的集数，例如一共8集时没有第4集
+}
+
+// GroupSeries 按剧名分组，组内按集数排列，并找出每一部中缺少的集数
+func GroupSeries(items []LibraryItem) []SeriesGroup {
+	index := make(map[string]int)
+	var groups []SeriesGroup
+	for _, item := range items {
+		name := firstNonEmpty(item.Series, item.SaveName)
+		i, ok := index[name]
+		if !ok {
+			i = len(groups)
+			index[name] = i
+			groups = append(groups, SeriesGroup{Series: name})
+		}
+		groups[i].Items = append(groups[i].Items, item)
+		if item.Status == StatusDownloaded {
+			groups[i].Downloaded++
+		}
+	}
+	for i := range groups {
+		g := &groups[i]
+		sortEpisodes(g.Items)
+		g.Missing = missingEpisodes(g.Items)
+	}
+	sort.SliceStable(groups, func(i, j int) bool { return groups[i].Series < groups[j].Series })
+	return groups
+}
+
+// sortEpisodes 按第几部、第几集排列，没有集数的放在最后
+func sortEpisodes(items []LibraryItem) {
+	sort.SliceStable(items, func(i, j int) bool {
+		a, b := items[i], items[j]
+		if a.Part != b.Part {
+			return a.Part < b.Part
+		}
+		if (a.Episode == 0) != (b.Episode == 0) {
+			return b.Episode == 0
+		}
+		if a.Episode != b.Episode {
+			return a.Episode < b.Episode
+		}
+		return a.ID < b.ID
+	})
+}
+
+// missingEpisodes 每一部从第1集到最大的集数之间没有的集数
+func missingEpisodes(items []LibraryItem) []Episode {
+	seen := make(map[Episode]bool)
+	maxEpisode := make(map[int]int)
+	for _, item := range items {
+		if item.Episode <= 0 {
+			continue
+		}
+		seen[Episode{item.Part, item.Episode}] = true
+		if item.Episode > maxEpisode[item.Part] {
+			maxEpisode[item.Part] = item.Episode
+		}
+	}
+	parts := make([]int, 0, len(maxEpisode))
+	for p := range maxEpisode {
+		parts = append(parts, p)
+	}
+	sort.Ints(parts)
+	var missing []Episode
+	for _, p := range parts {
+		for e := 1; e < maxEpisode[p]; e++ {
+			if !seen[Episode{p, e}] {
+				missing = append(missing, Episode{p, e})
+			}
+		}
+	}
+	return missing
+}
+
+// MissingText 缺少的集数，例如 第4集、第7集
+func (g SeriesGroup) MissingText() string {
+	names := make([]string, 0, len(g.Missing))
+	for _, e := range g.Missing {
+		names = append(names, e.String())
+	}
+	return strings.Join(names, "、")
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"gorm.io/gorm"
+)
+
+func TestParseEpisode(t *testing.T) {
+	tests := map[string]EpisodeInfo{
+		"妹仔想当主人婆第11集":      {Series: "妹仔想当主人婆", Episode: 11},
+		"妹仔想当主人婆 第十一集 大结局": {Series: "妹仔想当主人婆", Episode: 11, Subtitle: "大结局"},
+		"三看亲家（3）":          {Series: "三看亲家", Episode: 3},
+		"三看亲家(三)":          {Series: "三看亲家", Episode: 3},
+		"双喜临门第2部第5集":       {Series: "双喜临门", Part: 2, Episode: 5},
+		"双喜临门第二部":          {Series: "双喜临门", Part: 2},
+		"上门女婿下集":           {Series: "上门女婿", Part: 3},
+		"上门女婿 下":           {Series: "上门女婿", Part: 3},
+		"上门女婿第3集(下)":       {Series: "上门女婿", Episode: 3, Subtitle: "下"},
+		"卖杂货21":            {Series: "卖杂货", Episode: 21},
+		"第一集 妹仔想当主人婆":      {Series: "妹仔想当主人婆", Episode: 1},
+		"2023年春节晚会":        {Series: "2023年春节晚会"},
+		"没有集数的标题":          {Series: "没有集数的标题"},
+		"妹仔想当主人婆-第8集-婆媳和好": {Series: "妹仔想当主人婆", Episode: 8, Subtitle: "婆媳和好"},
+	}
+	for title, want := range tests {
+		if got := ParseEpisode(title); got != want {
+			t.Errorf("ParseEpisode(%q) = %+v, want %+v", title, got, want)
+		}
+	}
+}
+
+func seriesItem(id uint, series string, part, episode int, status VideoStatus) LibraryItem {
+	return LibraryItem{Video: Video{Model: gorm.Model{ID: id}, SaveName: series, Series: series, Part: part, Episode: episode, Status: status}}
+}
+
+func TestGroupSeries(t *testing.T) {
+	var items []LibraryItem
+	for _, e := range []int{8, 1, 2, 3, 5, 6, 7} {
+		items = append(items, seriesItem(uint(e), "妹仔想当主人婆", 0, e, StatusDownloaded))
+	}
+	items = append(items,
+		seriesItem(20, "双喜临门", 1, 1, StatusResolved),
+		seriesItem(21, "双喜临门", 2, 2, StatusDownloaded),
+		seriesItem(22, "双喜临门", 1, 2, StatusResolved),
+		seriesItem(23, "双喜临门", 0, 0, StatusResolved),
+	)
+	groups := GroupSeries(items)
+	if len(groups) != 2 {
+		t.Fatalf("groups = %d", len(groups))
+	}
+
+	g := groups[1]
+	if g.Series != "妹仔想当主人婆" || len(g.Items) != 7 || g.Downloaded != 7 {
+		t.Fatalf("group = %s %d %d", g.Series, len(g.Items), g.Downloaded)
+	}
+	if g.MissingText() != "第4集" {
+		t.Errorf("missing = %q", g.MissingText())
+	}
+	for i, item := range g.Items[:3] {
+		if item.Episode != i+1 {
+			t.Errorf("items[%d].Episode = %d", i, item.Episode)
+		}
+	}
+
+	g = groups[0]
+	if g.MissingText() != "第2部第1集" {
+		t.Errorf("missing = %q", g.MissingText())
+	}
+	if last := g.Items[len(g.Items)-1]; last.ID != 21 {
+		t.Errorf("last item = %d", last.ID)
+	}
+}
+
+func TestDetectSeries(t *testing.T) {
+	store := NewMemoryStore()
+	err := store.Save([]Video{
+		{WebUrl: "https://a/1", OriginName: "牛歌戏 三看亲家 第一集", SaveName: "三看亲家第1集"},
+		{WebUrl: "https://a/2", OriginName: "牛歌戏 三看亲家 第三集", SaveName: "三看亲家第3集", Series: "旧的剧名"},
+		{WebUrl: "https://a/3", SaveName: "导入的视频"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{store: store}
+	conf := DefaultConf()
+	conf.TitleRules = []TitleRule{{Type: RuleLiteral, Find: "牛歌戏"}, {Type: RuleTrim}}
+
+	n, err := s.DetectSeries(context.Background(), conf, false)
+	if err != nil || n != 1 {
+		t.Fatalf("DetectSeries = %d, %v", n, err)
+	}
+	if v, _ := store.GetVideo(1); v.Series != "三看亲家" || v.Episode != 1 {
+		t.Errorf("video 1 = %q %d", v.Series, v.Episode)
+	}
+	if v, _ := store.GetVideo(2); v.Series != "旧的剧名" {
+		t.Errorf("video 2 should keep its series, got %q", v.Series)
+	}
+
+	if n, err = s.DetectSeries(context.Background(), conf, true); err != nil || n != 1 {
+		t.Fatalf("DetectSeries all = %d, %v", n, err)
+	}
+	if v, _ := store.GetVideo(2); v.Series != "三看亲家" || v.Episode != 3 {
+		t.Errorf("video 2 = %q %d", v.Series, v.Episode)
+	}
+}
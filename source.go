@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/wujunwei928/parse-video/parser"
+)
+
+// SourceVideo 从频道主页获取到的一个视频
+type SourceVideo struct {
+	Title   string
+	PageUrl string // 规范化后的播放页面地址
+	MUrl    string // 手机端播放页面地址，平台没有手机端页面时为空
+}
+
+// Source 视频平台，新增平台时实现这个接口并加到 sources 中
+type Source interface {
+	// Name 平台名称，保存在配置和数据库中
+	Name() string
+	// Match 判断地址是否属于这个平台
+	Match(u *url.URL) bool
+	// ListVideos 打开频道主页，返回频道的所有视频
+	ListVideos(ctx context.Context, conf Conf, channelUrl string) ([]SourceVideo, error)
+	// CanonicalUrl 把页面中的链接转换成规范的播放页面地址
+	CanonicalUrl(href string) string
+	// ResolveDownloadUrl 根据播放页面地址解析视频的下载地址
+	ResolveDownloadUrl(ctx context.Context, pageUrl string) (string, error)
+}
+
+// MobileResolver 可以打开手机端页面获取下载地址的平台
+type MobileResolver interface {
+	ResolveMobileUrl(ctx context.Context, conf Conf, mUrl string) (string, error)
+}
+
+// UploadTimer 可以从播放地址中得到上传时间的平台
+type UploadTimer interface {
+	UploadTime(pageUrl string) (time.Time, bool)
+}
+
+// sources 支持的视频平台，第一个为默认平台
+var sources = []Source{
+	xiguaSource{},
+	shareSource{name: parser.SourceDouYin, domains: []string{"douyin.com", "iesdouyin.com"}},
+	shareSource{name: parser.SourceKuaiShou, domains: []string{"kuaishou.com"}},
+}
+
+// SourceNames 返回支持的平台名称
+func SourceNames() []string {
+	names := make([]string, 0, len(sources))
+	for _, src := range sources {
+		names = append(names, src.Name())
+	}
+	return names
+}
+
+// SourceByName 按名称查找平台，名称为空时使用默认平台
+func SourceByName(name string) (Source, error) {
+	if name == "" {
+		return sources[0], nil
+	}
+	for _, src := range sources {
+		if src.Name() == name {
+			return src, nil
+		}
+	}
+	return nil, fmt.Errorf("不支持的视频平台 %q，可选 %s", name, strings.Join(SourceNames(), "、"))
+}
+
+// SourceForUrl 根据地址的域名判断所属平台
+func SourceForUrl(rawUrl string) (Source, error) {
+	u, err := url.Parse(rawUrl)
+	if err != nil {
+		return nil, err
+	}
+	for _, src := range sources {
+		if src.Match(u) {
+			return src, nil
+		}
+	}
+	return nil, fmt.Errorf("不支持的视频地址 %q", rawUrl)
+}
+
+// resolveSource 优先使用指定的平台，没有指定时根据地址判断
+func resolveSource(name, rawUrl string) (Source, error) {
+	if name != "" {
+		return SourceByName(name)
+	}
+	return SourceForUrl(rawUrl)
+}
+
+// matchDomain 判断 host 是否为 domain 或者它的子域名
+func matchDomain(host, domain string) bool {
+	return host == domain || strings.HasSuffix(host, "."+domain)
+}
+
+// shareSource 只通过 parse-video 解析分享链接的平台，没有办法获取频道的视频列表，
+// 频道地址填写单个视频的分享链接，每次只获取这一个视频
+type shareSource struct {
+	name    string
+	domains []string
+}
+
+func (p shareSource) Name() string {
+	return p.name
+}
+
+func (p shareSource) Match(u *url.URL) bool {
+	for _, domain := range p.domains {
+		if matchDomain(u.Hostname(), domain) {
+			return true
+		}
+	}
+	return false
+}
+
+func (p shareSource) ListVideos(ctx context.Context, conf Conf, channelUrl string) ([]SourceVideo, error) {
+	info, err := parser.ParseVideoShareUrl(channelUrl)
+	if err != nil {
+		return nil, err
+	}
+	if info.VideoUrl == "" {
+		return nil, errors.New("分享链接中没有视频")
+	}
+	return []SourceVideo{{Title: info.Title, PageUrl: p.CanonicalUrl(channelUrl)}}, nil
+}
+
+func (p shareSource) CanonicalUrl(href string) string {
+	return strings.TrimSpace(href)
+}
+
+func (p shareSource) ResolveDownloadUrl(ctx context.Context, pageUrl string) (string, error) {
+	info, err := parser.ParseVideoShareUrl(pageUrl)
+	if err != nil {
+		return "", err
+	}
+	return info.VideoUrl, nil
+}
+
+// validateChannel 检查频道的地址和平台
+func validateChannel(ch Channel) error {
+	u, err := url.Parse(ch.Url)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("不是有效的网址 %q", ch.Url)
+	}
+	_, err = resolveSource(ch.Source, ch.Url)
+	return err
+}
@@ -0,0 +1,47 @@
+package main
+
+import "testing"
+
+func TestSourceForUrl(t *testing.T) {
+	tests := map[string]string{
+		"https://www.ixigua.com/home/104305645109/": "xigua",
+		"https://m.ixigua.com/video/7123":           "xigua",
+		"https://v.douyin.com/iRNBho6u/":            "douyin",
+		"https://v.kuaishou.com/abc":                "kuaishou",
+	}
+	for rawUrl, want := range tests {
+		src, err := SourceForUrl(rawUrl)
+		if err != nil {
+			t.Errorf("%s: %v", rawUrl, err)
+			continue
+		}
+		if src.Name() != want {
+			t.Errorf("%s: got %s, want %s", rawUrl, src.Name(), want)
+		}
+	}
+	if _, err := SourceForUrl("https://example.com/ixigua.com"); err == nil {
+		t.Error("不支持的地址应该返回错误")
+	}
+}
+
+func TestXiguaParseList(t *testing.T) {
+	html := `<div class="userDetailV3__main__list">
+<div class="HorizontalFeedCard__contentWrapper"><div><a href="/7123456789" title="牛歌戏《白蛇后传》第一节"></a></div></div>
+<div class="HorizontalFeedCard__contentWrapper"><div><a href="/7123456790" title="牛歌戏《白蛇后传》第二节"></a></div></div>
+</div>`
+	videos, err := xiguaSource{}.parseList(html)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(videos) != 2 {
+		t.Fatalf("获取到 %d 个视频", len(videos))
+	}
+	want := SourceVideo{
+		Title:   "牛歌戏《白蛇后传》第一节",
+		PageUrl: "https://www.ixigua.com/7123456789",
+		MUrl:    "https://m.ixigua.com/video/7123456789",
+	}
+	if videos[0] != want {
+		t.Errorf("got %+v, want %+v", videos[0], want)
+	}
+}
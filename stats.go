@@ -0,0 +1,295 @@
+package main
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+const (
+	// speedWindow 速度取最近这段时间的平均值，避免忽快忽慢
+	speedWindow = 5 * time.Second
+	// speedBuckets 速度窗口分成的段数，每段记录这段时间内下载的字节数
+	speedBuckets = 10
+)
+
+// Stats 下载统计，多个下载协程会同时更新，只能通过 Snapshot 读取。
+// 所有方法都可以在不同的协程中同时调用
+type Stats struct {
+	mu              sync.Mutex
+	now             func() time.Time // 测试时替换
+	totalFiles      int64
+	downloadedFiles int64
+	failedFiles     int64
+	// 已经下载完成的文件的总大小和个数，用来估计还没有开始下载的文件的大小
+	doneBytes int64
+	doneSized int64
+	files     []*fileProgress
+	speed     speedMeter
+}
+
+// fileProgress 一个正在下载的文件，只能在 Stats 的锁中读写
+type fileProgress struct {
+	worker   int
+	file     string
+	size     int64
+	downSize int64
+	speed    speedMeter
+}
+
+// FileStats 单个正在下载的文件
+type FileStats struct {
+	Worker   int     `json:"worker"`
+	File     string  `json:"file"`
+	Size     int64   `json:"size"` // 未知时为0
+	DownSize int64   `json:"downSize"`
+	Percent  float64 `json:"percent"` // 大小未知时为0
+	Speed    float64 `json:"speed"`   // MB/s
+}
+
+// StatsSnapshot 某一时刻的下载统计
+type StatsSnapshot struct {
+	TotalFiles      int64       `json:"totalFiles"`
+	DownloadedFiles int64       `json:"downloadedFiles"` // 下载成功的文件数
+	FailedFiles     int64       `json:"failedFiles"`
+	Files           []FileStats `json:"files"` // 正在下载的文件，按 worker 编号排列
+	// DownBytes、TotalBytes 已经下载的字节数和估计的总字节数，没有开始下载的文件按已知文件的平均大小估计
+	DownBytes  int64   `json:"downBytes"`
+	TotalBytes int64   `json:"totalBytes"`
+	Percent    float64 `json:"percent"` // 按字节数计算的总进度 0-100，都不知道大小时按文件数计算
+	Speed      float64 `json:"speed"`   // 最近几秒的总速度 MB/s
+	ETA        int64   `json:"eta"`     // 预计还需要的秒数，未知时为 -1
+}
+
+// Finished 已经结束（成功或失败）的文件数
+func (snap StatsSnapshot) Finished() int64 {
+	return snap.DownloadedFiles + snap.FailedFiles
+}
+
+func (st *Stats) clock() time.Time {
+	if st.now != nil {
+		return st.now()
+	}
+	return time.Now()
+}
+
+// Reset 开始新一轮下载前清空统计
+func (st *Stats) Reset() {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.totalFiles = 0
+	st.downloadedFiles = 0
+	st.failedFiles = 0
+	st.doneBytes = 0
+	st.doneSized = 0
+	st.files = nil
+	st.speed = speedMeter{}
+}
+
+func (st *Stats) SetTotal(total int64) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.totalFiles = total
+}
+
+// FileDone 一个视频下载结束，取消的不调用
+func (st *Stats) FileDone(ok bool) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if ok {
+		st.downloadedFiles++
+	} else {
+		st.failedFiles++
+	}
+}
+
+// Begin 登记一个正在下载的文件，下载结束后需要调用 End
+func (st *Stats) Begin(worker int, file string) *fileProgress {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	now := st.clock()
+	f := &fileProgress{worker: worker, file: file}
+	f.speed.begin(now)
+	st.speed.begin(now)
+	// 按 worker 编号有序插入，界面显示的顺序保持稳定
+	i := len(st.files)
+	for i > 0 && st.files[i-1].worker > worker {
+		i--
+	}
+	st.files = append(st.files, nil)
+	copy(st.files[i+1:], st.files[i:])
+	st.files[i] = f
+	return f
+}
+
+// End 文件下载结束，ok 时记录文件大小用于估计其他文件的大小
+func (st *Stats) End(f *fileProgress, ok bool) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	for i := range st.files {
+		if st.files[i] == f {
+			st.files = append(st.files[:i], st.files[i+1:]...)
+			break
+		}
+	}
+	if ok {
+		st.doneBytes += f.downSize
+		st.doneSized++
+	}
+}
+
+// SetSize 设置文件总大小和已经下载的大小（断点续传时不为0），重新请求时调用
+func (st *Stats) SetSize(f *fileProgress, size, downSize int64) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	f.size = size
+	f.downSize = downSize
+}
+
+func (st *Stats) add(f *fileProgress, n int64) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	now := st.clock()
+	f.downSize += n
+	f.speed.add(now, n)
+	st.speed.add(now, n)
+}
+
+func (st *Stats) Snapshot() StatsSnapshot {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	now := st.clock()
+	snap := StatsSnapshot{
+		TotalFiles:      st.totalFiles,
+		DownloadedFiles: st.downloadedFiles,
+		FailedFiles:     st.failedFiles,
+		Files:           make([]FileStats, 0, len(st.files)),
+		DownBytes:       st.doneBytes,
+		TotalBytes:      st.doneBytes,
+		Speed:           st.speed.rate(now) / 1024 / 1024,
+		ETA:             -1,
+	}
+	knownBytes, known := st.doneBytes, st.doneSized
+	for _, f := range st.files {
+		fs := FileStats{Worker: f.worker, File: f.file, Size: f.size, DownSize: f.downSize, Speed: f.speed.rate(now) / 1024 / 1024}
+		if f.size > 0 {
+			fs.Percent = percent(f.downSize, f.size)
+			knownBytes += f.size
+			known++
+			snap.TotalBytes += f.size
+		} else {
+			snap.TotalBytes += f.downSize
+		}
+		snap.DownBytes += f.downSize
+		snap.Files = append(snap.Files, fs)
+	}
+	if known == 0 {
+		// 还不知道任何文件的大小，按文件数计算
+		if snap.TotalFiles > 0 {
+			snap.Percent = percent(snap.Finished(), snap.TotalFiles)
+		}
+		return snap
+	}
+	// 没有开始的和大小未知的文件按平均大小估计，失败的文件不算
+	avg := knownBytes / known
+	pending := snap.TotalFiles - snap.Finished() - int64(len(st.files))
+	if pending < 0 {
+		pending = 0
+	}
+	snap.TotalBytes += pending * avg
+	for _, f := range st.files {
+		if f.size <= 0 && f.downSize < avg {
+			snap.TotalBytes += avg - f.downSize
+		}
+	}
+	snap.Percent = percent(snap.DownBytes, snap.TotalBytes)
+	if snap.Speed > 0 {
+		snap.ETA = int64(float64(snap.TotalBytes-snap.DownBytes)/(snap.Speed*1024*1024) + 0.5)
+	}
+	return snap
+}
+
+// formatETA 剩余时间，未知时为 --
+func formatETA(seconds int64) string {
+	if seconds < 0 {
+		return "--"
+	}
+	return (time.Duration(seconds) * time.Second).String()
+}
+
+// percent 0-100，不会超过100
+func percent(n, total int64) float64 {
+	if total <= 0 {
+		return 0
+	}
+	if n >= total {
+		return 100
+	}
+	return float64(n) * 100 / float64(total)
+}
+
+// speedMeter 滑动窗口的平均速度，窗口分成 speedBuckets 段，只保留最近 speedWindow 内的字节数
+type speedMeter struct {
+	start   time.Time
+	bytes   [speedBuckets]int64
+	buckets [speedBuckets]int64 // 每一段对应的时间段编号
+}
+
+// bucketOf 时间所在的时间段编号
+func bucketOf(t time.Time) int64 {
+	return t.UnixNano() / int64(speedWindow/speedBuckets)
+}
+
+// begin 从 now 开始计算速度，已经开始时不变
+func (m *speedMeter) begin(now time.Time) {
+	if m.start.IsZero() {
+		m.start = now
+	}
+}
+
+func (m *speedMeter) add(now time.Time, n int64) {
+	m.begin(now)
+	b := bucketOf(now)
+	i := b % speedBuckets
+	if m.buckets[i] != b {
+		m.buckets[i], m.bytes[i] = b, 0
+	}
+	m.bytes[i] += n
+}
+
+// rate 最近的平均速度，字节每秒。刚开始下载不到一个窗口时按实际经过的时间计算
+func (m *speedMeter) rate(now time.Time) float64 {
+	if m.start.IsZero() {
+		return 0
+	}
+	cur := bucketOf(now)
+	var sum int64
+	for i := range m.bytes {
+		if b := m.buckets[i]; b > cur-speedBuckets && b <= cur {
+			sum += m.bytes[i]
+		}
+	}
+	elapsed := now.Sub(m.start)
+	if elapsed > speedWindow {
+		elapsed = speedWindow
+	}
+	// 至少按一段的时间计算，避免第一次写入时速度特别大
+	if least := speedWindow / speedBuckets; elapsed < least {
+		elapsed = least
+	}
+	return float64(sum) / elapsed.Seconds()
+}
+
+type statsWriter struct {
+	writer io.Writer
+	stats  *Stats
+	file   *fileProgress
+}
+
+func (sw *statsWriter) Write(p []byte) (int, error) {
+	n, err := sw.writer.Write(p)
+	if n > 0 {
+		sw.stats.add(sw.file, int64(n))
+	}
+	return n, err
+}
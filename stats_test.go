@@ -0,0 +1,157 @@
+package main
+
+import (
+	"math"
+	"sync"
+	"testing"
+	"time"
+)
+
+const mb = 1024 * 1024
+
+// fakeClock 测试用的时钟，只有调用 advance 时才会变化
+type fakeClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+func newTestStats() (*Stats, *fakeClock) {
+	clock := &fakeClock{now: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+	return &Stats{now: clock.Now}, clock
+}
+
+func TestStatsProgress(t *testing.T) {
+	st, clock := newTestStats()
+	st.SetTotal(4)
+
+	// 还不知道大小时按文件数计算
+	f := st.Begin(1, "第1集.mp4")
+	if snap := st.Snapshot(); snap.Percent != 0 || snap.ETA != -1 || len(snap.Files) != 1 {
+		t.Errorf("before size: %+v", snap)
+	}
+
+	// 一个文件 100MB，下载了一半，其他3个按平均大小估计
+	st.SetSize(f, 100*mb, 0)
+	for i := 0; i < 5; i++ {
+		clock.advance(time.Second)
+		st.add(f, 10*mb)
+	}
+	snap := st.Snapshot()
+	if snap.TotalBytes != 400*mb || snap.DownBytes != 50*mb || snap.Percent != 12.5 {
+		t.Errorf("half: total %d down %d percent %v", snap.TotalBytes, snap.DownBytes, snap.Percent)
+	}
+	if snap.Files[0].Percent != 50 || math.Abs(snap.Files[0].Speed-10) > 0.01 {
+		t.Errorf("file = %+v", snap.Files[0])
+	}
+	if math.Abs(snap.Speed-10) > 0.01 || snap.ETA != 35 {
+		t.Errorf("speed %v eta %d", snap.Speed, snap.ETA)
+	}
+
+	st.add(f, 50*mb)
+	st.End(f, true)
+	st.FileDone(true)
+	// 第2个文件下载失败，不算进度
+	f = st.Begin(2, "第2集.mp4")
+	st.SetSize(f, 300*mb, 0)
+	st.add(f, 10*mb)
+	st.End(f, false)
+	st.FileDone(false)
+	snap = st.Snapshot()
+	if snap.DownloadedFiles != 1 || snap.FailedFiles != 1 || snap.Finished() != 2 || len(snap.Files) != 0 {
+		t.Errorf("counts: %+v", snap)
+	}
+	if snap.TotalBytes != 300*mb || snap.DownBytes != 100*mb {
+		t.Errorf("after one done: total %d down %d", snap.TotalBytes, snap.DownBytes)
+	}
+
+	// 超过速度窗口没有下载，速度为0，剩余时间未知
+	clock.advance(2 * speedWindow)
+	if snap = st.Snapshot(); snap.Speed != 0 || snap.ETA != -1 {
+		t.Errorf("idle: speed %v eta %d", snap.Speed, snap.ETA)
+	}
+
+	st.Reset()
+	if snap = st.Snapshot(); snap.TotalFiles != 0 || snap.DownBytes != 0 || snap.Speed != 0 {
+		t.Errorf("after Reset: %+v", snap)
+	}
+}
+
+func TestStatsFileCountFallback(t *testing.T) {
+	st, _ := newTestStats()
+	st.SetTotal(4)
+	st.FileDone(true)
+	// 大小未知时进度按完成的文件数，不会是整数除法的 0
+	if snap := st.Snapshot(); snap.Percent != 25 {
+		t.Errorf("percent = %v", snap.Percent)
+	}
+}
+
+func TestSpeedMeter(t *testing.T) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	var m speedMeter
+	m.add(start, mb)
+	// 刚开始时至少按一段时间计算
+	if got := m.rate(start) / mb; math.Abs(got-2) > 0.01 {
+		t.Errorf("first rate = %v", got)
+	}
+	// 前 5 秒快，后 5 秒慢，只算最近的一个窗口
+	for i := 1; i <= 10; i++ {
+		n := int64(mb)
+		if i > 5 {
+			n = mb / 2
+		}
+		m.add(start.Add(time.Duration(i)*time.Second), n)
+	}
+	if got := m.rate(start.Add(10*time.Second)) / mb; got < 0.4 || got > 0.6 {
+		t.Errorf("rate = %v", got)
+	}
+}
+
+// TestStatsConcurrent 多个下载协程和界面同时读写，用 go test -race 检查
+func TestStatsConcurrent(t *testing.T) {
+	var st Stats
+	st.SetTotal(40)
+	var wg sync.WaitGroup
+	for w := 1; w <= 4; w++ {
+		wg.Add(1)
+		go func(worker int) {
+			defer wg.Done()
+			for i := 0; i < 10; i++ {
+				f := st.Begin(worker, "a.mp4")
+				st.SetSize(f, 1000, 0)
+				for j := 0; j < 10; j++ {
+					st.add(f, 100)
+				}
+				st.End(f, true)
+				st.FileDone(true)
+			}
+		}(w)
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			snap := st.Snapshot()
+			if snap.Percent < 0 || snap.Percent > 100 {
+				t.Errorf("percent = %v", snap.Percent)
+			}
+		}
+	}()
+	wg.Wait()
+	<-done
+	if snap := st.Snapshot(); snap.DownloadedFiles != 40 || snap.Percent != 100 || snap.DownBytes != 40000 {
+		t.Errorf("final = %+v", snap)
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// VideoStatus 视频的状态，状态之间只能按 videoTransitions 切换
+type VideoStatus string
+
+const (
+	StatusDiscovered  VideoStatus = "discovered"  // 从频道获取到，还没有下载地址
+	StatusResolving   VideoStatus = "resolving"   // 正在获取下载地址
+	StatusResolved    VideoStatus = "resolved"    // 已经有下载地址
+	StatusQueued      VideoStatus = "queued"      // 等待下载
+	StatusDownloading VideoStatus = "downloading" // 正在下载
+	StatusDownloaded  VideoStatus = "downloaded"  // 已经下载到本地
+	StatusFailed      VideoStatus = "failed"      // 获取地址或者下载失败
+	StatusSkipped     VideoStatus = "skipped"     // 不需要下载
+	StatusRemoved     VideoStatus = "removed"     // 所属的频道已经删除
+)
+
+// videoStatuses 所有状态，按流程的顺序
+var videoStatuses = []VideoStatus{
+	StatusDiscovered, StatusResolving, StatusResolved, StatusQueued, StatusDownloading,
+	StatusDownloaded, StatusFailed, StatusSkipped, StatusRemoved,
+}
+
+// videoTransitions 每个状态可以切换到的状态
+var videoTransitions = map[VideoStatus][]VideoStatus{
+	StatusDiscovered:  {StatusResolving, StatusSkipped, StatusRemoved},
+	StatusResolving:   {StatusResolved, StatusFailed, StatusDiscovered, StatusSkipped, StatusRemoved},
+	StatusResolved:    {StatusResolving, StatusQueued, StatusDownloaded, StatusSkipped, StatusRemoved},
+	StatusQueued:      {StatusDownloading, StatusResolved, StatusDownloaded, StatusSkipped, StatusRemoved},
+	StatusDownloading: {StatusDownloaded, StatusFailed, StatusQueued, StatusRemoved},
+	StatusDownloaded:  {StatusQueued, StatusResolving, StatusSkipped, StatusRemoved},
+	StatusFailed:      {StatusResolving, StatusQueued, StatusDownloaded, StatusSkipped, StatusRemoved},
+	StatusSkipped:     {StatusDiscovered, StatusResolved, StatusDownloaded, StatusRemoved},
+	StatusRemoved:     {StatusDiscovered},
+}
+
+// statusLabels 界面和命令行显示的名称
+var statusLabels = map[VideoStatus]string{
+	StatusDiscovered:  "待获取地址",
+	StatusResolving:   "正在获取地址",
+	StatusResolved:    "待下载",
+	StatusQueued:      "排队中",
+	StatusDownloading: "正在下载",
+	StatusDownloaded:  "已下载",
+	StatusFailed:      "失败",
+	StatusSkipped:     "不下载",
+	StatusRemoved:     "已删除",
+}
+
+func (st VideoStatus) Label() string {
+	if label, ok := statusLabels[st]; ok {
+		return label
+	}
+	return string(st)
+}
+
+// CanTransition 判断是否可以从 from 切换到 to，状态不变时也返回 true
+func CanTransition(from, to VideoStatus) bool {
+	if from == to {
+		return true
+	}
+	for _, next := range videoTransitions[from] {
+		if next == to {
+			return true
+		}
+	}
+	return false
+}
+
+// TransitionError 不允许的状态切换
+type TransitionError struct {
+	VideoID  uint
+	From, To VideoStatus
+}
+
+func (e *TransitionError) Error() string {
+	return fmt.Sprintf("视频 %d 不能从 %s 切换到 %s", e.VideoID, e.From.Label(), e.To.Label())
+}
+
+// VideoEvent 视频状态切换的记录
+type VideoEvent struct {
+	ID        uint        `gorm:"primarykey" json:"id"`
+	VideoID   uint        `gorm:"column:video_id;index" json:"videoId"`
+	From      VideoStatus `gorm:"column:from_status;type:varchar(16)" json:"from"`
+	To        VideoStatus `gorm:"column:to_status;type:varchar(16)" json:"to"`
+	Reason    string      `gorm:"column:reason;type:varchar(512)" json:"reason"`
+	CreatedAt time.Time   `gorm:"column:created_at" json:"createdAt"`
+}
+
+func (m *VideoEvent) TableName() string {
+	return "biz_video_events"
+}
+
+// inferStatus 旧版数据没有状态，根据已有的字段推断，本地文件在下载时再检查
+func inferStatus(v Video) VideoStatus {
+	switch {
+	case !v.NeedDownload:
+		return StatusSkipped
+	case v.DownloadErr != "":
+		return StatusFailed
+	case v.WebDownloadUrl != "" || v.MDownloadUrl != "":
+		return StatusResolved
+	case v.ErrorMsg != "":
+		return StatusFailed
+	default:
+		return StatusDiscovered
+	}
+}
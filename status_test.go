@@ -0,0 +1,75 @@
+package main
+
+import (
+	"testing"
+
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+// newTestDB 内存中的 sqlite 数据库
+func newTestDB(t *testing.T) *gorm.DB {
+	t.Helper()
+	db, err := gorm.Open(sqlite.Open(":memory:"), &gorm.Config{Logger: logger.Discard})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sqlDB, err := db.DB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sqlDB.SetMaxOpenConns(1)
+	t.Cleanup(func() { sqlDB.Close() })
+	return db
+}
+
+// newTestStore 执行了所有升级的内存数据库
+func newTestStore(t *testing.T) *Store {
+	t.Helper()
+	db := newTestDB(t)
+	if err := newMigrator(db).prepare(); err != nil {
+		t.Fatal(err)
+	}
+	return &Store{db: db}
+}
+
+func TestCanTransition(t *testing.T) {
+	for from, next := range videoTransitions {
+		if _, ok := statusLabels[from]; !ok {
+			t.Errorf("%s has no label", from)
+		}
+		for _, to := range next {
+			if _, ok := videoTransitions[to]; !ok {
+				t.Errorf("%s -> %s: %s has no transitions", from, to, to)
+			}
+		}
+	}
+	if !CanTransition(StatusDiscovered, StatusResolving) {
+		t.Error("discovered -> resolving should be allowed")
+	}
+	if CanTransition(StatusDiscovered, StatusDownloading) {
+		t.Error("discovered -> downloading should not be allowed")
+	}
+	if !CanTransition(StatusFailed, StatusFailed) {
+		t.Error("same status should be allowed")
+	}
+}
+
+func TestInferStatus(t *testing.T) {
+	cases := []struct {
+		v    Video
+		want VideoStatus
+	}{
+		{Video{}, StatusSkipped},
+		{Video{NeedDownload: true}, StatusDiscovered},
+		{Video{NeedDownload: true, ErrorMsg: "x"}, StatusFailed},
+		{Video{NeedDownload: true, WebDownloadUrl: "u"}, StatusResolved},
+		{Video{NeedDownload: true, WebDownloadUrl: "u", DownloadErr: "x"}, StatusFailed},
+	}
+	for _, c := range cases {
+		if got := inferStatus(c.v); got != c.want {
+			t.Errorf("inferStatus(%+v) = %s, want %s", c.v, got, c.want)
+		}
+	}
+}
@@ -2,20 +2,29 @@ package main
 
 import (
 	"context"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
 
 	"gorm.io/driver/mysql"
+	"gorm.io/driver/postgres"
 	"gorm.io/driver/sqlite"
 	"gorm.io/gorm"
 )
 
+// Store 用 gorm 保存到 sqlite、mysql、postgres 的 Repository
 type Store struct {
 	db *gorm.DB
 }
 
 type Video struct {
 	gorm.Model
-	WebUrl         string `gorm:"column:web_url;type:varchar(1024)" json:"webUrl"`
+	ChannelID      uint   `gorm:"column:channel_id;index;comment:所属频道" json:"channelId"`
+	WebUrl         string `gorm:"column:web_url;type:varchar(768);comment:唯一索引在升级3中创建" json:"webUrl"`
 	MUrl           string `gorm:"column:m_url;type:varchar(1024);comment:手机端url" json:"MUrl"`
+	Source         string `gorm:"column:source;type:varchar(32);comment:视频平台" json:"source"`
 	OriginName     string `gorm:"column:origin_name;type:varchar(255);comment:原始名称" json:"originName"`
 	SaveName       string `gorm:"column:save_name;type:varchar(255);comment:保存名称" json:"title"`
 	WebDownloadUrl string `gorm:"column:web_download_url;type:varchar(1024);comment:浏览器下载地址" json:"webDownloadUrl"`
@@ -23,35 +32,166 @@ type Video struct {
 	NeedDownload   bool   `gorm:"column:need_download" json:"needDownload"`
 	ErrorMsg       string `gorm:"column:error_msg;type:varchar(512)" json:"errorMsg"`
 	DownloadErr    string `gorm:"column:download_err;type:varchar(512)" json:"downloadErr"`
+	ETag           string `gorm:"column:etag;type:varchar(255);comment:断点续传校验" json:"etag"`
+	LastModified   string `gorm:"column:last_modified;type:varchar(64);comment:断点续传校验" json:"lastModified"`
+	FileSize       int64  `gorm:"column:file_size;comment:文件大小" json:"fileSize"`
+	PartialSize    int64  `gorm:"column:partial_size;comment:未完成的临时文件大小" json:"partialSize"`
+
+	ResolveAttempts  int        `gorm:"column:resolve_attempts;comment:最近一次获取下载地址的尝试次数" json:"resolveAttempts"`
+	LastResolveAt    *time.Time `gorm:"column:last_resolve_at;comment:最近一次获取下载地址的时间" json:"lastResolveAt"`
+	WebResolvedAt    *time.Time `gorm:"column:web_resolved_at;comment:获取到网页端下载地址的时间，用来判断是否过期" json:"webResolvedAt"`
+	MResolvedAt      *time.Time `gorm:"column:m_resolved_at;comment:获取到手机端下载地址的时间，用来判断是否过期" json:"MResolvedAt"`
+	DownloadAttempts int        `gorm:"column:download_attempts;comment:最近一次下载的尝试次数" json:"downloadAttempts"`
+	LastDownloadAt   *time.Time `gorm:"column:last_download_at;comment:最近一次下载的时间" json:"lastDownloadAt"`
+
+	Series   string `gorm:"column:series;type:varchar(255);index;comment:从标题中识别的剧名" json:"series"`
+	Part     int    `gorm:"column:part;comment:第几部，0 为没有" json:"part"`
+	Episode  int    `gorm:"column:episode;comment:第几集，0 为没有识别到" json:"episode"`
+	Subtitle string `gorm:"column:subtitle;type:varchar(255);comment:集数后面的副标题" json:"subtitle"`
+
+	FileSuffix int `gorm:"column:file_suffix;comment:保存路径和其他视频相同时文件名后面加的序号，0 为没有" json:"fileSuffix"`
+
+	Status   VideoStatus `gorm:"column:status;type:varchar(16);index;comment:状态，只能通过 Transition 修改" json:"status"`
+	StatusAt *time.Time  `gorm:"column:status_at;comment:最近一次状态切换的时间" json:"statusAt"`
 }
 
 func (m *Video) TableName() string {
 	return "biz_videos"
 }
 
+// Channel 订阅的频道（UP主的主页）
+type Channel struct {
+	gorm.Model
+	Url     string            `gorm:"column:url;type:varchar(1024)" json:"url"`
+	Source  string            `gorm:"column:source;type:varchar(32);comment:视频平台，为空时根据地址判断" json:"source"`
+	Name    string            `gorm:"column:name;type:varchar(255);comment:显示名称" json:"name"`
+	Folder  string            `gorm:"column:folder;type:varchar(255);comment:下载子目录" json:"folder"`
+	Replace map[string]string `gorm:"column:replace_rules;type:text;serializer:json;comment:额外的名称替换规则" json:"replace"`
+	Enabled bool              `gorm:"column:enabled" json:"enabled"`
+}
+
+func (m *Channel) TableName() string {
+	return "biz_channels"
+}
+
+// DisplayName 没有名称时显示地址
+func (m *Channel) DisplayName() string {
+	if m.Name != "" {
+		return m.Name
+	}
+	return m.Url
+}
+
+// RunHistory 一次任务的运行记录
+type RunHistory struct {
+	ID         uint      `gorm:"primarykey" json:"id"`
+	StartedAt  time.Time `gorm:"column:started_at" json:"startedAt"`
+	FinishedAt time.Time `gorm:"column:finished_at" json:"finishedAt"`
+	Trigger    string    `gorm:"column:trigger_by;type:varchar(16);comment:触发方式 schedule、manual、cli" json:"trigger"`
+	Status     string    `gorm:"column:status;type:varchar(16);comment:success、failed、skipped、canceled" json:"status"`
+	Error      string    `gorm:"column:error;type:varchar(512)" json:"error"`
+	Downloaded int64     `gorm:"column:downloaded;comment:下载成功的文件数" json:"downloaded"`
+	Failed     int64     `gorm:"column:failed;comment:下载失败的文件数" json:"failed"`
+}
+
+func (m *RunHistory) TableName() string {
+	return "biz_runs"
+}
+
+// NewStore 连接数据库，新建的数据库会自动创建表，已有的数据库需要升级时返回 *PendingMigrationsError
 func NewStore(conf DBConfig) (*Store, error) {
-	var db *gorm.DB
-	var err error
-	if conf.Type == "sqlite" {
-		db, err = gorm.Open(sqlite.Open("xigua.db"), &gorm.Config{})
-	} else {
-		db, err = gorm.Open(mysql.New(mysql.Config{
+	db, err := openDB(conf)
+	if err != nil {
+		return nil, err
+	}
+	if err = newMigrator(db).prepare(); err != nil {
+		closeDB(db)
+		return nil, err
+	}
+	return &Store{db: db}, nil
+}
+
+// NewMigrator 连接数据库用来查看和执行升级，用完后调用 Close
+func NewMigrator(conf DBConfig) (*Migrator, error) {
+	db, err := openDB(conf)
+	if err != nil {
+		return nil, err
+	}
+	return newMigrator(db), nil
+}
+
+func (m *Migrator) Close() {
+	closeDB(m.db)
+}
+
+// legacySqlitePath 旧版在当前目录创建的数据库文件
+const legacySqlitePath = "xigua.db"
+
+// SqlitePath 返回 sqlite 数据库文件的路径：配置了 path 时使用配置，
+// 否则使用用户配置目录下的 niugexi/xigua.db，默认位置还没有数据库而当前目录有旧版的 xigua.db 时继续使用旧版的文件
+func SqlitePath(conf DBConfig) (string, error) {
+	if conf.Path != "" {
+		return conf.Path, nil
+	}
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", fmt.Errorf("获取用户配置目录失败，请在配置中设置 store.path: %w", err)
+	}
+	path := filepath.Join(dir, "niugexi", "xigua.db")
+	if _, err = os.Stat(path); os.IsNotExist(err) {
+		if info, err := os.Stat(legacySqlitePath); err == nil && !info.IsDir() {
+			log.Println("使用当前目录的", legacySqlitePath, "，可以移动到", path, "或者在配置中设置 store.path")
+			return legacySqlitePath, nil
+		}
+	}
+	return path, nil
+}
+
+func openDB(conf DBConfig) (*gorm.DB, error) {
+	var dialector gorm.Dialector
+	switch conf.Type {
+	case "sqlite":
+		path, err := SqlitePath(conf)
+		if err != nil {
+			return nil, err
+		}
+		if err = os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			return nil, err
+		}
+		dialector = sqlite.Open(path)
+	case "mysql":
+		dialector = mysql.New(mysql.Config{
 			DSN:                       conf.Dns, // DSN data source name
 			DefaultStringSize:         256,      // string 类型字段的默认长度
 			DisableDatetimePrecision:  true,     // 禁用 datetime 精度，MySQL 5.6 之前的数据库不支持
 			DontSupportRenameIndex:    true,     // 重命名索引时采用删除并新建的方式，MySQL 5.7 之前的数据库和 MariaDB 不支持重命名索引
 			DontSupportRenameColumn:   true,     // 用 `change` 重命名列，MySQL 8 之前的数据库和 MariaDB 不支持重命名列
 			SkipInitializeWithVersion: false,    // 根据当前 MySQL 版本自动配置
-		}), &gorm.Config{})
+		})
+	case "postgres":
+		dialector = postgres.Open(conf.Dns)
+	default:
+		return nil, fmt.Errorf("不支持的数据库类型 %q，可选 sqlite、mysql、postgres", conf.Type)
+	}
+	db, err := gorm.Open(dialector, &gorm.Config{})
+	if err != nil {
+		return nil, err
+	}
+	if conf.Type == "sqlite" {
+		// 多个下载协程同时写入时，sqlite 只能有一个连接，否则会出现 database is locked
+		sqlDB, err := db.DB()
 		if err != nil {
 			return nil, err
 		}
+		sqlDB.SetMaxOpenConns(1)
 	}
-	err = db.AutoMigrate(&Video{})
-	if err != nil {
-		return nil, err
+	return db, nil
+}
+
+func closeDB(db *gorm.DB) {
+	if sqlDB, err := db.DB(); err == nil {
+		sqlDB.Close()
 	}
-	return &Store{db: db}, nil
 }
 
 func (s *Store) Save(media []Video) error {
@@ -60,23 +200,181 @@ func (s *Store) Save(media []Video) error {
 
 func (s *Store) List() ([]Video, error) {
 	var medias []Video
-	err := s.db.Debug().Model(&Video{}).Find(&medias).Error
+	err := s.db.Model(&Video{}).Find(&medias).Error
 	return medias, err
 }
 
+// ListPage 按ID分页查询，同时返回总数
+func (s *Store) ListPage(ctx context.Context, offset, limit int) ([]Video, int64, error) {
+	var total int64
+	if err := s.db.WithContext(ctx).Model(&Video{}).Count(&total).Error; err != nil {
+		return nil, 0, err
+	}
+	var videos []Video
+	err := s.db.WithContext(ctx).Model(&Video{}).Order("id").Offset(offset).Limit(limit).Find(&videos).Error
+	return videos, total, err
+}
+
+// Update 保存非零值的字段，状态只能通过 Transition 修改
 func (s *Store) Update(v Video) error {
-	return s.db.Model(&Video{}).Where("id =?", v.ID).Updates(&v).Error
+	return s.db.Model(&Video{}).Where("id =?", v.ID).Omit("status", "status_at").Updates(&v).Error
+}
+
+// Transition 切换视频的状态并记录切换的时间和原因，不允许的切换返回 *TransitionError
+func (s *Store) Transition(id uint, to VideoStatus, reason string) error {
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		var v Video
+		if err := tx.Model(&Video{}).Select("id", "status").First(&v, id).Error; err != nil {
+			return err
+		}
+		if v.Status == to {
+			return nil
+		}
+		if !CanTransition(v.Status, to) {
+			return &TransitionError{VideoID: id, From: v.Status, To: to}
+		}
+		now := time.Now()
+		values := map[string]interface{}{"status": to, "status_at": now}
+		if to == StatusSkipped {
+			values["need_download"] = false
+		} else if v.Status == StatusSkipped {
+			values["need_download"] = true
+		}
+		res := tx.Model(&Video{}).Where("id = ? and status = ?", id, v.Status).Updates(values)
+		if res.Error != nil {
+			return res.Error
+		}
+		if res.RowsAffected == 0 {
+			return &TransitionError{VideoID: id, From: v.Status, To: to}
+		}
+		return tx.Create(&VideoEvent{VideoID: id, From: v.Status, To: to, Reason: truncate(reason, 512), CreatedAt: now}).Error
+	})
+}
+
+// ListByStatus 查询处于指定状态的视频
+func (s *Store) ListByStatus(ctx context.Context, statuses ...VideoStatus) ([]Video, error) {
+	var videos []Video
+	err := s.db.WithContext(ctx).Model(&Video{}).Where("status in ?", statuses).Order("id").Find(&videos).Error
+	return videos, err
+}
+
+// CountByStatus 每个状态的视频数量
+func (s *Store) CountByStatus() (map[VideoStatus]int64, error) {
+	var rows []struct {
+		Status VideoStatus
+		Count  int64
+	}
+	err := s.db.Model(&Video{}).Select("status, count(*) as count").Group("status").Scan(&rows).Error
+	counts := make(map[VideoStatus]int64, len(rows))
+	for _, r := range rows {
+		counts[r.Status] = r.Count
+	}
+	return counts, err
+}
+
+// ListEvents 视频的状态切换记录，按时间排列
+func (s *Store) ListEvents(videoID uint) ([]VideoEvent, error) {
+	var events []VideoEvent
+	err := s.db.Model(&VideoEvent{}).Where("video_id = ?", videoID).Order("id").Find(&events).Error
+	return events, err
+}
+
+// UpdateDownload 保存下载结果，零值也会写入，用来清空下载错误和临时文件大小
+func (s *Store) UpdateDownload(v Video) error {
+	return s.db.Model(&Video{}).Where("id =?", v.ID).
+		Select("download_err", "etag", "last_modified", "file_size", "partial_size",
+			"download_attempts", "last_download_at").Updates(&v).Error
+}
+
+// UpdateResolve 保存获取下载地址的结果，零值也会写入，用来清空错误信息
+func (s *Store) UpdateResolve(v Video) error {
+	return s.db.Model(&Video{}).Where("id =?", v.ID).
+		Select("web_download_url", "m_download_url", "web_resolved_at", "m_resolved_at",
+			"error_msg", "resolve_attempts", "last_resolve_at").Updates(&v).Error
+}
+
+func (s *Store) GetVideo(id uint) (v Video, e error) {
+	e = s.db.Model(&Video{}).First(&v, id).Error
+	return
 }
 
+// UpdateSeries 保存识别的剧名和集数，集数为0时也会保存
+func (s *Store) UpdateSeries(v Video) error {
+	return s.db.Model(&Video{}).Where("id =?", v.ID).Select("series", "part", "episode", "subtitle").
+		Updates(map[string]interface{}{"series": v.Series, "part": v.Part, "episode": v.Episode, "subtitle": v.Subtitle}).Error
+}
+
+func (s *Store) UpdateFileSuffix(id uint, n int) error {
+	return s.db.Model(&Video{}).Where("id =?", id).Update("file_suffix", n).Error
+}
+
+func (s *Store) UpdateSaveName(id uint, name string) error {
+	return s.db.Model(&Video{}).Where("id =?", id).Update("save_name", name).Error
+}
+
+// findByWebUrl 没有找到时返回 gorm.ErrRecordNotFound，用 Find 代替 First 是为了不在日志中打印找不到的错误，导入时大部分视频都是新的
 func (s *Store) findByWebUrl(ctx context.Context, weburl string) (n Video, e error) {
-	e = s.db.WithContext(ctx).Model(&Video{}).Where(Video{WebUrl: weburl}).First(&n).Error
+	tx := s.db.WithContext(ctx).Model(&Video{}).Where(Video{WebUrl: weburl}).Order("id").Limit(1).Find(&n)
+	if tx.Error == nil && tx.RowsAffected == 0 {
+		return n, gorm.ErrRecordNotFound
+	}
+	return n, tx.Error
+}
+
+func (s *Store) ListChannels() ([]Channel, error) {
+	var channels []Channel
+	err := s.db.Model(&Channel{}).Order("id").Find(&channels).Error
+	return channels, err
+}
+
+// SaveChannel 新增或修改频道，零值也会写入
+func (s *Store) SaveChannel(c *Channel) error {
+	return s.db.Save(c).Error
+}
+
+func (s *Store) GetChannel(id uint) (c Channel, e error) {
+	e = s.db.Model(&Channel{}).First(&c, id).Error
 	return
 }
 
-func (s *Store) GetEmptyDownload(ctx context.Context) ([]Video, error) {
-	var medias []Video
-	err := s.db.WithContext(ctx).Debug().Model(&Video{}).Select("id ,web_url,save_name").Where("length(m_download_url) = 0  or length(web_download_url) = 0").Scan(&medias).Error
+// DeleteChannel 删除频道，频道的视频标记为已删除
+func (s *Store) DeleteChannel(id uint) error {
+	var ids []uint
+	if err := s.db.Model(&Video{}).Where("channel_id = ? and status <> ?", id, StatusRemoved).Pluck("id", &ids).Error; err != nil {
+		return err
+	}
+	for _, videoID := range ids {
+		if err := s.Transition(videoID, StatusRemoved, "频道已删除"); err != nil {
+			return err
+		}
+	}
+	return s.db.Delete(&Channel{}, id).Error
+}
 
-	return medias, err
+func (s *Store) findChannelByUrl(url string) (c Channel, e error) {
+	tx := s.db.Model(&Channel{}).Where(Channel{Url: url}).Order("id").Limit(1).Find(&c)
+	if tx.Error == nil && tx.RowsAffected == 0 {
+		return c, gorm.ErrRecordNotFound
+	}
+	return c, tx.Error
+}
+
+// AssignChannel 没有所属频道的视频归到指定的频道
+func (s *Store) AssignChannel(channelID uint) error {
+	return s.db.Model(&Video{}).Where("channel_id = 0 or channel_id is null").Update("channel_id", channelID).Error
+}
 
+func (s *Store) SaveRun(r *RunHistory) error {
+	return s.db.Create(r).Error
+}
+
+// ListRuns 最近的运行记录，limit 为0时返回全部
+func (s *Store) ListRuns(limit int) ([]RunHistory, error) {
+	var runs []RunHistory
+	tx := s.db.Model(&RunHistory{}).Order("id desc")
+	if limit > 0 {
+		tx = tx.Limit(limit)
+	}
+	err := tx.Find(&runs).Error
+	return runs, err
 }
@@ -2,13 +2,57 @@ package main
 
 import (
 	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 )
 
-func TestDownload(t *testing.T) {
-	create, err := os.Create("d:/妹仔想当主人婆21.mp4.download")
+func TestSqlitePath(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("XDG_CONFIG_HOME", dir)
+	t.Setenv("HOME", dir)
+	t.Setenv("AppData", dir)
+
+	path, err := SqlitePath(DBConfig{Type: "sqlite", Path: "/data/a.db"})
+	if err != nil || path != "/data/a.db" {
+		t.Errorf("configured path = %q, %v", path, err)
+	}
+
+	cwd, _ := os.Getwd()
+	defer os.Chdir(cwd)
+	work := t.TempDir()
+	if err = os.Chdir(work); err != nil {
+		t.Fatal(err)
+	}
+	path, err = SqlitePath(DBConfig{Type: "sqlite"})
+	if err != nil || !strings.HasPrefix(path, dir) || filepath.Base(path) != "xigua.db" {
+		t.Errorf("default path = %q, %v", path, err)
+	}
+
+	// 默认位置还没有数据库时继续使用当前目录的旧版数据库
+	if err = os.WriteFile(legacySqlitePath, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if path, _ = SqlitePath(DBConfig{Type: "sqlite"}); path != legacySqlitePath {
+		t.Errorf("legacy path = %q", path)
+	}
+}
+
+func TestNewStoreUnknownType(t *testing.T) {
+	_, err := NewStore(DBConfig{Type: "oracle"})
+	if err == nil || !strings.Contains(err.Error(), "oracle") {
+		t.Errorf("err = %v", err)
+	}
+}
+
+func TestNewStoreSqlitePath(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "sub", "test.db")
+	store, err := NewStore(DBConfig{Type: "sqlite", Path: path})
 	if err != nil {
-		return
+		t.Fatal(err)
+	}
+	closeDB(store.db)
+	if _, err = os.Stat(path); err != nil {
+		t.Errorf("database not created: %v", err)
 	}
-	create.Close()
 }
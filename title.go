@@ -0,0 +1,330 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// 整理标题的规则类型
+const (
+	RuleLiteral       = "literal"       // 把 find 替换为 replace
+	RuleRegex         = "regex"         // 正则替换，replace 中可以用 $1 引用分组
+	RuleStripBrackets = "stripBrackets" // 去掉括号，保留括号中的内容，find 可以指定括号，默认为 defaultBrackets
+	RuleTrim          = "trim"          // 去掉首尾的空白，find 可以指定额外去掉的字符
+	RuleCollapseSpace = "collapseSpace" // 连续的空白合并为一个空格
+	RuleNumerals      = "numerals"      // 集、节、部、场前的中文数字转换为阿拉伯数字
+)
+
+// ruleTypes 所有的规则类型，界面中按这个顺序显示
+var ruleTypes = []string{RuleLiteral, RuleRegex, RuleStripBrackets, RuleTrim, RuleCollapseSpace, RuleNumerals}
+
+// defaultBrackets stripBrackets 默认去掉的括号
+const defaultBrackets = "《》【】[]()（）「」『』〈〉"
+
+// TitleRule 整理标题的一条规则，所有规则按顺序执行，前一条的结果是后一条的输入
+type TitleRule struct {
+	Type    string `json:"type"`
+	Find    string `json:"find,omitempty"`
+	Replace string `json:"replace,omitempty"`
+}
+
+func (r TitleRule) String() string {
+	switch r.Type {
+	case RuleLiteral, RuleRegex:
+		return fmt.Sprintf("%s %q → %q", r.Type, r.Find, r.Replace)
+	case RuleStripBrackets, RuleTrim:
+		if r.Find != "" {
+			return fmt.Sprintf("%s %q", r.Type, r.Find)
+		}
+	}
+	return r.Type
+}
+
+// DefaultTitleRules 默认的规则：去掉宣传用的词和括号，转换集数，去掉空白和逗号
+func DefaultTitleRules() []TitleRule {
+	return []TitleRule{
+		{Type: RuleRegex, Find: "非物质文化遗产|非物质|非遗|牛歌剧|牛歌戏|山歌|广西|弘扬|地方|特色|平南|文化|遗产|戏曲|精彩|传承|区粹|戏剧|现代版|民间|现代"},
+		{Type: RuleStripBrackets},
+		{Type: RuleNumerals},
+		{Type: RuleRegex, Find: `[\s，,]+`},
+		{Type: RuleTrim},
+	}
+}
+
+// literalRules 把旧版的替换表转换为规则，长的关键字先替换，"第二十一" 不会被 "第二" 先替换掉
+func literalRules(replace map[string]string) []TitleRule {
+	keys := make([]string, 0, len(replace))
+	for k := range replace {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if li, lj := len([]rune(keys[i])), len([]rune(keys[j])); li != lj {
+			return li > lj
+		}
+		return keys[i] < keys[j]
+	})
+	rules := make([]TitleRule, 0, len(keys))
+	for _, k := range keys {
+		rules = append(rules, TitleRule{Type: RuleLiteral, Find: k, Replace: replace[k]})
+	}
+	return rules
+}
+
+// legacyTitleRules 转换旧版配置中的替换表，手写的 第一=第1 这样的数字替换改为 numerals 规则
+func legacyTitleRules(replace map[string]string) []TitleRule {
+	rest := make(map[string]string, len(replace))
+	var numerals bool
+	for k, v := range replace {
+		if v != k && numeralPattern.MatchString(k) && convertNumerals(k) == v {
+			numerals = true
+			continue
+		}
+		rest[k] = v
+	}
+	rules := literalRules(rest)
+	if numerals {
+		rules = append(rules, TitleRule{Type: RuleNumerals})
+	}
+	return rules
+}
+
+// TitlePipeline 编译好的规则
+type TitlePipeline struct {
+	steps []func(string) string
+}
+
+// CompileTitleRules 编译规则，规则有错误时返回出错的规则序号（从1开始）
+func CompileTitleRules(rules []TitleRule) (*TitlePipeline, error) {
+	p := &TitlePipeline{}
+	for i, r := range rules {
+		step, err := compileRule(r)
+		if err != nil {
+			return nil, fmt.Errorf("第 %d 条规则 %s: %w", i+1, r.Type, err)
+		}
+		p.steps = append(p.steps, step)
+	}
+	return p, nil
+}
+
+func compileRule(r TitleRule) (func(string) string, error) {
+	switch r.Type {
+	case RuleLiteral:
+		if r.Find == "" {
+			return nil, fmt.Errorf("查找的内容不能为空")
+		}
+		return func(s string) string { return strings.ReplaceAll(s, r.Find, r.Replace) }, nil
+	case RuleRegex:
+		if r.Find == "" {
+			return nil, fmt.Errorf("正则表达式不能为空")
+		}
+		re, err := regexp.Compile(r.Find)
+		if err != nil {
+			return nil, fmt.Errorf("正则表达式错误: %w", err)
+		}
+		return func(s string) string { return re.ReplaceAllString(s, r.Replace) }, nil
+	case RuleStripBrackets:
+		brackets := firstNonEmpty(r.Find, defaultBrackets)
+		return func(s string) string {
+			return strings.Map(func(c rune) rune {
+				if strings.ContainsRune(brackets, c) {
+					return -1
+				}
+				return c
+			}, s)
+		}, nil
+	case RuleTrim:
+		return func(s string) string {
+			return strings.TrimFunc(s, func(c rune) bool { return unicode.IsSpace(c) || strings.ContainsRune(r.Find, c) })
+		}, nil
+	case RuleCollapseSpace:
+		return func(s string) string { return strings.Join(strings.Fields(s), " ") }, nil
+	case RuleNumerals:
+		return convertNumerals, nil
+	}
+	return nil, fmt.Errorf("未知的规则类型，可选 %s", strings.Join(ruleTypes, "、"))
+}
+
+// Apply 依次执行所有规则
+func (p *TitlePipeline) Apply(title string) string {
+	for _, step := range p.steps {
+		title = step(title)
+	}
+	return title
+}
+
+// chineseDigits 中文数字
+var chineseDigits = map[rune]int{'零': 0, '〇': 0, '一': 1, '二': 2, '两': 2, '三': 3, '四': 4, '五': 5, '六': 6, '七': 7, '八': 8, '九': 9}
+
+// chineseUnits 中文数字的单位
+var chineseUnits = map[rune]int{'十': 10, '百': 100, '千': 1000, '万': 10000}
+
+// numeralPattern 第X集、第X节、第X部、第X场、第X回、标题末尾的第X 以及 X集、X节 中的中文数字。
+// 后面不是这些字时不转换，避免把“第一次”“第三千金”转换成“第1次”“第3000金”；
+// 没有“第”时不转换 部、场，避免把“一场好戏”转换成“1场好戏”
+var numeralPattern = regexp.MustCompile(`第([零〇一二两三四五六七八九十百千万]+)([集节部场回]|$)|([零〇一二两三四五六七八九十百千万]+)([集节])`)
+
+// convertNumerals 把集数中的中文数字转换为阿拉伯数字
+func convertNumerals(s string) string {
+	return numeralPattern.ReplaceAllStringFunc(s, func(m string) string {
+		sub := numeralPattern.FindStringSubmatch(m)
+		prefix, digits, suffix := "第", sub[1], sub[2]
+		if digits == "" {
+			prefix, digits, suffix = "", sub[3], sub[4]
+		}
+		n, ok := ChineseToArabic(digits)
+		if !ok {
+			return m
+		}
+		return prefix + strconv.Itoa(n) + suffix
+	})
+}
+
+// ChineseToArabic 把中文数字转换为整数，支持 十一、二十、一百零五、两千 这样的写法，
+// 也支持 一〇五 这样逐位的写法，不是有效的数字时返回 false
+func ChineseToArabic(s string) (int, bool) {
+	if s == "" {
+		return 0, false
+	}
+	runes := []rune(s)
+	hasUnit := false
+	for _, c := range runes {
+		if _, ok := chineseUnits[c]; ok {
+			hasUnit = true
+		} else if _, ok := chineseDigits[c]; !ok {
+			return 0, false
+		}
+	}
+	// 逐位的写法
+	if !hasUnit {
+		n := 0
+		for _, c := range runes {
+			n = n*10 + chineseDigits[c]
+		}
+		return n, true
+	}
+
+	total, section, digit := 0, 0, -1
+	lastUnit := 100000
+	for _, c := range runes {
+		if d, ok := chineseDigits[c]; ok {
+			if digit > 0 && d != 0 {
+				// 两个数字连在一起，例如 二三十，零后面可以跟数字，例如 一百零五
+				return 0, false
+			}
+			digit = d
+			continue
+		}
+		unit := chineseUnits[c]
+		if unit == 10000 {
+			if digit > 0 {
+				section += digit
+			}
+			if section == 0 {
+				return 0, false
+			}
+			total += section * unit
+			section, digit, lastUnit = 0, -1, 100000
+			continue
+		}
+		if unit >= lastUnit {
+			// 单位需要从大到小，例如 十百 是错误的
+			return 0, false
+		}
+		if digit < 0 {
+			// 十一 这样省略了开头的 一
+			if section != 0 || unit != 10 {
+				return 0, false
+			}
+			digit = 1
+		}
+		if digit == 0 {
+			return 0, false
+		}
+		section += digit * unit
+		digit, lastUnit = -1, unit
+	}
+	if digit > 0 {
+		section += digit
+	}
+	return total + section, true
+}
+
+// titlePipeline 频道的替换规则先执行，再执行 rules
+func titlePipeline(rules []TitleRule, ch Channel) (*TitlePipeline, error) {
+	return CompileTitleRules(append(literalRules(ch.Replace), rules...))
+}
+
+// TitlePreview 一个视频按规则重新整理后的保存名称
+type TitlePreview struct {
+	ID         uint
+	OriginName string
+	SaveName   string // 现在的保存名称
+	NewName    string
+}
+
+func (p TitlePreview) Changed() bool {
+	return p.SaveName != p.NewName
+}
+
+// PreviewTitles 用 rules 重新计算所有视频的保存名称，不修改数据库。
+// 和获取视频时一样，原始名称重复的视频名称相同，保存路径相同时下载前加上 (2) 这样的序号
+func (s *Server) PreviewTitles(conf Conf, rules []TitleRule) ([]TitlePreview, error) {
+	if err := s.openStore(conf); err != nil {
+		return nil, err
+	}
+	list, err := s.store.List()
+	if err != nil {
+		return nil, err
+	}
+	channels, err := s.store.ListChannels()
+	if err != nil {
+		return nil, err
+	}
+	pipelines := make(map[uint]*TitlePipeline, len(channels)+1)
+	if pipelines[0], err = CompileTitleRules(rules); err != nil {
+		return nil, err
+	}
+	for _, ch := range channels {
+		if pipelines[ch.ID], err = titlePipeline(rules, ch); err != nil {
+			return nil, fmt.Errorf("频道 %s: %w", ch.DisplayName(), err)
+		}
+	}
+
+	previews := make([]TitlePreview, 0, len(list))
+	for _, v := range list {
+		// 导入的视频可能没有原始名称，保留现在的名称
+		if v.OriginName == "" {
+			previews = append(previews, TitlePreview{ID: v.ID, SaveName: v.SaveName, NewName: v.SaveName})
+			continue
+		}
+		p, ok := pipelines[v.ChannelID]
+		if !ok {
+			p = pipelines[0]
+		}
+		name := firstNonEmpty(p.Apply(v.OriginName), v.OriginName)
+		previews = append(previews, TitlePreview{ID: v.ID, OriginName: v.OriginName, SaveName: v.SaveName, NewName: name})
+	}
+	return previews, nil
+}
+
+// ApplyTitles 保存预览中有变化的名称，本地已有的文件一起改名，返回修改的个数，出错的视频跳过
+func (s *Server) ApplyTitles(conf Conf, previews []TitlePreview) (int, error) {
+	var n int
+	var errs []error
+	for _, p := range previews {
+		if !p.Changed() {
+			continue
+		}
+		if err := s.RenameVideo(conf, p.ID, p.NewName); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", p.SaveName, err))
+			continue
+		}
+		n++
+	}
+	return n, errors.Join(errs...)
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestChineseToArabic(t *testing.T) {
+	tests := map[string]int{
+		"零": 0, "一": 1, "十": 10, "十一": 11, "二十": 20, "二十三": 23, "两百": 200, "一百零五": 105,
+		"一百一十": 110, "一千零一十": 1010, "三千二百五十一": 3251, "一万二千": 12000, "十万": 100000, "一〇五": 105, "二三": 23,
+	}
+	for s, want := range tests {
+		if got, ok := ChineseToArabic(s); !ok || got != want {
+			t.Errorf("ChineseToArabic(%q) = %d, %v, want %d", s, got, ok, want)
+		}
+	}
+	for _, s := range []string{"", "百", "十百", "二三十", "一百十", "第一", "零十"} {
+		if got, ok := ChineseToArabic(s); ok {
+			t.Errorf("ChineseToArabic(%q) = %d, should fail", s, got)
+		}
+	}
+}
+
+func TestConvertNumerals(t *testing.T) {
+	tests := map[string]string{
+		"妹仔想当主人婆第十一集":   "妹仔想当主人婆第11集",
+		"第一百零五集":        "第105集",
+		"第二十一":          "第21",
+		"三十集":           "30集",
+		"上部第三部 第二场":     "上部第3部 第2场",
+		"一场好戏":          "一场好戏",
+		"第十一集和第一集":      "第11集和第1集",
+		"第二十三节(下)":      "第23节(下)",
+		"第一〇五集":         "第105集",
+		"没有数字的标题":       "没有数字的标题",
+		"第十百集":          "第十百集",
+		"第二十一集与二十二集大结局": "第21集与22集大结局",
+		"第一次相亲":         "第一次相亲",
+		"第三千金":          "第三千金",
+		"第三回 第一次相亲":     "第3回 第一次相亲",
+	}
+	for in, want := range tests {
+		if got := convertNumerals(in); got != want {
+			t.Errorf("convertNumerals(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestTitlePipeline(t *testing.T) {
+	p, err := CompileTitleRules([]TitleRule{
+		{Type: RuleLiteral, Find: "牛歌戏", Replace: ""},
+		{Type: RuleRegex, Find: `【[^】]*】`},
+		{Type: RuleStripBrackets},
+		{Type: RuleNumerals},
+		{Type: RuleCollapseSpace},
+		{Type: RuleTrim, Find: "-"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := p.Apply("-【高清】 牛歌戏《妹仔想当主人婆》   第十一集 -"); got != "妹仔想当主人婆 第11集" {
+		t.Errorf("Apply = %q", got)
+	}
+
+	p, _ = CompileTitleRules(DefaultTitleRules())
+	if got := p.Apply("广西平南牛歌戏《妹仔想当主人婆》第二十一集，精彩"); got != "妹仔想当主人婆第21集" {
+		t.Errorf("default Apply = %q", got)
+	}
+
+	for _, rules := range [][]TitleRule{
+		{{Type: RuleLiteral}},
+		{{Type: RuleRegex, Find: "("}},
+		{{Type: "upper"}},
+	} {
+		if _, err = CompileTitleRules(rules); err == nil || !strings.Contains(err.Error(), "第 1 条规则") {
+			t.Errorf("CompileTitleRules(%v) err = %v", rules, err)
+		}
+	}
+}
+
+func TestLegacyTitleRules(t *testing.T) {
+	rules := legacyTitleRules(map[string]string{"第二": "第2", "第二十一": "第21", "第十集": "第10集", "山歌": "", "平南山歌": "x"})
+	want := []TitleRule{
+		{Type: RuleLiteral, Find: "平南山歌", Replace: "x"},
+		{Type: RuleLiteral, Find: "山歌"},
+		{Type: RuleNumerals},
+	}
+	if len(rules) != len(want) {
+		t.Fatalf("rules = %v", rules)
+	}
+	for i := range want {
+		if rules[i] != want[i] {
+			t.Errorf("rules[%d] = %v, want %v", i, rules[i], want[i])
+		}
+	}
+}
+
+func TestPreviewTitles(t *testing.T) {
+	store := NewMemoryStore()
+	ch := Channel{Url: "https://www.ixigua.com/home/1/", Replace: map[string]string{"平南": ""}}
+	if err := store.SaveChannel(&ch); err != nil {
+		t.Fatal(err)
+	}
+	err := store.Save([]Video{
+		{ChannelID: ch.ID, WebUrl: "https://a/1", OriginName: "平南 第一集", SaveName: "平南 第一集"},
+		{ChannelID: ch.ID, WebUrl: "https://a/2", OriginName: "片段", SaveName: "片段"},
+		{ChannelID: ch.ID, WebUrl: "https://a/3", OriginName: "片段", SaveName: "片段2"},
+		{WebUrl: "https://a/4", OriginName: "平南 第二集", SaveName: "平南 第二集"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{store: store}
+	conf := DefaultConf()
+	previews, err := s.PreviewTitles(conf, []TitleRule{{Type: RuleNumerals}, {Type: RuleTrim}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"第1集", "片段", "片段", "平南 第2集"}
+	for i, p := range previews {
+		if p.NewName != want[i] {
+			t.Errorf("previews[%d] = %q, want %q", i, p.NewName, want[i])
+		}
+	}
+
+	// 两个片段都已经下载，改名后保存路径相同，后一个加上序号
+	conf.DownloadPath = t.TempDir()
+	paths, err := s.videoPaths(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range previews[1:3] {
+		v, _ := store.GetVideo(p.ID)
+		if err := os.MkdirAll(filepath.Dir(paths.File(v)), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(paths.File(v), []byte(p.SaveName), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	n, err := s.ApplyTitles(conf, previews)
+	if err != nil || n != 3 {
+		t.Errorf("ApplyTitles = %d, %v", n, err)
+	}
+	if v, _ := store.GetVideo(previews[0].ID); v.SaveName != "第1集" {
+		t.Errorf("SaveName = %q", v.SaveName)
+	}
+	v, _ := store.GetVideo(previews[2].ID)
+	if v.SaveName != "片段" || v.FileSuffix != 2 {
+		t.Errorf("SaveName = %q, FileSuffix = %d", v.SaveName, v.FileSuffix)
+	}
+	if b, err := os.ReadFile(paths.File(v)); err != nil || string(b) != "片段2" {
+		t.Errorf("%s = %q, %v", paths.File(v), b, err)
+	}
+}
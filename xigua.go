@@ -0,0 +1,217 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/PuerkitoBio/goquery"
+	"github.com/wujunwei928/parse-video/parser"
+)
+
+//https://www.ixigua.com/home/104305645109/?source=pgc_author_name&list_entrance=anyVideo
+
+const (
+	xiguaHost       = "https://www.ixigua.com"
+	xiguaMobileHost = "https://m.ixigua.com/video"
+	// xiguaFooter 频道主页滚动到底部时出现的提示
+	xiguaFooter = "<div class=\"Feed-footer\">已经到底部，没有更多内容了</div>"
+)
+
+// xiguaSource 西瓜视频，通过浏览器滚动频道主页获取视频列表
+type xiguaSource struct {
+	// host、mobileHost 网页端和手机端的地址，为空时使用西瓜视频的地址，测试时指向本地的网站
+	host, mobileHost string
+	// browser 为空时使用任务共用的 chrome
+	browser Browser
+	// parseVideoId 为空时使用 parse-video 解析
+	parseVideoId func(source, videoId string) (*parser.VideoParseInfo, error)
+}
+
+func (x xiguaSource) webHost() string {
+	if x.host != "" {
+		return x.host
+	}
+	return xiguaHost
+}
+
+func (x xiguaSource) mobileHostUrl() string {
+	if x.mobileHost != "" {
+		return x.mobileHost
+	}
+	return xiguaMobileHost
+}
+
+func (x xiguaSource) openPage(ctx context.Context, conf Conf, userAgent string) (Page, error) {
+	if x.browser != nil {
+		return x.browser.NewPage(ctx, conf, userAgent)
+	}
+	return openPage(ctx, conf, userAgent)
+}
+
+func (xiguaSource) Name() string {
+	return parser.SourceXiGua
+}
+
+func (xiguaSource) Match(u *url.URL) bool {
+	return matchDomain(u.Hostname(), "ixigua.com")
+}
+
+func (x xiguaSource) ListVideos(ctx context.Context, conf Conf, channelUrl string) ([]SourceVideo, error) {
+	page, err := x.openPage(ctx, conf, desktopUserAgent)
+	if err != nil {
+		return nil, err
+	}
+	defer page.Close()
+
+	if err = page.Navigate(channelUrl); err != nil {
+		return nil, err
+	}
+	if err = page.WaitVisible("div.userDetailV3__main__list"); err != nil {
+		return nil, err
+	}
+	var hasMore string
+	for hasMore != xiguaFooter {
+		if err = page.ScrollToBottom(); err != nil {
+			return nil, err
+		}
+		if err = page.Sleep(time.Duration(rand.Intn(2)+2) * time.Second); err != nil {
+			return nil, err
+		}
+		if hasMore, err = page.OuterHTML(".Feed-footer"); err != nil {
+			return nil, err
+		}
+	}
+
+	as, err := page.OuterHTML(".userDetailV3__main__list")
+	if err != nil {
+		return nil, err
+	}
+	return x.parseList(as)
+}
+
+// parseList 从频道主页的视频列表中提取标题和链接
+func (x xiguaSource) parseList(html string) ([]SourceVideo, error) {
+	dom, err := goquery.NewDocumentFromReader(strings.NewReader(html))
+	if err != nil {
+		return nil, err
+	}
+	nodes := dom.Find("div.HorizontalFeedCard__contentWrapper > div > a").Nodes
+	videos := make([]SourceVideo, 0, len(nodes))
+	for i := range nodes {
+		var video SourceVideo
+		node := nodes[i]
+		for index := range node.Attr {
+			attribute := node.Attr[index]
+			if attribute.Key == "href" {
+				video.PageUrl = x.CanonicalUrl(attribute.Val)
+			}
+			if attribute.Key == "title" {
+				video.Title = attribute.Val
+			}
+		}
+		video.MUrl = x.mobileUrl(video.PageUrl)
+		videos = append(videos, video)
+	}
+	return videos, nil
+}
+
+func (x xiguaSource) CanonicalUrl(href string) string {
+	if strings.HasPrefix(href, "http://") || strings.HasPrefix(href, "https://") {
+		return href
+	}
+	return x.webHost() + href
+}
+
+// mobileUrl 把网页端的播放地址转换成手机端的播放地址
+func (x xiguaSource) mobileUrl(pageUrl string) string {
+	return strings.ReplaceAll(pageUrl, x.webHost()+"/", x.mobileHostUrl()+"/")
+}
+
+func (x xiguaSource) ResolveDownloadUrl(ctx context.Context, pageUrl string) (string, error) {
+	u, err := url.Parse(pageUrl)
+	if err != nil {
+		return "", err
+	}
+	// 播放地址为 https://www.ixigua.com/视频ID
+	videoId := strings.Trim(u.Path, "/")
+	if videoId == "" || strings.Contains(videoId, "/") {
+		return "", fmt.Errorf("不是西瓜视频的播放地址 %q", pageUrl)
+	}
+	parse := x.parseVideoId
+	if parse == nil {
+		parse = parser.ParseVideoId
+	}
+	id, err := parse(parser.SourceXiGua, videoId)
+	if err != nil {
+		return "", err
+	}
+	return id.VideoUrl, nil
+}
+
+// UploadTime 西瓜视频的视频ID的高32位是发布时间的时间戳
+func (xiguaSource) UploadTime(pageUrl string) (time.Time, bool) {
+	u, err := url.Parse(pageUrl)
+	if err != nil {
+		return time.Time{}, false
+	}
+	id, err := strconv.ParseUint(strings.Trim(u.Path, "/"), 10, 64)
+	if err != nil {
+		return time.Time{}, false
+	}
+	t := time.Unix(int64(id>>32), 0)
+	// 不是这种格式的ID时算出来的时间不合理
+	if t.Year() < 2012 || t.After(time.Now().Add(24*time.Hour)) {
+		return time.Time{}, false
+	}
+	return t, true
+}
+
+// ResolveMobileUrl 用浏览器打开手机端的播放页面，从 video 标签中获取下载地址
+func (x xiguaSource) ResolveMobileUrl(ctx context.Context, conf Conf, mUrl string) (string, error) {
+	timeout, cancel := context.WithTimeout(ctx, time.Second*20)
+	defer cancel()
+	page, err := x.openPage(timeout, conf, mobileUserAgent)
+	if err != nil {
+		return "", err
+	}
+	defer page.Close()
+
+	if err = page.Navigate(mUrl); err != nil {
+		return "", err
+	}
+	if err = page.Sleep(time.Second * time.Duration(rand.Intn(5)+2)); err != nil {
+		return "", err
+	}
+	html, err := page.OuterHTML("video")
+	if err != nil {
+		return "", err
+	}
+	return parseMobileVideo(html, mUrl)
+}
+
+// parseMobileVideo 从 video 标签中取出下载地址，src 一般是 //开头的地址，按播放页面的协议补全
+func parseMobileVideo(html, mUrl string) (string, error) {
+	dom, err := goquery.NewDocumentFromReader(strings.NewReader(html))
+	if err != nil {
+		return "", err
+	}
+	src, ok := dom.Find("video[mediatype]").First().Attr("src")
+	if !ok || src == "" {
+		return "", errors.New("downloadUrl not found")
+	}
+	base, err := url.Parse(mUrl)
+	if err != nil {
+		return "", err
+	}
+	ref, err := url.Parse(src)
+	if err != nil {
+		return "", err
+	}
+	return base.ResolveReference(ref).String(), nil
+}
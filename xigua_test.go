@@ -0,0 +1,366 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"text/template"
+	"time"
+
+	"github.com/PuerkitoBio/goquery"
+	"github.com/wujunwei928/parse-video/parser"
+)
+
+// fakeXigua 本地的西瓜视频网站，页面来自 testdata/xigua 中录制的 html
+//
+//	/home/<id>/?scroll=N  频道主页，每滚动一次多加载一批视频，最后一批加载完后出现 Feed-footer 结束提示
+//	/video/<id>/          手机端播放页面，video 标签中是下载地址，已下架的视频没有 video 标签
+//	/media/<id>.mp4       视频文件
+type fakeXigua struct {
+	*httptest.Server
+	batches []string
+	titles  map[string]string
+	removed map[string]bool
+	video   []byte
+	channel *template.Template
+	mobile  *template.Template
+}
+
+const fakeXiguaRemoved = "7210000000000000007"
+
+func newFakeXigua(t *testing.T) *fakeXigua {
+	t.Helper()
+	dir := filepath.Join("testdata", "xigua")
+	f := &fakeXigua{titles: make(map[string]string), removed: map[string]bool{fakeXiguaRemoved: true}}
+	for i := 1; ; i++ {
+		data, err := os.ReadFile(filepath.Join(dir, "feed_"+strconv.Itoa(i)+".html"))
+		if errors.Is(err, os.ErrNotExist) {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.batches = append(f.batches, string(data))
+		dom, err := goquery.NewDocumentFromReader(bytes.NewReader(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		dom.Find("div.HorizontalFeedCard__contentWrapper > div > a").Each(func(_ int, a *goquery.Selection) {
+			f.titles[strings.Trim(a.AttrOr("href", ""), "/")] = a.AttrOr("title", "")
+		})
+	}
+	var err error
+	if f.video, err = os.ReadFile(filepath.Join(dir, "video.mp4")); err != nil {
+		t.Fatal(err)
+	}
+	f.channel = template.Must(template.ParseFiles(filepath.Join(dir, "channel.html")))
+	f.mobile = template.Must(template.ParseFiles(filepath.Join(dir, "mobile.html")))
+	removed, err := os.ReadFile(filepath.Join(dir, "removed.html"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/home/", func(w http.ResponseWriter, r *http.Request) {
+		scroll, _ := strconv.Atoi(r.URL.Query().Get("scroll"))
+		n := scroll + 1
+		if n > len(f.batches) {
+			n = len(f.batches)
+		}
+		footer := `<div class="Feed-footer">加载中...</div>`
+		if n == len(f.batches) {
+			footer = xiguaFooter
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		f.channel.Execute(w, map[string]interface{}{"Cards": strings.Join(f.batches[:n], ""), "Footer": footer, "Scroll": scroll})
+	})
+	mux.HandleFunc("/video/", func(w http.ResponseWriter, r *http.Request) {
+		// 手机端页面只给手机浏览器访问
+		if !strings.Contains(r.UserAgent(), "Mobile") {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		id := strings.Trim(strings.TrimPrefix(r.URL.Path, "/video/"), "/")
+		title, ok := f.titles[id]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		if f.removed[id] {
+			w.Write(removed)
+			return
+		}
+		f.mobile.Execute(w, map[string]string{"Title": title, "Src": "//" + r.Host + "/media/" + id + ".mp4"})
+	})
+	mux.HandleFunc("/media/", func(w http.ResponseWriter, r *http.Request) {
+		id := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/media/"), ".mp4")
+		if _, ok := f.titles[id]; !ok || f.removed[id] {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("ETag", `"`+id+`"`)
+		http.ServeContent(w, r, id+".mp4", time.Unix(1700000000, 0), bytes.NewReader(f.video))
+	})
+	f.Server = httptest.NewServer(mux)
+	t.Cleanup(f.Close)
+	return f
+}
+
+// source 指向本地网站的西瓜视频
+func (f *fakeXigua) source(browser Browser, parse func(source, videoId string) (*parser.VideoParseInfo, error)) xiguaSource {
+	return xiguaSource{host: f.URL, mobileHost: f.URL + "/video", browser: browser, parseVideoId: parse}
+}
+
+func (f *fakeXigua) channelUrl() string {
+	return f.URL + "/home/3000000000/"
+}
+
+func (f *fakeXigua) mediaUrl(id string) string {
+	return f.URL + "/media/" + id + ".mp4"
+}
+
+// useXigua 在测试期间替换默认的西瓜视频平台
+func useXigua(t *testing.T, x xiguaSource) {
+	old := sources
+	sources = append([]Source{x}, sources[1:]...)
+	t.Cleanup(func() { sources = old })
+}
+
+// httpBrowser 不需要 chrome 的浏览器，直接请求页面，滚动时带上 scroll 参数重新请求
+type httpBrowser struct{}
+
+func (httpBrowser) NewPage(ctx context.Context, conf Conf, userAgent string) (Page, error) {
+	return &httpPage{ctx: ctx, userAgent: userAgent}, nil
+}
+
+type httpPage struct {
+	ctx       context.Context
+	userAgent string
+	url       *url.URL
+	scroll    int
+	dom       *goquery.Document
+}
+
+func (p *httpPage) Navigate(rawUrl string) (err error) {
+	if p.url, err = url.Parse(rawUrl); err != nil {
+		return err
+	}
+	p.scroll = 0
+	return p.load()
+}
+
+func (p *httpPage) load() error {
+	u := *p.url
+	if p.scroll > 0 {
+		q := u.Query()
+		q.Set("scroll", strconv.Itoa(p.scroll))
+		u.RawQuery = q.Encode()
+	}
+	req, err := http.NewRequestWithContext(p.ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("User-Agent", p.userAgent)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: %s", u.String(), resp.Status)
+	}
+	p.dom, err = goquery.NewDocumentFromReader(resp.Body)
+	return err
+}
+
+func (p *httpPage) WaitVisible(sel string) error {
+	if p.dom.Find(sel).Length() == 0 {
+		return fmt.Errorf("%s 不存在", sel)
+	}
+	return nil
+}
+
+func (p *httpPage) ScrollToBottom() error {
+	p.scroll++
+	return p.load()
+}
+
+// OuterHTML 元素不存在时直接返回错误，chrome 会一直等到超时
+func (p *httpPage) OuterHTML(sel string) (string, error) {
+	s := p.dom.Find(sel).First()
+	if s.Length() == 0 {
+		return "", fmt.Errorf("%s 不存在", sel)
+	}
+	return goquery.OuterHtml(s)
+}
+
+func (p *httpPage) Sleep(d time.Duration) error {
+	return p.ctx.Err()
+}
+
+func (p *httpPage) Close() {}
+
+// testBrowsers 测试用的浏览器，本机安装了 chrome 时也用 chrome 测试，测试结束时关闭
+func testBrowsers(t *testing.T) map[string]Browser {
+	browsers := map[string]Browser{"http": httpBrowser{}}
+	for _, name := range []string{"google-chrome", "chromium", "chromium-browser", "chrome", "headless-shell"} {
+		if _, err := exec.LookPath(name); err == nil {
+			pool := NewBrowserPool(DefaultConf())
+			t.Cleanup(pool.Close)
+			browsers["chrome"] = pool
+			break
+		}
+	}
+	return browsers
+}
+
+func TestXiguaListVideos(t *testing.T) {
+	f := newFakeXigua(t)
+	for name, browser := range testBrowsers(t) {
+		t.Run(name, func(t *testing.T) {
+			if name == "chrome" && testing.Short() {
+				t.Skip("short 模式不启动 chrome")
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+			defer cancel()
+			videos, err := f.source(browser, nil).ListVideos(ctx, DefaultConf(), f.channelUrl())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(videos) != len(f.titles) {
+				t.Fatalf("videos = %d, want %d", len(videos), len(f.titles))
+			}
+			first := videos[0]
+			if first.Title != "牛歌戏 妹仔想当主人婆 第1集" || first.PageUrl != f.URL+"/7210000000000000001/" ||
+				first.MUrl != f.URL+"/video/7210000000000000001/" {
+				t.Errorf("first = %+v", first)
+			}
+			if last := videos[len(videos)-1]; last.PageUrl != f.URL+"/"+fakeXiguaRemoved+"/" {
+				t.Errorf("last = %+v", last)
+			}
+		})
+	}
+}
+
+func TestXiguaResolveMobileUrl(t *testing.T) {
+	f := newFakeXigua(t)
+	for name, browser := range testBrowsers(t) {
+		t.Run(name, func(t *testing.T) {
+			if name == "chrome" && testing.Short() {
+				t.Skip("short 模式不启动 chrome")
+			}
+			useXigua(t, f.source(browser, nil))
+			s := &Server{}
+			v := Video{Source: parser.SourceXiGua, MUrl: f.URL + "/video/7210000000000000002/"}
+			got, err := s.GetDownloadUrlChrome(context.Background(), DefaultConf(), v)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != f.mediaUrl("7210000000000000002") {
+				t.Errorf("url = %q", got)
+			}
+			if name == "chrome" {
+				// chrome 会一直等 video 标签出现直到超时
+				return
+			}
+			v.MUrl = f.URL + "/video/" + fakeXiguaRemoved + "/"
+			if got, err = s.GetDownloadUrlChrome(context.Background(), DefaultConf(), v); err == nil {
+				t.Errorf("已下架的视频 url = %q", got)
+			}
+		})
+	}
+}
+
+func TestXiguaResolveDownloadUrl(t *testing.T) {
+	x := xiguaSource{parseVideoId: func(source, videoId string) (*parser.VideoParseInfo, error) {
+		return &parser.VideoParseInfo{VideoUrl: "https://v.test/" + videoId + ".mp4"}, nil
+	}}
+	for _, pageUrl := range []string{"https://www.ixigua.com/7210000000000000001", "https://www.ixigua.com/7210000000000000001/"} {
+		if got, err := x.ResolveDownloadUrl(context.Background(), pageUrl); err != nil || got != "https://v.test/7210000000000000001.mp4" {
+			t.Errorf("%s = %q, %v", pageUrl, got, err)
+		}
+	}
+	// 没有视频ID的地址返回错误，不能 panic
+	for _, pageUrl := range []string{"https://www.ixigua.com", "https://www.ixigua.com/", "https://www.ixigua.com/home/104305645109/", ""} {
+		if _, err := x.ResolveDownloadUrl(context.Background(), pageUrl); err == nil {
+			t.Errorf("%q should fail", pageUrl)
+		}
+	}
+}
+
+func TestParseMobileVideo(t *testing.T) {
+	tests := map[string]struct {
+		html, mUrl, want string
+	}{
+		"协议相对地址": {`<video mediatype="video" src="//v3.ixigua.com/a.mp4"></video>`, "https://m.ixigua.com/video/1/", "https://v3.ixigua.com/a.mp4"},
+		"完整地址":   {`<video mediatype="video" src="http://v3.ixigua.com/a.mp4"></video>`, "https://m.ixigua.com/video/1/", "http://v3.ixigua.com/a.mp4"},
+		"没有src":  {`<video mediatype="video"></video>`, "https://m.ixigua.com/video/1/", ""},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			got, err := parseMobileVideo(tt.html, tt.mUrl)
+			if got != tt.want || (tt.want == "") != (err != nil) {
+				t.Errorf("got %q, %v, want %q", got, err, tt.want)
+			}
+		})
+	}
+}
+
+// TestXiguaPipeline 从频道主页开始，获取视频列表、下载地址，再下载到本地
+func TestXiguaPipeline(t *testing.T) {
+	f := newFakeXigua(t)
+	// 只有第一集能通过网页端的接口解析，其他的都要用手机端页面获取下载地址
+	useXigua(t, f.source(httpBrowser{}, func(source, videoId string) (*parser.VideoParseInfo, error) {
+		if videoId == "7210000000000000001" {
+			return &parser.VideoParseInfo{VideoUrl: f.mediaUrl(videoId)}, nil
+		}
+		return nil, errors.New("解析失败")
+	}))
+
+	store := NewMemoryStore()
+	if err := store.SaveChannel(&Channel{Url: f.channelUrl(), Source: parser.SourceXiGua, Folder: "牛歌戏", Enabled: true}); err != nil {
+		t.Fatal(err)
+	}
+	conf := DefaultConf()
+	conf.DownloadPath = t.TempDir()
+	conf.TitleRules = []TitleRule{{Type: RuleLiteral, Find: "牛歌戏 "}}
+	conf.Retry = RetryPolicy{MaxAttempts: 1}
+	conf.CheckMp4 = true
+	conf.Concurrency = 2
+	conf.GetUrl, conf.FillUrl, conf.Download = true, true, true
+
+	s := &Server{store: store}
+	if err := s.Run(context.Background(), conf); !errors.Is(err, errResolveFailed) {
+		t.Fatalf("Run err = %v", err)
+	}
+
+	counts, _ := store.CountByStatus()
+	if counts[StatusDownloaded] != 6 || counts[StatusFailed] != 1 {
+		t.Errorf("counts = %v", counts)
+	}
+	for _, name := range []string{"妹仔想当主人婆 第1集", "妹仔想当主人婆 第4集", "精彩片段", "精彩片段 (2)"} {
+		data, err := os.ReadFile(filepath.Join(conf.DownloadPath, "牛歌戏", name+".mp4"))
+		if err != nil || !bytes.Equal(data, f.video) {
+			t.Errorf("%s.mp4 = %d bytes, %v", name, len(data), err)
+		}
+	}
+	failed, _ := store.ListByStatus(context.Background(), StatusFailed)
+	if len(failed) != 1 || failed[0].OriginName != "牛歌戏 已下架的视频" {
+		t.Errorf("failed = %+v", failed)
+	}
+	v, _ := store.findByWebUrl(context.Background(), f.URL+"/7210000000000000002/")
+	if v.WebDownloadUrl != "" || v.MDownloadUrl != f.mediaUrl("7210000000000000002") || v.ETag != `"7210000000000000002"` {
+		t.Errorf("第2集 = %+v", v)
+	}
+}